@@ -0,0 +1,348 @@
+// Package anon runs the anonymous election of lab04 on one node: initiators
+// draw random IDs and start echo waves tagged with their round and ID, higher
+// waves extinguish lower ones, an initiator whose wave reached all nodes is
+// elected and one that tied with another initiator starts the next round. The
+// leader is then flooded with acknowledgements and the nodes are terminated
+// along the tree of the announcement.
+//
+// A node only handles the messages it is given and hands the messages it sends
+// to its environment, so the same handlers run on the network of the lab04
+// nodes and in the simulator of anonsim, which runs many nodes in one process.
+package anon
+
+import (
+	"io"
+	"log"
+)
+
+// Messages of the anonymous election. DONE acknowledges the leader
+// announcement once a node and its subtree know the leader and have delivered
+// all their messages, TERMINATE terminates a child in the tree of the
+// announcement.
+const (
+	PING      = "ping"
+	PONG      = "pong"
+	ELECTED   = "elected"
+	DONE      = "done"
+	TERMINATE = "#TERMINATE#"
+)
+
+// Message is a message of the election, sent From the port of a node. Leader
+// and Round tag the wave or announcement it belongs to, Size is the number of
+// nodes in the subtree of the sender or, in an announcement, in the wave of
+// the leader.
+type Message struct {
+	From   string
+	Kind   string
+	Leader int
+	Round  int
+	Size   int
+}
+
+// Wave is the state of a node in the echo wave it takes part in. A wave is
+// tagged with the Round it was started in and the random Id drawn by its
+// initiator. Parent is the port of the neighbour the wave arrived from (empty
+// for the initiator), Pending holds the ports of the neighbours whose echo is
+// still awaited, nil once the wave completed, and Size is the number of nodes
+// in the subtree of the node.
+type Wave struct {
+	Round   int
+	Id      int
+	Parent  string
+	Pending map[string]bool
+	Size    int
+}
+
+// Env is the network a node runs on and the rest of the program around it.
+type Env interface {
+	// Send sends msg to the neighbour with port to.
+	Send(to string, msg Message)
+	// RandomId draws the random ID of a new round.
+	RandomId() int
+	// ReachedAll reports whether a wave that reached size nodes reached the
+	// whole network.
+	ReachedAll(size int) bool
+	// Joined is called when the node started wave w as initiator, with an
+	// empty Parent, or joined the wave w of a neighbour.
+	Joined(w Wave)
+	// Completed is called when all neighbours replied to the wave w of the
+	// node.
+	Completed(w Wave)
+	// Decided is called when the node learned the leader from announcement
+	// msg, sent by the node itself if it was elected.
+	Decided(msg Message)
+	// Announced is called on the leader once all size nodes know it.
+	Announced(size int)
+	// Terminated is called when the node terminated.
+	Terminated()
+}
+
+// Node is a node of the anonymous election with the given Port and the ports
+// of its Neighbours, which runs on Env and logs to Log. Wave is the wave it
+// takes part in and Leader and Round are the ID and round of the leader it
+// knows. Once it Decided on the leader, AnnounceParent is the neighbour the
+// announcement came from, AnnouncePending holds the neighbours yet to
+// acknowledge it and AnnounceChildren the children in its tree, with
+// AnnounceSize nodes in the subtree of the node. AnnounceAcked is set once the
+// node acknowledged it.
+type Node struct {
+	Port       string
+	Neighbours []string
+	Env        Env
+	Log        *log.Logger
+
+	Wave             Wave
+	Leader           int
+	Round            int
+	Decided          bool
+	AnnounceParent   string
+	AnnouncePending  map[string]bool
+	AnnounceChildren map[string]bool
+	AnnounceSize     int
+	AnnounceAcked    bool
+}
+
+// NewNode returns the node with port and the ports of its neighbours, in the
+// order of the config file, that runs on env and does not log.
+func NewNode(port string, neighbours []string, env Env) *Node {
+	return &Node{
+		Port:             port,
+		Neighbours:       append([]string(nil), neighbours...),
+		Env:              env,
+		Log:              log.New(io.Discard, "", 0),
+		AnnouncePending:  make(map[string]bool),
+		AnnounceChildren: make(map[string]bool),
+		AnnounceSize:     1,
+	}
+}
+
+// Initiate starts the first round of the election, unless a wave of another
+// initiator reached the node first.
+func (n *Node) Initiate() {
+	if n.Wave.Pending != nil || n.Wave.Parent != "" {
+		n.Log.Printf("Not initiating, already part of the wave of ID %d in round %d.\n", n.Wave.Id, n.Wave.Round)
+		return
+	}
+
+	n.startRound(1)
+}
+
+// Handle handles msg. Once the node knows the leader it no longer takes part
+// in any wave.
+func (n *Node) Handle(msg Message) {
+	switch msg.Kind {
+	case PING:
+		if !n.Decided {
+			n.receivePing(msg)
+		}
+	case PONG:
+		if !n.Decided {
+			n.receivePong(msg)
+		}
+	case ELECTED:
+		n.receiveLeader(msg)
+	case DONE:
+		if n.AnnouncePending[msg.From] {
+			delete(n.AnnouncePending, msg.From)
+			if msg.Size > 0 {
+				n.AnnounceChildren[msg.From] = true
+				n.AnnounceSize += msg.Size
+			}
+			n.checkDone()
+		}
+	case TERMINATE:
+		if n.Decided && msg.From == n.AnnounceParent {
+			n.Terminate()
+		}
+	}
+}
+
+// Children returns the children of the node in the tree of the announcement,
+// in the order of its neighbours.
+func (n *Node) Children() []string {
+	children := make([]string, 0)
+	for _, port := range n.Neighbours {
+		if n.AnnounceChildren[port] {
+			children = append(children, port)
+		}
+	}
+
+	return children
+}
+
+// Terminate sends TERMINATE to the children of the node in the tree of the
+// announcement and terminates the node. It is called once no message of the
+// election is in flight any more.
+func (n *Node) Terminate() {
+	for _, port := range n.Children() {
+		n.Env.Send(port, Message{From: n.Port, Kind: TERMINATE, Leader: n.Leader, Round: n.Round})
+	}
+
+	n.Env.Terminated()
+}
+
+// startRound starts a wave in round with a fresh random ID and the node as
+// initiator.
+func (n *Node) startRound(round int) {
+	id := n.Env.RandomId()
+	n.Leader, n.Round = id, round
+	n.Wave = Wave{
+		Round:   round,
+		Id:      id,
+		Pending: make(map[string]bool),
+		Size:    1,
+	}
+
+	n.Log.Printf("Starting round %d with ID %d.\n", round, id)
+	n.Env.Joined(n.Wave)
+	n.sendWave()
+}
+
+// sendWave sends the wave of the node to all neighbours except its parent.
+func (n *Node) sendWave() {
+	for _, port := range n.Neighbours {
+		if port == n.Wave.Parent {
+			continue
+		}
+
+		n.Wave.Pending[port] = true
+		n.Env.Send(port, Message{From: n.Port, Kind: PING, Leader: n.Wave.Id, Round: n.Wave.Round})
+	}
+
+	n.checkRound()
+}
+
+// compareWave compares the tag of msg with the tag of the wave of the node and
+// returns -1, 0 or 1 if it is lower, equal or higher.
+func (n *Node) compareWave(msg Message) int {
+	switch {
+	case msg.Round > n.Wave.Round || msg.Round == n.Wave.Round && msg.Leader > n.Wave.Id:
+		return 1
+	case msg.Round < n.Wave.Round || msg.Round == n.Wave.Round && msg.Leader < n.Wave.Id:
+		return -1
+	}
+
+	return 0
+}
+
+// receivePing handles the wave message of a neighbour. Waves with a lower tag
+// than the current one are extinguished and a wave with a higher tag is
+// joined, which makes an initiator give up its own wave. A wave message with
+// the tag of the current wave counts as a reply, whether it comes from the
+// same wave or from another initiator that drew the same ID in the same round.
+func (n *Node) receivePing(msg Message) {
+	switch n.compareWave(msg) {
+	case 0:
+		delete(n.Wave.Pending, msg.From)
+		n.checkRound()
+		return
+	case -1:
+		n.Log.Printf("Extinguishing wave of ID %d in round %d.\n", msg.Leader, msg.Round)
+		return
+	}
+
+	n.Log.Printf("Joining wave of ID %d in round %d, parent is %s.\n", msg.Leader, msg.Round, msg.From)
+	n.Leader, n.Round = msg.Leader, msg.Round
+	n.Wave = Wave{
+		Round:   msg.Round,
+		Id:      msg.Leader,
+		Parent:  msg.From,
+		Pending: make(map[string]bool),
+		Size:    1,
+	}
+
+	n.Env.Joined(n.Wave)
+	n.sendWave()
+}
+
+// receivePong handles the echo of a child in the current wave, which carries
+// the size of its subtree.
+func (n *Node) receivePong(msg Message) {
+	if n.compareWave(msg) != 0 || n.Wave.Pending == nil || !n.Wave.Pending[msg.From] {
+		return
+	}
+
+	n.Log.Printf("Received reply from %s.\n", msg.From)
+	n.Wave.Size += msg.Size
+	delete(n.Wave.Pending, msg.From)
+
+	n.checkRound()
+}
+
+// checkRound completes the current wave once all neighbours replied. Every
+// node but the initiator echoes the size of its subtree to its parent. The
+// initiator is elected if its wave reached all nodes of the network.
+// Otherwise another initiator drew the same ID in the same round and the
+// waves split the network between them, so the initiator starts the next
+// round with a new ID.
+func (n *Node) checkRound() {
+	if n.Wave.Pending == nil || len(n.Wave.Pending) > 0 {
+		return
+	}
+	n.Wave.Pending = nil
+	n.Env.Completed(n.Wave)
+
+	if n.Wave.Parent != "" {
+		n.Env.Send(n.Wave.Parent, Message{From: n.Port, Kind: PONG, Leader: n.Wave.Id, Round: n.Wave.Round, Size: n.Wave.Size})
+		return
+	}
+
+	if !n.Env.ReachedAll(n.Wave.Size) {
+		n.Log.Printf("Tie in round %d, the wave of ID %d only reached %d nodes.\n", n.Wave.Round, n.Wave.Id, n.Wave.Size)
+		n.startRound(n.Wave.Round + 1)
+		return
+	}
+
+	n.receiveLeader(Message{From: n.Port, Kind: ELECTED, Leader: n.Wave.Id, Round: n.Wave.Round, Size: n.Wave.Size})
+}
+
+// receiveLeader records the leader announced by a neighbour, or by the node
+// itself once it has been elected. The announcement is flooded to all
+// neighbours and the neighbour it first arrived from becomes the parent of the
+// node, so the announcement reaches the nodes of waves the leader did not win
+// too. Later announcements are answered right away with an empty
+// acknowledgement.
+func (n *Node) receiveLeader(msg Message) {
+	if n.Decided {
+		if msg.From != n.Port && msg.From != n.AnnounceParent {
+			n.Env.Send(msg.From, Message{From: n.Port, Kind: DONE, Leader: n.Leader, Round: n.Round})
+		}
+		return
+	}
+
+	n.Decided = true
+	n.Leader, n.Round = msg.Leader, msg.Round
+	if msg.From != n.Port {
+		n.AnnounceParent = msg.From
+	}
+	n.Env.Decided(msg)
+
+	for _, port := range n.Neighbours {
+		if port == n.AnnounceParent {
+			continue
+		}
+
+		n.AnnouncePending[port] = true
+		n.Env.Send(port, Message{From: n.Port, Kind: ELECTED, Leader: msg.Leader, Round: msg.Round, Size: msg.Size})
+	}
+
+	n.checkDone()
+}
+
+// checkDone acknowledges the announcement to the parent once all neighbours
+// it was sent to answered, carrying the number of nodes in the subtree of the
+// node. Once the leader has all acknowledgements every node knows the leader.
+func (n *Node) checkDone() {
+	if len(n.AnnouncePending) > 0 || n.AnnounceAcked {
+		return
+	}
+	n.AnnounceAcked = true
+
+	if n.AnnounceParent == "" {
+		n.Log.Printf("All %d nodes know the leader.\n", n.AnnounceSize)
+		n.Env.Announced(n.AnnounceSize)
+		return
+	}
+
+	n.Env.Send(n.AnnounceParent, Message{From: n.Port, Kind: DONE, Leader: n.Leader, Round: n.Round, Size: n.AnnounceSize})
+}
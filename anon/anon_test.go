@@ -0,0 +1,88 @@
+package anon
+
+import (
+	"strconv"
+	"testing"
+)
+
+// testNetwork delivers the messages of its nodes in the order they were sent
+// and hands every node the IDs in ids in turn.
+type testNetwork struct {
+	nodes      []*Node
+	queue      []delivery
+	ids        [][]int
+	elected    []int
+	announced  int
+	terminated int
+}
+
+// delivery is a message in flight to the node with index to.
+type delivery struct {
+	to  int
+	msg Message
+}
+
+// testEnv is the environment of the node with index idx.
+type testEnv struct {
+	net *testNetwork
+	idx int
+}
+
+func (e testEnv) Send(to string, msg Message) {
+	idx, _ := strconv.Atoi(to)
+	e.net.queue = append(e.net.queue, delivery{idx, msg})
+}
+
+func (e testEnv) RandomId() int {
+	id := e.net.ids[e.idx][0]
+	e.net.ids[e.idx] = e.net.ids[e.idx][1:]
+	return id
+}
+
+func (e testEnv) ReachedAll(size int) bool { return size >= len(e.net.nodes) }
+func (e testEnv) Joined(w Wave)            {}
+func (e testEnv) Completed(w Wave)         {}
+
+func (e testEnv) Decided(msg Message) {
+	if msg.From == e.net.nodes[e.idx].Port {
+		e.net.elected = append(e.net.elected, e.idx)
+	}
+}
+
+func (e testEnv) Announced(size int) {
+	e.net.announced = size
+	e.net.nodes[e.idx].Terminate()
+}
+
+func (e testEnv) Terminated() { e.net.terminated++ }
+
+// TestTieStartsNextRound runs the election on a ring of four nodes whose two
+// initiators draw the same ID in the first round, so that their waves split
+// the ring, and different IDs in the second.
+func TestTieStartsNextRound(t *testing.T) {
+	net := &testNetwork{ids: [][]int{{3, 1}, nil, {3, 2}, nil}}
+	for idx := 0; idx < 4; idx++ {
+		left, right := strconv.Itoa((idx+3)%4), strconv.Itoa((idx+1)%4)
+		net.nodes = append(net.nodes, NewNode(strconv.Itoa(idx), []string{left, right}, testEnv{net, idx}))
+	}
+
+	net.nodes[0].Initiate()
+	net.nodes[2].Initiate()
+	for len(net.queue) > 0 {
+		d := net.queue[0]
+		net.queue = net.queue[1:]
+		net.nodes[d.to].Handle(d.msg)
+	}
+
+	if len(net.elected) != 1 || net.elected[0] != 2 {
+		t.Fatalf("elected nodes %v, expected node 2 only", net.elected)
+	}
+	for idx, n := range net.nodes {
+		if !n.Decided || n.Leader != 2 || n.Round != 2 {
+			t.Errorf("node %d decided %v on ID %d in round %d, expected ID 2 in round 2", idx, n.Decided, n.Leader, n.Round)
+		}
+	}
+	if net.announced != 4 || net.terminated != 4 {
+		t.Errorf("%d nodes announced and %d terminated, expected 4", net.announced, net.terminated)
+	}
+}
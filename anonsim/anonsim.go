@@ -0,0 +1,881 @@
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"distributed-systems/anon"
+)
+
+// SOURCE labels the results: they are measured by running the handlers of
+// the lab04 nodes on a simulated network, not on the lab04 nodes.
+const SOURCE = "simulation"
+
+// message is a message in flight between two simulated nodes, delivered At a
+// simulated time measured in mean message delays.
+type message struct {
+	At   float64
+	Seq  int
+	From int
+	To   int
+	Msg  anon.Message
+}
+
+// queue orders the messages in flight by delivery time, breaking ties by the
+// order in which they were sent.
+type queue []message
+
+func (q queue) Len() int { return len(q) }
+func (q queue) Less(i, j int) bool {
+	return q[i].At < q[j].At || q[i].At == q[j].At && q[i].Seq < q[j].Seq
+}
+func (q queue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *queue) Push(x interface{}) { *q = append(*q, x.(message)) }
+func (q *queue) Pop() interface{} {
+	old := *q
+	m := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return m
+}
+
+// flight identifies a message in flight by the fields the lab04 nodes log
+// with it. Fields that do not matter for a kind are left 0.
+type flight struct {
+	From  int
+	To    int
+	Kind  string
+	Round int
+	Id    int
+	Size  int
+}
+
+// step is the next thing a node of a replayed run did: initiate the election
+// or receive a message.
+type step struct {
+	Initiate bool
+	Msg      flight
+}
+
+// event is the part of an entry of the event log of a lab04 node that the
+// replay needs.
+type event struct {
+	Node    string                 `json:"node"`
+	Type    string                 `json:"type"`
+	Peer    string                 `json:"peer,omitempty"`
+	Message map[string]interface{} `json:"message,omitempty"`
+	Detail  string                 `json:"detail,omitempty"`
+}
+
+// host is the simulated network and ID source of the node with index idx,
+// which the handlers of package anon run on.
+type host struct {
+	sim *simulation
+	idx int
+}
+
+// result describes a single simulated election.
+type result struct {
+	Source           string  `json:"source"`
+	Topology         string  `json:"topology"`
+	Nodes            int     `json:"nodes"`
+	IdRange          int     `json:"idRange"`
+	Run              int     `json:"run"`
+	Elected          bool    `json:"elected"`
+	Rounds           int     `json:"rounds"`
+	Ties             int     `json:"ties"`
+	ElectionMessages int     `json:"electionMessages"`
+	Messages         int     `json:"messages"`
+	ElectionTime     float64 `json:"electionTime"`
+	Time             float64 `json:"time"`
+}
+
+// summary holds the statistics of all runs of one setting.
+type summary struct {
+	Source   string           `json:"source"`
+	Topology string           `json:"topology"`
+	Nodes    int              `json:"nodes"`
+	IdRange  int              `json:"idRange"`
+	Runs     int              `json:"runs"`
+	Failed   int              `json:"failed"`
+	Stats    map[string]stats `json:"stats"`
+}
+
+// stats are the statistics of one measure over the runs of a setting.
+type stats struct {
+	Mean   float64 `json:"mean"`
+	StdDev float64 `json:"stddev"`
+	Min    float64 `json:"min"`
+	Median float64 `json:"median"`
+	P95    float64 `json:"p95"`
+	Max    float64 `json:"max"`
+}
+
+// simulation runs one election with the handlers of the lab04 nodes. Every
+// message takes an exponentially distributed delay with mean 1, so messages
+// between two nodes may overtake each other just like the messages of the
+// lab04 nodes, which dial a new connection for every message. A replayed run
+// keeps its messages InFlight instead, until the node receives them in the
+// order of the lab04 run, and the nodes draw the Ids they drew in that run.
+// Mismatch describes the first difference between the simulation and the run.
+type simulation struct {
+	Nodes     []*anon.Node
+	IdRange   int
+	MaxRounds int
+	Rand      *rand.Rand
+	Queue     queue
+	Now       float64
+	Seq       int
+	Result    result
+	Leader    int
+	InFlight  map[flight]int
+	Ids       [][]int
+	Mismatch  string
+}
+
+func main() {
+	// Setup and parse CLI flags.
+	runs := flag.Int("runs", 1000, "Number of elections per setting.")
+	topologies := flag.String("topology", "ring", "Comma separated topologies: ring, line, star, complete, grid or random.")
+	sizes := flag.String("nodes", "5", "Comma separated network sizes.")
+	idRanges := flag.String("ids", "n", "Comma separated ID ranges, a number or a multiple of the network size such as 2n.")
+	initiators := flag.Float64("initiators", 1, "Fraction of the nodes that initiate, at least one node always does.")
+	edgeProb := flag.Float64("edge-prob", 0.2, "Probability of every extra edge of the random topology.")
+	maxRounds := flag.Int("max-rounds", 1000, "Give up on an election after this many rounds.")
+	seed := flag.Int64("seed", 0, "Seed of the simulation, 0 to seed from the time.")
+	format := flag.String("format", "csv", "Output format: csv or json.")
+	outFile := flag.String("out", "", "Path to write the results to, stdout if empty.")
+	replay := flag.Bool("replay", false, "Replay the run of lab04 whose event logs are given as arguments, on the config directory given as topology.")
+	flag.Parse()
+
+	if *replay {
+		replayRun(*topologies, flag.Args())
+		return
+	}
+
+	if *runs <= 0 {
+		panic("Invalid number of runs, please pass a positive number.")
+	}
+	if *format != "csv" && *format != "json" {
+		panic("Invalid format, please pass csv or json.")
+	}
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	log.Printf("Seed is %d.\n", *seed)
+	log.Println("Simulating the lab04 election on a simulated network, not on the lab04 nodes.")
+	r := rand.New(rand.NewSource(*seed))
+
+	results := make([]result, 0)
+	summaries := make([]summary, 0)
+	for _, topology := range strings.Split(*topologies, ",") {
+		settingSizes := parseSizes(*sizes)
+		if isConfigDir(topology) {
+			neighbours, _ := readConfigTopology(topology)
+			settingSizes = []int{len(neighbours)}
+		}
+
+		for _, size := range settingSizes {
+			for _, idRange := range parseIdRanges(*idRanges, size) {
+				setting := make([]result, 0, *runs)
+				for run := 1; run <= *runs; run++ {
+					neighbours := buildTopology(topology, size, *edgeProb, r)
+					sim := simulation{IdRange: idRange, MaxRounds: *maxRounds, Rand: r}
+					res := sim.run(neighbours, *initiators)
+					res.Source, res.Topology, res.Nodes, res.IdRange, res.Run = SOURCE, topology, size, idRange, run
+					setting = append(setting, res)
+				}
+
+				s := summarize(setting)
+				log.Printf("%s of %d nodes, IDs 1-%d: %.2f rounds, %.1f messages and %.2f delays on average, %d of %d runs failed.\n",
+					topology, size, idRange, s.Stats["rounds"].Mean, s.Stats["messages"].Mean, s.Stats["time"].Mean, s.Failed, s.Runs)
+				results = append(results, setting...)
+				summaries = append(summaries, s)
+			}
+		}
+	}
+
+	out := os.Stdout
+	if *outFile != "" {
+		f, err := os.Create(*outFile)
+		if err != nil {
+			panic("Error creating output file.")
+		}
+		defer f.Close()
+		out = f
+	}
+
+	if *format == "json" {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(map[string]interface{}{"source": SOURCE, "runs": results, "summary": summaries}); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	writeCSV(out, results)
+	writeSummary(os.Stderr, summaries)
+}
+
+// parseSizes parses the comma separated network sizes.
+func parseSizes(list string) []int {
+	sizes := make([]int, 0)
+	for _, field := range strings.Split(list, ",") {
+		size, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || size < 1 {
+			panic("Invalid network size " + field + ", please pass positive numbers.")
+		}
+		sizes = append(sizes, size)
+	}
+
+	return sizes
+}
+
+// parseIdRanges parses the comma separated ID ranges for a network of size
+// nodes. A range ending in n is a multiple of the network size.
+func parseIdRanges(list string, size int) []int {
+	ranges := make([]int, 0)
+	for _, field := range strings.Split(list, ",") {
+		field = strings.TrimSpace(field)
+
+		idRange := 0
+		if strings.HasSuffix(field, "n") {
+			factor := 1.0
+			if field != "n" {
+				var err error
+				if factor, err = strconv.ParseFloat(strings.TrimSuffix(field, "n"), 64); err != nil {
+					panic("Invalid ID range " + field + ".")
+				}
+			}
+			idRange = int(math.Ceil(factor * float64(size)))
+		} else {
+			var err error
+			if idRange, err = strconv.Atoi(field); err != nil {
+				panic("Invalid ID range " + field + ".")
+			}
+		}
+
+		if idRange < 1 {
+			panic("Invalid ID range " + field + ", it has to hold at least one ID.")
+		}
+		ranges = append(ranges, idRange)
+	}
+
+	return ranges
+}
+
+// isConfigDir checks if topology names a directory of lab04 config files.
+func isConfigDir(topology string) bool {
+	info, err := os.Stat(topology)
+	return err == nil && info.IsDir()
+}
+
+// readConfigTopology reads the network of the lab04 config files in dir and
+// returns the neighbours of every node and its host:port, in the order of the
+// files.
+func readConfigTopology(dir string) ([][]int, []string) {
+	paths, err := filepath.Glob(filepath.Join(dir, "configFile_*.txt"))
+	if err != nil || len(paths) == 0 {
+		panic("No config files in " + dir + ".")
+	}
+	sort.Strings(paths)
+
+	lines := make([][]string, 0, len(paths))
+	addrs := make([]string, 0, len(paths))
+	index := make(map[string]int)
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			panic("Error reading config file " + path + ".")
+		}
+
+		fields := strings.Fields(string(data))
+		if len(fields) == 0 {
+			panic("Empty config file " + path + ".")
+		}
+		parts := strings.Split(fields[0], ":")
+		if len(parts) < 2 {
+			panic("Invalid first line in config file " + path + ".")
+		}
+
+		addr := parts[0] + ":" + parts[1]
+		index[addr] = len(addrs)
+		addrs = append(addrs, addr)
+		lines = append(lines, fields[1:])
+	}
+
+	neighbours := make([][]int, len(addrs))
+	for idx, list := range lines {
+		for _, addr := range list {
+			other, ok := index[addr]
+			if !ok {
+				panic("Neighbour " + addr + " of " + addrs[idx] + " has no config file in " + dir + ".")
+			}
+			neighbours[idx] = append(neighbours[idx], other)
+		}
+	}
+
+	return neighbours, addrs
+}
+
+// buildTopology returns the neighbours of every node of a connected network of
+// size nodes. The random topology is a random spanning tree with every other
+// edge added with probability edgeProb, a directory of lab04 config files
+// gives the network of the nodes configured in it.
+func buildTopology(topology string, size int, edgeProb float64, r *rand.Rand) [][]int {
+	if isConfigDir(topology) {
+		neighbours, _ := readConfigTopology(topology)
+		return neighbours
+	}
+
+	edges := make(map[[2]int]bool)
+	connect := func(a int, b int) {
+		if a == b {
+			return
+		}
+		if a > b {
+			a, b = b, a
+		}
+		edges[[2]int{a, b}] = true
+	}
+
+	switch topology {
+	case "ring":
+		for idx := 0; idx < size; idx++ {
+			connect(idx, (idx+1)%size)
+		}
+	case "line":
+		for idx := 1; idx < size; idx++ {
+			connect(idx-1, idx)
+		}
+	case "star":
+		for idx := 1; idx < size; idx++ {
+			connect(0, idx)
+		}
+	case "complete":
+		for a := 0; a < size; a++ {
+			for b := a + 1; b < size; b++ {
+				connect(a, b)
+			}
+		}
+	case "grid":
+		width := int(math.Ceil(math.Sqrt(float64(size))))
+		for idx := 0; idx < size; idx++ {
+			if idx%width > 0 {
+				connect(idx-1, idx)
+			}
+			if idx >= width {
+				connect(idx-width, idx)
+			}
+		}
+	case "random":
+		for idx := 1; idx < size; idx++ {
+			connect(r.Intn(idx), idx)
+		}
+		for a := 0; a < size; a++ {
+			for b := a + 1; b < size; b++ {
+				if r.Float64() < edgeProb {
+					connect(a, b)
+				}
+			}
+		}
+	default:
+		panic("Invalid topology " + topology + ", please pass ring, line, star, complete, grid, random or a config directory.")
+	}
+
+	neighbours := make([][]int, size)
+	for edge := range edges {
+		neighbours[edge[0]] = append(neighbours[edge[0]], edge[1])
+		neighbours[edge[1]] = append(neighbours[edge[1]], edge[0])
+	}
+	for _, list := range neighbours {
+		sort.Ints(list)
+	}
+
+	return neighbours
+}
+
+// run simulates an election on the network given by neighbours, in which each
+// node initiates with probability initiators, and checks that all nodes agree
+// on a single leader.
+func (sim *simulation) run(neighbours [][]int, initiators float64) result {
+	sim.setup(neighbours)
+	initiator := make([]bool, len(sim.Nodes))
+	for idx := range initiator {
+		initiator[idx] = sim.Rand.Float64() < initiators
+	}
+	initiator[sim.Rand.Intn(len(sim.Nodes))] = true
+
+	for idx, n := range sim.Nodes {
+		if initiator[idx] {
+			n.Initiate()
+		}
+	}
+
+	for sim.Queue.Len() > 0 {
+		msg := heap.Pop(&sim.Queue).(message)
+		sim.Now = msg.At
+		sim.Nodes[msg.To].Handle(msg.Msg)
+
+		if sim.Result.Rounds > sim.MaxRounds {
+			sim.Result.Elected = false
+			return sim.Result
+		}
+	}
+
+	if sim.Leader < 0 {
+		return sim.Result
+	}
+	for idx, n := range sim.Nodes {
+		if !n.Decided {
+			panic(fmt.Sprintf("Node %d does not know the leader.", idx))
+		}
+	}
+	sim.Result.Elected = true
+
+	return sim.Result
+}
+
+// setup creates the nodes of the network given by neighbours. The port of a
+// node is its index.
+func (sim *simulation) setup(neighbours [][]int) {
+	sim.Nodes = make([]*anon.Node, len(neighbours))
+	for idx := range sim.Nodes {
+		ports := make([]string, 0, len(neighbours[idx]))
+		for _, other := range neighbours[idx] {
+			ports = append(ports, strconv.Itoa(other))
+		}
+		sim.Nodes[idx] = anon.NewNode(strconv.Itoa(idx), ports, host{sim, idx})
+	}
+	sim.Leader = -1
+}
+
+// send puts a message from one node to another in flight.
+func (sim *simulation) send(from int, to int, msg anon.Message) {
+	if sim.InFlight != nil {
+		sim.InFlight[flightOf(from, to, msg.Kind, msg.Round, msg.Leader, msg.Size)]++
+	} else {
+		sim.Seq++
+		heap.Push(&sim.Queue, message{
+			At:   sim.Now + sim.Rand.ExpFloat64(),
+			Seq:  sim.Seq,
+			From: from,
+			To:   to,
+			Msg:  msg,
+		})
+	}
+
+	sim.Result.Messages++
+	if msg.Kind == anon.PING || msg.Kind == anon.PONG {
+		sim.Result.ElectionMessages++
+	}
+}
+
+// Send puts msg in flight to the neighbour with port to.
+func (h host) Send(to string, msg anon.Message) {
+	idx, _ := strconv.Atoi(to)
+	h.sim.send(h.idx, idx, msg)
+}
+
+// RandomId draws a fresh random ID, or the next ID the node drew in a
+// replayed run.
+func (h host) RandomId() int {
+	sim := h.sim
+	if sim.Ids == nil {
+		return sim.Rand.Intn(sim.IdRange) + 1
+	}
+
+	id := 0
+	if len(sim.Ids[h.idx]) > 0 {
+		id, sim.Ids[h.idx] = sim.Ids[h.idx][0], sim.Ids[h.idx][1:]
+	} else if sim.Mismatch == "" {
+		sim.Mismatch = fmt.Sprintf("node %d starts a round it did not start in lab04", h.idx)
+	}
+
+	return id
+}
+
+// ReachedAll reports whether a wave reached every node of the network.
+func (h host) ReachedAll(size int) bool {
+	return size >= len(h.sim.Nodes)
+}
+
+// Joined counts the rounds and the ties after which an initiator started the
+// next round.
+func (h host) Joined(w anon.Wave) {
+	if w.Parent != "" {
+		return
+	}
+
+	if w.Round > h.sim.Result.Rounds {
+		h.sim.Result.Rounds = w.Round
+	}
+	if w.Round > 1 {
+		h.sim.Result.Ties++
+	}
+}
+
+// Completed does nothing, the simulation only measures whole rounds.
+func (h host) Completed(w anon.Wave) {}
+
+// Decided records the time the leader was elected and checks that no other
+// node was.
+func (h host) Decided(msg anon.Message) {
+	if msg.From != h.sim.Nodes[h.idx].Port {
+		return
+	}
+
+	if h.sim.Leader >= 0 {
+		panic(fmt.Sprintf("Nodes %d and %d were both elected.", h.sim.Leader, h.idx))
+	}
+	h.sim.Leader = h.idx
+	h.sim.Result.ElectionTime = h.sim.Now
+}
+
+// Announced terminates the nodes along the tree of the announcement once all
+// of them know the leader. The simulated network loses no message, so unlike
+// the lab04 nodes the leader does not detect termination first.
+func (h host) Announced(size int) {
+	if size != len(h.sim.Nodes) {
+		panic(fmt.Sprintf("Only %d of %d nodes know the leader.", size, len(h.sim.Nodes)))
+	}
+
+	h.sim.Result.Time = h.sim.Now
+	h.sim.Nodes[h.idx].Terminate()
+}
+
+// Terminated does nothing, a simulated node stops once no message is in
+// flight to it.
+func (h host) Terminated() {}
+
+// flightOf returns the message in flight with the fields that matter for its
+// kind. Echoes and acknowledgements carry the size of a subtree, the size an
+// announcement of the leader carries is only logged, and the message to
+// terminate carries nothing the election uses.
+func flightOf(from int, to int, kind string, round int, id int, size int) flight {
+	switch kind {
+	case anon.PING, anon.ELECTED:
+		size = 0
+	case anon.DONE:
+		round, id = 0, 0
+	case anon.TERMINATE:
+		round, id, size = 0, 0, 0
+	}
+
+	return flight{From: from, To: to, Kind: kind, Round: round, Id: id, Size: size}
+}
+
+// replayRun replays the run of lab04 whose event logs are at paths on the
+// network of the config directory dir. Every node draws the IDs it drew in the
+// run and handles the messages it received in the order it received them.
+// The simulation matches the run if it sent exactly the messages the nodes
+// received and they decided on the same leader in the same round.
+func replayRun(dir string, paths []string) {
+	if !isConfigDir(dir) {
+		panic("Invalid topology " + dir + ", replaying needs the config directory of the run.")
+	}
+	if len(paths) == 0 {
+		panic("No event logs given, pass the event log of every node as arguments.")
+	}
+
+	neighbours, addrs := readConfigTopology(dir)
+	steps, ids, decisions := readRun(addrs, paths)
+
+	sim := simulation{InFlight: make(map[flight]int), Ids: ids}
+	res := sim.replay(neighbours, steps)
+	if sim.Mismatch == "" {
+		sim.Mismatch = sim.compareDecisions(decisions)
+	}
+	if sim.Mismatch != "" {
+		log.Fatalf("The simulation does not match the lab04 run: %s.\n", sim.Mismatch)
+	}
+
+	log.Printf("The simulation matches the lab04 run: %d rounds, %d ties, %d election messages and %d messages.\n",
+		res.Rounds, res.Ties, res.ElectionMessages, res.Messages)
+}
+
+// readRun reads the event logs of a lab04 run at paths and returns what every
+// node at addrs did in turn, the IDs it drew and the round and ID of the
+// leader it decided on.
+func readRun(addrs []string, paths []string) ([][]step, [][]int, [][2]int) {
+	index := make(map[string]int)
+	for idx, addr := range addrs {
+		index[addr] = idx
+	}
+
+	steps := make([][]step, len(addrs))
+	ids := make([][]int, len(addrs))
+	decisions := make([][2]int, len(addrs))
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			panic("Error reading event log " + path + ".")
+		}
+
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var e event
+			if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+				continue
+			}
+			idx, ok := index[e.Node]
+			if !ok {
+				panic("Node " + e.Node + " of " + path + " has no config file.")
+			}
+
+			var round, id int
+			switch e.Type {
+			case "state-change":
+				// Only rounds the node starts itself come without a parent,
+				// round 0 is the ID drawn when the node starts up.
+				if _, err := fmt.Sscanf(e.Detail, "round %d leader %d", &round, &id); err != nil || round == 0 || strings.Contains(e.Detail, "parent") {
+					continue
+				}
+				ids[idx] = append(ids[idx], id)
+				if round == 1 {
+					steps[idx] = append(steps[idx], step{Initiate: true})
+				}
+			case "decide":
+				if _, err := fmt.Sscanf(e.Detail, "round %d leader %d", &round, &id); err == nil {
+					decisions[idx] = [2]int{round, id}
+				}
+			case "receive":
+				kind, _ := e.Message["Message"].(string)
+				switch kind {
+				case anon.PING, anon.PONG, anon.ELECTED, anon.DONE, anon.TERMINATE:
+				default:
+					continue
+				}
+
+				from, ok := index[e.Peer]
+				if !ok {
+					panic("Node " + e.Peer + " of " + path + " has no config file.")
+				}
+				round, _ := e.Message["Round"].(float64)
+				id, _ := e.Message["Leader"].(float64)
+				size, _ := e.Message["Size"].(float64)
+				steps[idx] = append(steps[idx], step{Msg: flightOf(from, idx, kind, int(round), int(id), int(size))})
+			}
+		}
+		f.Close()
+	}
+
+	return steps, ids, decisions
+}
+
+// replay runs the election on the network given by neighbours, with every
+// node taking the steps it took in a lab04 run. A node receives a message once
+// the simulation sent it, so the nodes take their steps in an order that respects
+// the messages between them. It stops at the first mismatch.
+func (sim *simulation) replay(neighbours [][]int, steps [][]step) result {
+	sim.setup(neighbours)
+
+	next := make([]int, len(sim.Nodes))
+	for progress := true; progress && sim.Mismatch == ""; {
+		progress = false
+		for idx := range sim.Nodes {
+			for next[idx] < len(steps[idx]) && sim.Mismatch == "" {
+				s := steps[idx][next[idx]]
+				if s.Initiate {
+					sim.Nodes[idx].Initiate()
+				} else if sim.InFlight[s.Msg] > 0 {
+					sim.InFlight[s.Msg]--
+					sim.Nodes[idx].Handle(anon.Message{
+						From:   strconv.Itoa(s.Msg.From),
+						Kind:   s.Msg.Kind,
+						Leader: s.Msg.Id,
+						Round:  s.Msg.Round,
+						Size:   s.Msg.Size,
+					})
+				} else {
+					break
+				}
+
+				next[idx]++
+				progress = true
+			}
+		}
+	}
+	if sim.Mismatch != "" {
+		return sim.Result
+	}
+
+	for idx := range sim.Nodes {
+		if next[idx] < len(steps[idx]) {
+			sim.Mismatch = fmt.Sprintf("node %d received %+v in lab04, which the simulation did not send", idx, steps[idx][next[idx]].Msg)
+			return sim.Result
+		}
+	}
+	for msg, count := range sim.InFlight {
+		if count > 0 {
+			sim.Mismatch = fmt.Sprintf("the simulation sent %+v, which node %d did not receive in lab04", msg, msg.To)
+			return sim.Result
+		}
+	}
+
+	return sim.Result
+}
+
+// compareDecisions compares the leader the simulated nodes decided on
+// with the round and ID of the leader every node of the lab04 run decided on.
+func (sim *simulation) compareDecisions(decisions [][2]int) string {
+	if sim.Leader < 0 {
+		return "the simulation elected no leader"
+	}
+
+	leader := sim.Nodes[sim.Leader]
+	for idx, n := range sim.Nodes {
+		if !n.Decided {
+			return fmt.Sprintf("simulated node %d did not decide", idx)
+		}
+		if decisions[idx] != [2]int{leader.Round, leader.Leader} {
+			return fmt.Sprintf("node %d decided on ID %d in round %d in lab04, the simulation on ID %d in round %d",
+				idx, decisions[idx][1], decisions[idx][0], leader.Leader, leader.Round)
+		}
+	}
+
+	return ""
+}
+
+// measures returns the measures of the summary and how to read them from a
+// result.
+func measures() ([]string, map[string]func(result) float64) {
+	names := []string{"rounds", "ties", "electionMessages", "messages", "electionTime", "time"}
+	return names, map[string]func(result) float64{
+		"rounds":           func(r result) float64 { return float64(r.Rounds) },
+		"ties":             func(r result) float64 { return float64(r.Ties) },
+		"electionMessages": func(r result) float64 { return float64(r.ElectionMessages) },
+		"messages":         func(r result) float64 { return float64(r.Messages) },
+		"electionTime":     func(r result) float64 { return r.ElectionTime },
+		"time":             func(r result) float64 { return r.Time },
+	}
+}
+
+// summarize computes the statistics of the elected runs of a setting.
+func summarize(results []result) summary {
+	s := summary{
+		Source:   results[0].Source,
+		Topology: results[0].Topology,
+		Nodes:    results[0].Nodes,
+		IdRange:  results[0].IdRange,
+		Runs:     len(results),
+		Stats:    make(map[string]stats),
+	}
+
+	names, measure := measures()
+	for _, name := range names {
+		values := make([]float64, 0, len(results))
+		for _, r := range results {
+			if r.Elected {
+				values = append(values, measure[name](r))
+			}
+		}
+		s.Stats[name] = computeStats(values)
+	}
+
+	for _, r := range results {
+		if !r.Elected {
+			s.Failed++
+		}
+	}
+
+	return s
+}
+
+// computeStats computes the statistics of values, using the nearest rank for
+// the percentiles.
+func computeStats(values []float64) stats {
+	if len(values) == 0 {
+		return stats{}
+	}
+	sort.Float64s(values)
+
+	sum := 0.0
+	for _, v := range values {
+		sum += v
+	}
+	mean := sum / float64(len(values))
+
+	variance := 0.0
+	for _, v := range values {
+		variance += (v - mean) * (v - mean)
+	}
+	if len(values) > 1 {
+		variance /= float64(len(values) - 1)
+	}
+
+	percentile := func(p float64) float64 {
+		rank := int(math.Ceil(p*float64(len(values)))) - 1
+		if rank < 0 {
+			rank = 0
+		}
+		return values[rank]
+	}
+
+	return stats{
+		Mean:   mean,
+		StdDev: math.Sqrt(variance),
+		Min:    values[0],
+		Median: percentile(0.5),
+		P95:    percentile(0.95),
+		Max:    values[len(values)-1],
+	}
+}
+
+// writeCSV writes one line per run.
+func writeCSV(out io.Writer, results []result) {
+	w := csv.NewWriter(out)
+	w.Write([]string{"source", "topology", "nodes", "id_range", "run", "elected", "rounds", "ties",
+		"election_messages", "messages", "election_time", "time"})
+	for _, r := range results {
+		w.Write([]string{
+			r.Source,
+			r.Topology,
+			strconv.Itoa(r.Nodes),
+			strconv.Itoa(r.IdRange),
+			strconv.Itoa(r.Run),
+			strconv.FormatBool(r.Elected),
+			strconv.Itoa(r.Rounds),
+			strconv.Itoa(r.Ties),
+			strconv.Itoa(r.ElectionMessages),
+			strconv.Itoa(r.Messages),
+			strconv.FormatFloat(r.ElectionTime, 'f', 3, 64),
+			strconv.FormatFloat(r.Time, 'f', 3, 64),
+		})
+	}
+
+	w.Flush()
+	if err := w.Error(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// writeSummary writes a table with the statistics of every setting.
+func writeSummary(out io.Writer, summaries []summary) {
+	names, _ := measures()
+	fmt.Fprintln(out, "Lab04 election on a simulated network, times in mean message delays:")
+	fmt.Fprintf(out, "%-10s %6s %6s %6s %-17s %10s %10s %10s %10s %10s %10s\n",
+		"topology", "nodes", "ids", "failed", "measure", "mean", "stddev", "min", "median", "p95", "max")
+	for _, s := range summaries {
+		for _, name := range names {
+			st := s.Stats[name]
+			fmt.Fprintf(out, "%-10s %6d %6d %6d %-17s %10.2f %10.2f %10.2f %10.2f %10.2f %10.2f\n",
+				s.Topology, s.Nodes, s.IdRange, s.Failed, name, st.Mean, st.StdDev, st.Min, st.Median, st.P95, st.Max)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+#! /bin/bash
+
+# Usage: ./check.sh [runs] [flags...]
+#
+# Checks that the simulated network of anonsim.go runs the election like the
+# lab04 nodes. Runs the anonymous election of lab04 on the 5 nodes of its
+# config directory the given number of times (10 by default), passing any
+# further flags to every node, with an event log per node, and replays every
+# run in the simulation: every simulated node draws the IDs its lab04 node drew
+# and handles the messages in the order its lab04 node received them. Checks
+# that the simulation sends exactly the messages the nodes received and
+# decides on the same leader in the same round. The rounds and messages of
+# every run are printed.
+
+set -u
+
+RUNS=${1:-10}
+shift
+DIR=$(mktemp -d)
+CONFIG=../lab04/config
+
+cleanup() {
+    kill $(jobs -p) 2>/dev/null
+    wait 2>/dev/null
+}
+trap cleanup EXIT
+
+(cd ../lab04 && go build -o $DIR/anon *.go) || exit 1
+go build -o $DIR/anonsim . || exit 1
+echo "Logs are in $DIR."
+
+for run in $(seq $RUNS); do
+    mkdir -p $DIR/run_$run
+    for n in 1 2 3 4 5; do
+        (timeout 120 $DIR/anon -config $CONFIG/configFile_600$n.txt -events $DIR/run_$run/events_600$n.jsonl "$@" \
+            > $DIR/run_$run/node_600$n.log 2>&1
+         echo "exit $?" >> $DIR/run_$run/node_600$n.log) &
+    done
+    wait
+
+    if [ "$(grep -h '^exit' $DIR/run_$run/node_600*.log | sort -u)" != "exit 0" ]; then
+        echo "FAIL: run $run, not all lab04 nodes terminated cleanly."
+        exit 1
+    fi
+
+    if ! $DIR/anonsim -replay -topology $CONFIG $DIR/run_$run/events_600*.jsonl > $DIR/run_$run/replay.log 2>&1; then
+        echo "FAIL: run $run, $(tail -1 $DIR/run_$run/replay.log | sed 's/^[0-9\/: ]*//')"
+        exit 1
+    fi
+    echo "OK: run $run, $(tail -1 $DIR/run_$run/replay.log | sed 's/^[0-9\/: ]*The simulation matches the lab04 run: //')"
+done
+
+echo "PASS"
@@ -0,0 +1,366 @@
+// Package clustertest runs networks of nodes of the labs built with the race
+// detector for their tests. Every node listens on a Unix socket in the
+// directory of the test and serves its HTTP endpoints on free ports, so the
+// tests of all labs can run at the same time.
+package clustertest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"distributed-systems/core"
+)
+
+// NODES is the number of nodes of the networks the tests run on.
+const NODES = 8
+
+// Request is a request a client of the nodes sends while they run.
+type Request struct {
+	Method string
+	URL    string
+	Body   string
+}
+
+// Cluster runs networks of nodes built with the race detector from the lab in
+// the current directory.
+type Cluster struct {
+	Dir    string
+	Binary string
+}
+
+// New builds the nodes of the lab with the race detector as binary name,
+// unless the tests are short.
+func New(t *testing.T, name string) *Cluster {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("building the nodes with the race detector takes too long for short tests")
+	}
+
+	c := &Cluster{Dir: t.TempDir()}
+	c.Binary = filepath.Join(c.Dir, name)
+	if out, err := exec.Command("go", "build", "-race", "-o", c.Binary, ".").CombinedOutput(); err != nil {
+		t.Fatalf("building the nodes: %v\n%s", err, out)
+	}
+
+	return c
+}
+
+// Address returns the config line of node n: its address, the suffix of the
+// address and the path of its Unix socket.
+func (c *Cluster) Address(n int, suffix string) string {
+	return fmt.Sprintf("127.0.0.1:%d%s %s", 10000+n, suffix, filepath.Join(c.Dir, fmt.Sprintf("node-%d.sock", n)))
+}
+
+// Network writes the config file of every node, made of the lines returned
+// by lines, to directory name and returns its path.
+func (c *Cluster) Network(t *testing.T, name string, lines func(n int) []string) string {
+	t.Helper()
+
+	dir := filepath.Join(c.Dir, name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for n := 1; n <= NODES; n++ {
+		path := filepath.Join(dir, fmt.Sprintf("configFile_%d.txt", n))
+		if err := os.WriteFile(path, []byte(strings.Join(lines(n), "\n")+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return dir
+}
+
+// output collects the output of a node while it runs.
+type output struct {
+	mutex sync.Mutex
+	text  strings.Builder
+}
+
+func (o *output) Write(p []byte) (int, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.text.Write(p)
+}
+
+func (o *output) String() string {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.text.String()
+}
+
+// Nodes are the running nodes of a network.
+type Nodes struct {
+	cmds    []*exec.Cmd
+	outputs []*output
+	cancel  context.CancelFunc
+}
+
+// Start starts a node per config file of directory config with args and the
+// arguments of the node returned by nodeArgs. Messages are delayed by up to
+// 100ms and every node takes a snapshot.
+func (c *Cluster) Start(t *testing.T, config string, nodeArgs func(n int) []string, args ...string) *Nodes {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	nodes := &Nodes{cancel: cancel}
+	t.Cleanup(cancel)
+
+	snapshots := t.TempDir()
+	for n := 1; n <= NODES; n++ {
+		flags := []string{"-config", filepath.Join(config, fmt.Sprintf("configFile_%d.txt", n)), "-transport", "unix",
+			"-snapshot-dir", snapshots, "-snapshot-after", "1s", "-jitter", "100ms"}
+		if nodeArgs != nil {
+			flags = append(flags, nodeArgs(n)...)
+		}
+
+		out := &output{}
+		cmd := exec.CommandContext(ctx, c.Binary, append(flags, args...)...)
+		cmd.Stdout = out
+		cmd.Stderr = out
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		nodes.cmds = append(nodes.cmds, cmd)
+		nodes.outputs = append(nodes.outputs, out)
+	}
+
+	return nodes
+}
+
+// Output returns the output of node n so far.
+func (nodes *Nodes) Output(n int) string {
+	return nodes.outputs[n-1].String()
+}
+
+// Wait waits for every node to exit. It checks that every node exits with
+// code and that none reports a data race, and returns the output of every
+// node.
+func (nodes *Nodes) Wait(t *testing.T, code int) []string {
+	t.Helper()
+	defer nodes.cancel()
+
+	codes := make([]int, len(nodes.cmds))
+	for idx, cmd := range nodes.cmds {
+		cmd.Wait()
+		codes[idx] = cmd.ProcessState.ExitCode()
+	}
+
+	result := make([]string, len(nodes.outputs))
+	for idx := range nodes.outputs {
+		result[idx] = nodes.outputs[idx].String()
+		if strings.Contains(result[idx], "DATA RACE") {
+			t.Errorf("node %d reported a data race:\n%s", idx+1, result[idx])
+		} else if codes[idx] != code {
+			t.Errorf("node %d exited with code %d, expected %d:\n%s", idx+1, codes[idx], code, LastLines(result[idx], 20))
+		}
+	}
+
+	return result
+}
+
+// Run runs the nodes of directory config like Start while requests are sent
+// to them, waits for them like Wait and returns the output of every node.
+func (c *Cluster) Run(t *testing.T, config string, code int, nodeArgs func(n int) []string, requests []Request, args ...string) []string {
+	t.Helper()
+
+	nodes := c.Start(t, config, nodeArgs, args...)
+	stop := SendRequests(requests)
+	defer stop()
+
+	return nodes.Wait(t, code)
+}
+
+// SendRequests keeps sending every request until the returned function is
+// called. Each request is sent by its own client, so that serving one request
+// never orders the handler of another after the event loop.
+func SendRequests(requests []Request) func() {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+
+	for _, r := range requests {
+		wg.Add(1)
+		go func(r Request) {
+			defer wg.Done()
+			client := http.Client{Timeout: time.Second, Transport: &http.Transport{}}
+			for {
+				req, err := http.NewRequest(r.Method, r.URL, strings.NewReader(r.Body))
+				if err != nil {
+					return
+				}
+				if resp, err := client.Do(req); err == nil {
+					resp.Body.Close()
+				}
+
+				select {
+				case <-done:
+					return
+				case <-time.After(100 * time.Millisecond):
+				}
+			}
+		}(r)
+	}
+
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+// MetricsRequests returns a request for the metrics on every address of addrs.
+func MetricsRequests(addrs []string) []Request {
+	requests := make([]Request, 0, len(addrs))
+	for _, addr := range addrs {
+		requests = append(requests, Request{Method: http.MethodGet, URL: "http://" + addr + "/metrics"})
+	}
+
+	return requests
+}
+
+// FreeAddrs returns count addresses on the loopback interface that are free
+// to listen on.
+func FreeAddrs(t *testing.T, count int) []string {
+	t.Helper()
+
+	addrs := make([]string, count)
+	listeners := make([]net.Listener, count)
+	for idx := range listeners {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners[idx] = l
+		addrs[idx] = l.Addr().String()
+	}
+	for _, l := range listeners {
+		l.Close()
+	}
+
+	return addrs
+}
+
+// LastLines returns the last count lines of output.
+func LastLines(output string, count int) string {
+	lines := strings.Split(strings.TrimRight(output, "\n"), "\n")
+	if len(lines) > count {
+		lines = lines[len(lines)-count:]
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// Decided returns the last match of pattern in every output, or an empty
+// string for outputs without a match.
+func Decided(outputs []string, pattern *regexp.Regexp) []string {
+	decided := make([]string, len(outputs))
+	for idx, output := range outputs {
+		matches := pattern.FindAllString(output, -1)
+		if len(matches) > 0 {
+			decided[idx] = matches[len(matches)-1]
+		}
+	}
+
+	return decided
+}
+
+// Agree returns whether every output reports the same last match of pattern.
+func Agree(outputs []string, pattern *regexp.Regexp) bool {
+	decided := Decided(outputs, pattern)
+	for idx := range decided {
+		if decided[idx] == "" || decided[idx] != decided[0] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ExpectAgreement checks that every output reports the same last match of
+// pattern.
+func ExpectAgreement(t *testing.T, outputs []string, pattern *regexp.Regexp) {
+	t.Helper()
+
+	if !Agree(outputs, pattern) {
+		t.Errorf("nodes did not agree: %q", Decided(outputs, pattern))
+	}
+}
+
+// Partition is a step of a partition scenario: the faults file of the nodes
+// is set to Faults, after which the nodes of every group of Groups have to
+// decide again and agree on a decision that Expect accepts.
+type Partition struct {
+	Name   string
+	Faults string
+	Groups [][]int
+	Expect func(group []int, decided string) bool
+}
+
+// RunPartitions runs the nodes of directory config with args and a faults
+// file through the steps of a partition scenario. In every step it waits until
+// the nodes of each group agree on a match of pattern in the output they wrote
+// since the step started that the step accepts, or fails once timeout passed.
+// The nodes are then interrupted and have to exit as aborted.
+func (c *Cluster) RunPartitions(t *testing.T, config string, pattern *regexp.Regexp, timeout time.Duration, steps []Partition, args ...string) {
+	t.Helper()
+
+	faults := filepath.Join(t.TempDir(), "faults.txt")
+	if err := os.WriteFile(faults, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	nodes := c.Start(t, config, nil, append([]string{"-faults", faults}, args...)...)
+
+	for _, step := range steps {
+		start := make([]int, NODES+1)
+		for n := 1; n <= NODES; n++ {
+			start[n] = len(nodes.Output(n))
+		}
+		if err := os.WriteFile(faults, []byte(step.Faults+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if !nodes.await(t, step, start, pattern, time.Now().Add(timeout)) {
+			break
+		}
+	}
+
+	for _, cmd := range nodes.cmds {
+		cmd.Process.Signal(os.Interrupt)
+	}
+	nodes.Wait(t, core.EXIT_ABORTED)
+}
+
+// await waits until the nodes of every group of step agree on a match of
+// pattern in their output after start that step accepts. It fails the test
+// and returns false if they did not by the deadline.
+func (nodes *Nodes) await(t *testing.T, step Partition, start []int, pattern *regexp.Regexp, deadline time.Time) bool {
+	t.Helper()
+
+	for _, group := range step.Groups {
+		outputs := make([]string, len(group))
+		for {
+			for idx, n := range group {
+				outputs[idx] = nodes.Output(n)[start[n]:]
+			}
+			decided := Decided(outputs, pattern)
+			if Agree(outputs, pattern) && step.Expect(group, decided[0]) {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Errorf("%s, nodes %v did not decide as expected: %q", step.Name, group, decided)
+				return false
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,117 @@
+package core
+
+import (
+	"log"
+	"sort"
+	"sync"
+)
+
+// ChannelSeq places a message on the channel from its sender to its receiver.
+// Seq numbers the messages sent on the channel from 1, Marker is the Seq of
+// the last snapshot marker sent on the channel before the message, 0 if none.
+// Messages that are sent once carry none, they are not ordered.
+type ChannelSeq struct {
+	Seq    int
+	Marker int
+}
+
+// channelOut is the channel from the current node to another node. Seq is the
+// Seq of the last message sent on it and Marker that of the last marker.
+type channelOut struct {
+	Seq    int
+	Marker int
+}
+
+// channelIn is the channel from another node to the current node. Next is the
+// lowest Seq that did not arrive yet and Arrived holds the ones above it that
+// did, Marker is the Seq of the last marker handled and Held holds the
+// messages that arrived but wait to be handled.
+type channelIn struct {
+	Next    int
+	Arrived map[int]bool
+	Marker  int
+	Held    []Message
+}
+
+var channelsOut = make(map[string]*channelOut) // Outgoing channels by the host:port of their receiver.
+var channelsOutMutex sync.Mutex                // Mutex to manage access to channelsOut.
+var channelsIn = make(map[string]*channelIn)   // Incoming channels by the host:port of their sender, only used on the event loop.
+
+// stampChannel returns msg numbered as the next message on the channel to
+// node to.
+func stampChannel(to Peer, msg Message) Message {
+	channelsOutMutex.Lock()
+	defer channelsOutMutex.Unlock()
+
+	key := to.Host + ":" + to.Port
+	c, ok := channelsOut[key]
+	if !ok {
+		c = &channelOut{}
+		channelsOut[key] = c
+	}
+
+	c.Seq++
+	h := msg.Header()
+	h.Channel = &ChannelSeq{Seq: c.Seq, Marker: c.Marker}
+	if h.Kind == MARKER {
+		c.Marker = c.Seq
+	}
+
+	return msg.WithHeader(h)
+}
+
+// inOrder returns the messages that can be handled now that msg arrived, in
+// the order they can be handled. The channels do not need to be FIFO, but a
+// snapshot needs the markers to be: a marker is held back until every message
+// sent on its channel before it was handled, and a message sent after a marker
+// is held back until the marker is handled. Other messages are handled as they
+// arrive, so they may still overtake each other.
+func inOrder(msg Message) []Message {
+	h := msg.Header()
+	if h.Channel == nil {
+		return []Message{msg}
+	}
+
+	key := h.Host + ":" + h.Port
+	c, ok := channelsIn[key]
+	ready := make([]Message, 0, 1)
+	if ok && h.Channel.Seq == 1 && c.Next > 1 {
+		// The sender restarted, the messages of its earlier run that are
+		// still held back would wait forever.
+		log.Printf("%s restarted, handling %d held back messages.\n", key, len(c.Held))
+		ready = append(ready, c.Held...)
+		ok = false
+	}
+	if !ok {
+		c = &channelIn{Next: 1, Arrived: make(map[int]bool)}
+		channelsIn[key] = c
+	}
+
+	c.Arrived[h.Channel.Seq] = true
+	for c.Arrived[c.Next] {
+		delete(c.Arrived, c.Next)
+		c.Next++
+	}
+	idx := sort.Search(len(c.Held), func(idx int) bool { return c.Held[idx].Header().Channel.Seq > h.Channel.Seq })
+	c.Held = append(c.Held[:idx], append([]Message{msg}, c.Held[idx:]...)...)
+
+	for released := true; released; {
+		released = false
+		for idx, held := range c.Held {
+			h := held.Header()
+			if h.Channel.Marker > c.Marker || h.Kind == MARKER && c.Next <= h.Channel.Seq {
+				continue
+			}
+
+			if h.Kind == MARKER {
+				c.Marker = h.Channel.Seq
+			}
+			ready = append(ready, held)
+			c.Held = append(c.Held[:idx], c.Held[idx+1:]...)
+			released = true
+			break
+		}
+	}
+
+	return ready
+}
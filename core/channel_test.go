@@ -0,0 +1,70 @@
+package core
+
+import "testing"
+
+// resetChannels forgets the incoming channels of earlier tests.
+func resetChannels() {
+	channelsIn = make(map[string]*channelIn)
+}
+
+// onChannel returns a message of kind from node 127.0.0.1:port numbered seq on
+// its channel, sent after the marker numbered marker.
+func onChannel(port string, kind string, seq int, marker int) testMessage {
+	return testMessage{Host: "127.0.0.1", Port: port, Kind: kind, Channel: &ChannelSeq{Seq: seq, Marker: marker}}
+}
+
+// seqs returns the sequence numbers of msgs on their channel.
+func seqs(msgs []Message) []int {
+	out := make([]int, 0, len(msgs))
+	for _, msg := range msgs {
+		out = append(out, msg.Header().Channel.Seq)
+	}
+
+	return out
+}
+
+// expectSeqs fails the test unless msgs are numbered want on their channel.
+func expectSeqs(t *testing.T, msgs []Message, want ...int) {
+	t.Helper()
+
+	got := seqs(msgs)
+	if len(got) != len(want) {
+		t.Fatalf("handled %v, expected %v", got, want)
+	}
+	for idx := range got {
+		if got[idx] != want[idx] {
+			t.Fatalf("handled %v, expected %v", got, want)
+		}
+	}
+}
+
+func TestInOrderLetsMessagesOvertakeEachOther(t *testing.T) {
+	resetChannels()
+	expectSeqs(t, inOrder(onChannel("10201", "value", 2, 0)), 2)
+	expectSeqs(t, inOrder(onChannel("10201", "value", 1, 0)), 1)
+}
+
+func TestInOrderHoldsMarkerBackForEarlierMessages(t *testing.T) {
+	resetChannels()
+	expectSeqs(t, inOrder(onChannel("10202", MARKER, 3, 0)))
+	expectSeqs(t, inOrder(onChannel("10202", "value", 1, 0)), 1)
+	expectSeqs(t, inOrder(onChannel("10202", "value", 2, 0)), 2, 3)
+}
+
+func TestInOrderHoldsLaterMessagesBackForMarker(t *testing.T) {
+	resetChannels()
+	expectSeqs(t, inOrder(onChannel("10203", "value", 3, 2)))
+	expectSeqs(t, inOrder(onChannel("10203", "value", 4, 2)))
+	expectSeqs(t, inOrder(onChannel("10203", MARKER, 2, 0)))
+	expectSeqs(t, inOrder(onChannel("10203", "value", 1, 0)), 1, 2, 3, 4)
+}
+
+func TestInOrderStartsOverWhenSenderRestarts(t *testing.T) {
+	resetChannels()
+	expectSeqs(t, inOrder(onChannel("10204", "value", 1, 0)), 1)
+	expectSeqs(t, inOrder(onChannel("10204", "value", 3, 2)))
+
+	// The message held back for the marker of the earlier run is handled
+	// before the first message of the new run.
+	expectSeqs(t, inOrder(onChannel("10204", "value", 1, 0)), 3, 1)
+}
@@ -0,0 +1,412 @@
+package core
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+)
+
+// WIRE_VERSION is the version of the wire format, sent in the high four bits
+// of the first byte of every connection. The low four bits name the codec the
+// rest of the connection is encoded with.
+const WIRE_VERSION = 1
+
+// MAX_FRAME_SIZE bounds the bytes of a message on the wire, so that a corrupt
+// or hostile length does not make a node allocate without bound.
+const MAX_FRAME_SIZE = 1 << 20
+
+// Codecs messages can be encoded with.
+const (
+	CODEC_GOB    = 1
+	CODEC_JSON   = 2
+	CODEC_BINARY = 3
+)
+
+// codec encodes and decodes the envelopes sent over a connection. The
+// envelope is passed as a pointer to it.
+type codec interface {
+	encode(w io.Writer, env any) error
+	decode(r *bufio.Reader, env any) error
+}
+
+var codecName string // Name of the codec messages are sent with.
+var sendCodec byte   // Codec messages are sent with.
+
+// codecs maps the codecs to their names and implementations.
+var codecs = map[byte]struct {
+	Name  string
+	Codec codec
+}{
+	CODEC_GOB:    {"gob", gobCodec{}},
+	CODEC_JSON:   {"json", jsonCodec{}},
+	CODEC_BINARY: {"binary", binaryCodec{}},
+}
+
+// registerCodecFlags registers the command line flag that selects the codec.
+func registerCodecFlags() {
+	flag.StringVar(&codecName, "codec", "gob", "Codec to send messages with: gob, json or binary.")
+}
+
+// setupCodec checks the codec given as flag. Messages are received with any
+// codec, whichever the sender picked.
+func setupCodec() {
+	for id, c := range codecs {
+		if c.Name == codecName {
+			sendCodec = id
+			return
+		}
+	}
+
+	panic("Invalid codec, please pass gob, json or binary.")
+}
+
+// writeMessage writes msg sealed in an envelope to a new connection w,
+// starting with the byte that names the wire version and codec.
+func writeMessage[M Message](w io.Writer, msg M) error {
+	env, err := sealEnvelope(msg)
+	if err != nil {
+		return err
+	}
+
+	counter := &countingWriter{w: w}
+	buf := bufio.NewWriter(counter)
+
+	buf.WriteByte(WIRE_VERSION<<4 | sendCodec)
+	if err := codecs[sendCodec].Codec.encode(buf, &env); err != nil {
+		return err
+	}
+	if err := buf.Flush(); err != nil {
+		return err
+	}
+
+	nodeMetrics.bytesSent(counter.N)
+	return nil
+}
+
+// readMessage reads a message from a new connection r with the codec named by
+// its first byte and takes it out of its envelope, unless the envelope is
+// rejected. No more than MAX_FRAME_SIZE bytes are read.
+func readMessage(r io.Reader) (Message, error) {
+	buf := bufio.NewReader(io.LimitReader(r, MAX_FRAME_SIZE))
+	b, err := buf.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	if b>>4 != WIRE_VERSION {
+		return nil, fmt.Errorf("unsupported wire version %d", b>>4)
+	}
+	c, ok := codecs[b&0x0f]
+	if !ok {
+		return nil, fmt.Errorf("unsupported codec %d", b&0x0f)
+	}
+
+	return proto.Decode(buf, c.Codec)
+}
+
+// readEnvelope decodes an envelope with a message of the protocol from r with
+// codec c and takes the message out of it.
+func readEnvelope[M Message](r *bufio.Reader, c codec) (Message, error) {
+	var env envelope[M]
+	if err := c.decode(r, &env); err != nil {
+		return nil, err
+	}
+
+	return openEnvelope(env)
+}
+
+// countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	N int
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.N += n
+	return n, err
+}
+
+// gobCodec encodes an envelope with encoding/gob. Every connection carries a
+// single message with an encoder of its own, so gob sends the type of the
+// envelope along with every message. The binary codec does not.
+type gobCodec struct{}
+
+func (gobCodec) encode(w io.Writer, env any) error {
+	return gob.NewEncoder(w).Encode(env)
+}
+
+func (gobCodec) decode(r *bufio.Reader, env any) error {
+	return gob.NewDecoder(r).Decode(env)
+}
+
+// jsonCodec encodes an envelope as a single line of JSON, with the field names
+// of the envelope and message as keys.
+type jsonCodec struct{}
+
+func (jsonCodec) encode(w io.Writer, env any) error {
+	return json.NewEncoder(w).Encode(env)
+}
+
+func (jsonCodec) decode(r *bufio.Reader, env any) error {
+	return json.NewDecoder(r).Decode(env)
+}
+
+// binaryCodec encodes an envelope the way protocol buffers do, prefixed with
+// its length as a varint. Every field that is not zero is written as a key,
+// the number of the field (its position in the struct starting at 1) shifted
+// left by three bits and ORed with its wire type, followed by its value:
+//
+//   - integers and bools as varints (wire type 0), signed integers zigzag
+//     encoded,
+//   - floats as 8 little endian bytes (wire type 1),
+//   - strings and nested structs as a varint length and the bytes (wire type 2).
+//
+// Slices repeat the key for every element and maps repeat it for every entry,
+// encoded as a struct with the key as field 1 and the value as field 2. Fields
+// with unknown numbers are skipped.
+type binaryCodec struct{}
+
+func (binaryCodec) encode(w io.Writer, env any) error {
+	body := appendStruct(nil, reflect.ValueOf(env).Elem())
+
+	_, err := w.Write(append(binary.AppendUvarint(nil, uint64(len(body))), body...))
+	return err
+}
+
+func (binaryCodec) decode(r *bufio.Reader, env any) error {
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return err
+	}
+
+	if length > MAX_FRAME_SIZE {
+		return fmt.Errorf("frame of %d bytes, at most %d allowed", length, MAX_FRAME_SIZE)
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return err
+	}
+
+	return decodeStruct(body, reflect.ValueOf(env).Elem())
+}
+
+// Wire types of the binary codec.
+const (
+	WIRE_VARINT  = 0
+	WIRE_FIXED64 = 1
+	WIRE_BYTES   = 2
+)
+
+// appendStruct appends the exported fields of struct v that are not zero.
+func appendStruct(buf []byte, v reflect.Value) []byte {
+	for idx := 0; idx < v.NumField(); idx++ {
+		if !v.Type().Field(idx).IsExported() || v.Field(idx).IsZero() {
+			continue
+		}
+
+		buf = appendField(buf, idx+1, v.Field(idx))
+	}
+
+	return buf
+}
+
+// appendField appends v as field number num.
+func appendField(buf []byte, num int, v reflect.Value) []byte {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		buf = binary.AppendUvarint(buf, uint64(num<<3|WIRE_VARINT))
+		return binary.AppendVarint(buf, v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		buf = binary.AppendUvarint(buf, uint64(num<<3|WIRE_VARINT))
+		return binary.AppendUvarint(buf, v.Uint())
+	case reflect.Bool:
+		buf = binary.AppendUvarint(buf, uint64(num<<3|WIRE_VARINT))
+		if v.Bool() {
+			return append(buf, 1)
+		}
+		return append(buf, 0)
+	case reflect.Float32, reflect.Float64:
+		buf = binary.AppendUvarint(buf, uint64(num<<3|WIRE_FIXED64))
+		return binary.LittleEndian.AppendUint64(buf, math.Float64bits(v.Float()))
+	case reflect.String:
+		buf = binary.AppendUvarint(buf, uint64(num<<3|WIRE_BYTES))
+		buf = binary.AppendUvarint(buf, uint64(v.Len()))
+		return append(buf, v.String()...)
+	case reflect.Struct:
+		return appendBytes(buf, num, appendStruct(nil, v))
+	case reflect.Ptr:
+		if v.IsNil() {
+			return buf
+		}
+		return appendField(buf, num, v.Elem())
+	case reflect.Slice:
+		for idx := 0; idx < v.Len(); idx++ {
+			buf = appendField(buf, num, v.Index(idx))
+		}
+		return buf
+	case reflect.Map:
+		iter := v.MapRange()
+		for iter.Next() {
+			entry := appendField(nil, 1, iter.Key())
+			entry = appendField(entry, 2, iter.Value())
+			buf = appendBytes(buf, num, entry)
+		}
+		return buf
+	}
+
+	panic("Unsupported field type " + v.Type().String() + " in envelope.")
+}
+
+// appendBytes appends data as field number num with wire type 2.
+func appendBytes(buf []byte, num int, data []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(num<<3|WIRE_BYTES))
+	buf = binary.AppendUvarint(buf, uint64(len(data)))
+	return append(buf, data...)
+}
+
+// wireValue is a field read by the binary codec, either a number for wire
+// types 0 and 1 or Bytes for wire type 2.
+type wireValue struct {
+	Type   int
+	Number uint64
+	Bytes  []byte
+}
+
+// readField reads the next field from data, returning its number, its value
+// and the rest of data.
+func readField(data []byte) (int, wireValue, []byte, error) {
+	key, n := binary.Uvarint(data)
+	if n <= 0 {
+		return 0, wireValue{}, nil, errors.New("malformed field key")
+	}
+	data = data[n:]
+
+	value := wireValue{Type: int(key & 7)}
+	switch value.Type {
+	case WIRE_VARINT:
+		value.Number, n = binary.Uvarint(data)
+		if n <= 0 {
+			return 0, wireValue{}, nil, errors.New("malformed varint")
+		}
+		data = data[n:]
+	case WIRE_FIXED64:
+		if len(data) < 8 {
+			return 0, wireValue{}, nil, errors.New("truncated fixed64")
+		}
+		value.Number = binary.LittleEndian.Uint64(data)
+		data = data[8:]
+	case WIRE_BYTES:
+		length, n := binary.Uvarint(data)
+		if n <= 0 || uint64(len(data)-n) < length {
+			return 0, wireValue{}, nil, errors.New("truncated bytes")
+		}
+		value.Bytes = data[n : n+int(length)]
+		data = data[n+int(length):]
+	default:
+		return 0, wireValue{}, nil, fmt.Errorf("unknown wire type %d", value.Type)
+	}
+
+	return int(key >> 3), value, data, nil
+}
+
+// decodeStruct decodes data into struct v, skipping unknown fields.
+func decodeStruct(data []byte, v reflect.Value) error {
+	for len(data) > 0 {
+		num, value, rest, err := readField(data)
+		if err != nil {
+			return err
+		}
+		data = rest
+
+		if num < 1 || num > v.NumField() || !v.Type().Field(num-1).IsExported() {
+			continue
+		}
+		if err := decodeField(value, v.Field(num-1)); err != nil {
+			return fmt.Errorf("field %s: %w", v.Type().Field(num-1).Name, err)
+		}
+	}
+
+	return nil
+}
+
+// decodeField stores value in v, appending it to slices and adding it to
+// maps.
+func decodeField(value wireValue, v reflect.Value) error {
+	wireType := WIRE_BYTES
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		wireType = WIRE_VARINT
+		v.SetInt(int64(value.Number>>1) ^ -int64(value.Number&1))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		wireType = WIRE_VARINT
+		v.SetUint(value.Number)
+	case reflect.Bool:
+		wireType = WIRE_VARINT
+		v.SetBool(value.Number != 0)
+	case reflect.Float32, reflect.Float64:
+		wireType = WIRE_FIXED64
+		v.SetFloat(math.Float64frombits(value.Number))
+	case reflect.String:
+		v.SetString(string(value.Bytes))
+	case reflect.Struct:
+		if value.Type == WIRE_BYTES {
+			return decodeStruct(value.Bytes, v)
+		}
+	case reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return decodeField(value, v.Elem())
+	case reflect.Slice:
+		elem := reflect.New(v.Type().Elem()).Elem()
+		if err := decodeField(value, elem); err != nil {
+			return err
+		}
+		v.Set(reflect.Append(v, elem))
+		return nil
+	case reflect.Map:
+		if value.Type != WIRE_BYTES {
+			break
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		key := reflect.New(v.Type().Key()).Elem()
+		elem := reflect.New(v.Type().Elem()).Elem()
+		for data := value.Bytes; len(data) > 0; {
+			num, field, rest, err := readField(data)
+			if err != nil {
+				return err
+			}
+			data = rest
+
+			switch num {
+			case 1:
+				err = decodeField(field, key)
+			case 2:
+				err = decodeField(field, elem)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		v.SetMapIndex(key, elem)
+		return nil
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+
+	if value.Type != wireType {
+		return fmt.Errorf("wire type %d, expected %d", value.Type, wireType)
+	}
+	return nil
+}
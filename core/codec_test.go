@@ -0,0 +1,121 @@
+package core
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestMain runs the tests as node 127.0.0.1:10001 of the protocol of the tests
+// on the network of the tests, with the log silenced.
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+
+	self = Peer{Host: "127.0.0.1", Port: "10001"}
+	proto = eraseProtocol(Protocol[testMessage]{
+		Name:    "test",
+		Version: 1,
+		Types:   map[string]MessageType{"value": TYPE_PROTOCOL},
+		Handle:  func(msg testMessage) { testHandle(msg) },
+		State:   func() any { return nil },
+	})
+	sendCodec = CODEC_GOB
+	nodeTransport = testNetwork
+
+	os.Exit(m.Run())
+}
+
+// testMessage is the message of the protocol the tests run.
+type testMessage struct {
+	Host     string
+	Port     string
+	Kind     string
+	Clock    int
+	Snapshot string
+	Channel  *ChannelSeq
+	Safra    *SafraToken
+	Value    int
+}
+
+func (msg testMessage) Header() Header {
+	return Header{
+		Host:     msg.Host,
+		Port:     msg.Port,
+		Kind:     msg.Kind,
+		Clock:    msg.Clock,
+		Snapshot: msg.Snapshot,
+		Channel:  msg.Channel,
+		Safra:    msg.Safra,
+	}
+}
+
+func (msg testMessage) WithHeader(h Header) Message {
+	msg.Host = h.Host
+	msg.Port = h.Port
+	msg.Kind = h.Kind
+	msg.Clock = h.Clock
+	msg.Snapshot = h.Snapshot
+	msg.Channel = h.Channel
+	msg.Safra = h.Safra
+	return msg
+}
+
+// testValue returns a message of the protocol of the tests from the current
+// node that carries value.
+func testValue(value int) testMessage {
+	return testMessage{Host: self.Host, Port: self.Port, Kind: "value", Value: value}
+}
+
+func TestCodecsRoundTrip(t *testing.T) {
+	defer func(id byte) { sendCodec = id }(sendCodec)
+
+	for id, c := range codecs {
+		sendCodec = id
+		sent := testValue(-7)
+		sent.Clock = 3
+
+		var payload bytes.Buffer
+		if err := writeMessage(&payload, sent); err != nil {
+			t.Fatalf("%s: writing message: %v", c.Name, err)
+		}
+
+		received, err := readMessage(&payload)
+		if err != nil {
+			t.Fatalf("%s: reading message: %v", c.Name, err)
+		}
+		if received != sent {
+			t.Errorf("%s: received %+v, sent %+v", c.Name, received, sent)
+		}
+	}
+}
+
+func TestBinaryCodecRejectsOversizedFrame(t *testing.T) {
+	// The length of the envelope is a varint of ten bytes whose value does
+	// not fit in memory.
+	frame := []byte{WIRE_VERSION<<4 | CODEC_BINARY, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}
+	if _, err := readMessage(bytes.NewReader(frame)); err == nil {
+		t.Fatal("frame with a length of 2^64-1 was accepted")
+	}
+
+	frame = append([]byte{WIRE_VERSION<<4 | CODEC_BINARY}, 0x81, 0x80, 0x80, 0x01)
+	if _, err := readMessage(bytes.NewReader(frame)); err == nil || !strings.Contains(err.Error(), "at most") {
+		t.Fatalf("frame longer than MAX_FRAME_SIZE: got error %v", err)
+	}
+}
+
+func TestReadMessageStopsAtMaxFrameSize(t *testing.T) {
+	// A JSON envelope that never ends is only read up to MAX_FRAME_SIZE.
+	frame := append([]byte{WIRE_VERSION<<4 | CODEC_JSON}, `{"Protocol":"`...)
+	frame = append(frame, bytes.Repeat([]byte{'a'}, 2*MAX_FRAME_SIZE)...)
+
+	r := bytes.NewReader(frame)
+	if _, err := readMessage(r); err == nil {
+		t.Fatal("unterminated envelope was accepted")
+	}
+	if read := len(frame) - r.Len(); read > MAX_FRAME_SIZE {
+		t.Errorf("read %d bytes, at most %d allowed", read, MAX_FRAME_SIZE)
+	}
+}
@@ -0,0 +1,108 @@
+package core
+
+import "fmt"
+
+// MessageType enumerates the kinds of messages the nodes exchange.
+type MessageType int
+
+// Kinds of the messages of the core. The kinds of the messages of a protocol
+// start at TYPE_PROTOCOL, TYPE_UNKNOWN is never sent.
+const (
+	TYPE_UNKNOWN MessageType = iota
+	TYPE_MARKER
+	TYPE_SIGNAL
+	TYPE_SAFRA
+	TYPE_PROTOCOL
+)
+
+// coreTypes maps the kinds of the messages of the core to their types.
+var coreTypes = map[string]MessageType{
+	MARKER: TYPE_MARKER,
+	SIGNAL: TYPE_SIGNAL,
+	SAFRA:  TYPE_SAFRA,
+}
+
+// envelope wraps every message sent between nodes. Version is the protocol
+// version of the sender, Protocol names the protocol it runs, Type is the kind
+// of the message and Sender the host:port of the sender. The kind is left
+// empty in the wrapped message, it travels as Type.
+type envelope[M Message] struct {
+	Version  int
+	Protocol string
+	Type     MessageType
+	Sender   string
+	Message  M
+}
+
+// messageType returns the type of messages of kind.
+func messageType(kind string) (MessageType, bool) {
+	if t, ok := coreTypes[kind]; ok {
+		return t, true
+	}
+
+	t, ok := proto.Types[kind]
+	return t, ok
+}
+
+// messageKind returns the kind of messages of type t.
+func messageKind(t MessageType) string {
+	for kind, k := range coreTypes {
+		if k == t {
+			return kind
+		}
+	}
+
+	for kind, k := range proto.Types {
+		if k == t {
+			return kind
+		}
+	}
+
+	return ""
+}
+
+// sealEnvelope wraps msg in an envelope of the current node.
+func sealEnvelope[M Message](msg M) (envelope[M], error) {
+	h := msg.Header()
+	kind, ok := messageType(h.Kind)
+	if !ok {
+		return envelope[M]{}, fmt.Errorf("unknown message %q", h.Kind)
+	}
+
+	h.Kind = ""
+	env := envelope[M]{
+		Version:  proto.Version,
+		Protocol: proto.Name,
+		Type:     kind,
+		Sender:   self.Host + ":" + self.Port,
+		Message:  msg.WithHeader(h).(M),
+	}
+
+	return env, nil
+}
+
+// openEnvelope takes the message out of env. Envelopes of another version or
+// protocol, of an unknown kind or whose sender is not the node the message
+// claims to come from are rejected.
+func openEnvelope[M Message](env envelope[M]) (M, error) {
+	var msg M
+	if env.Version != proto.Version {
+		return msg, fmt.Errorf("version %d from %s, expected %d", env.Version, env.Sender, proto.Version)
+	}
+
+	if env.Protocol != proto.Name {
+		return msg, fmt.Errorf("protocol %q from %s, expected %q", env.Protocol, env.Sender, proto.Name)
+	}
+
+	h := env.Message.Header()
+	h.Kind = messageKind(env.Type)
+	if h.Kind == "" {
+		return msg, fmt.Errorf("unknown message type %d from %s", env.Type, env.Sender)
+	}
+
+	if env.Sender == "" || env.Sender != h.Host+":"+h.Port {
+		return msg, fmt.Errorf("%s from %q claims to come from %s:%s", h.Kind, env.Sender, h.Host, h.Port)
+	}
+
+	return env.Message.WithHeader(h).(M), nil
+}
@@ -0,0 +1,114 @@
+package core
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Event types written to the structured event log.
+const (
+	EVENT_SEND         = "send"
+	EVENT_RECEIVE      = "receive"
+	EVENT_STATE_CHANGE = "state-change"
+	EVENT_DECIDE       = "decide"
+)
+
+// event is a single entry of the structured event log. Every event carries
+// the wall clock Time, the Node (host:port) and NodeId it happened on, the
+// Lamport Clock of the node after the event, its Type, the Peer that a message
+// was sent to or received from, the Message itself and a free-form Detail.
+type event struct {
+	Time    time.Time `json:"time"`
+	Node    string    `json:"node"`
+	NodeId  int       `json:"nodeId,omitempty"`
+	Clock   int       `json:"clock"`
+	Type    string    `json:"type"`
+	Peer    string    `json:"peer,omitempty"`
+	Message Message   `json:"message,omitempty"`
+	Detail  string    `json:"detail,omitempty"`
+}
+
+var eventLog *json.Encoder // Encoder for the event log, nil if disabled.
+var eventMutex sync.Mutex  // Mutex to manage access to the clock and log.
+var lamportClock int       // Lamport clock of the current node.
+
+// openEventLog opens path for writing JSON events, one per line. An empty path
+// disables the event log.
+func openEventLog(path string) {
+	if path == "" {
+		return
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		panic("Error creating event log.")
+	}
+
+	log.Println("Writing events to: " + path)
+	eventLog = json.NewEncoder(f)
+}
+
+// logSend advances the Lamport clock for a send to recvAddr, records the event
+// and returns msg stamped with the clock.
+func logSend(recvAddr Peer, msg Message) Message {
+	eventMutex.Lock()
+	defer eventMutex.Unlock()
+
+	lamportClock++
+	h := msg.Header()
+	h.Clock = lamportClock
+	msg = msg.WithHeader(h)
+	writeEvent(EVENT_SEND, recvAddr.Host+":"+recvAddr.Port, msg, "")
+
+	return msg
+}
+
+// logReceive merges the Lamport clock carried by msg into the clock of the
+// current node and records the event.
+func logReceive(msg Message) {
+	eventMutex.Lock()
+	defer eventMutex.Unlock()
+
+	h := msg.Header()
+	if h.Clock > lamportClock {
+		lamportClock = h.Clock
+	}
+	lamportClock++
+	writeEvent(EVENT_RECEIVE, h.Host+":"+h.Port, msg, "")
+}
+
+// LogLocal advances the Lamport clock for a local event of type kind, such as
+// EVENT_STATE_CHANGE or EVENT_DECIDE, and records it.
+func LogLocal(kind string, detail string) {
+	eventMutex.Lock()
+	defer eventMutex.Unlock()
+
+	lamportClock++
+	writeEvent(kind, "", nil, detail)
+}
+
+// writeEvent writes an event to the event log. It must be called with
+// eventMutex held.
+func writeEvent(kind string, peer string, msg Message, detail string) {
+	if eventLog == nil {
+		return
+	}
+
+	e := event{
+		Time:    time.Now(),
+		Node:    self.Host + ":" + self.Port,
+		NodeId:  self.NodeId,
+		Clock:   lamportClock,
+		Type:    kind,
+		Peer:    peer,
+		Message: msg,
+		Detail:  detail,
+	}
+
+	if err := eventLog.Encode(e); err != nil {
+		log.Printf("Error writing event: %v\n", err)
+	}
+}
@@ -0,0 +1,325 @@
+package core
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// faults describes the faults injected between the algorithm and the
+// network. Drop, Duplicate and Reorder are the probabilities of dropping,
+// duplicating and holding back a message, Delay is a fixed delay added to
+// every message, Jitter is the upper bound of an additional random delay,
+// Hold is how long a reordered message is held back and Partition lists groups
+// of ports, a message is dropped if its sender and receiver are in different
+// groups.
+type faults struct {
+	Drop      float64
+	Delay     time.Duration
+	Jitter    time.Duration
+	Duplicate float64
+	Reorder   float64
+	Hold      time.Duration
+	Partition [][]string
+}
+
+var nodeFaults faults             // Faults currently injected.
+var faultsMutex sync.Mutex        // Mutex to manage access to nodeFaults and faultsRand.
+var faultsRand *rand.Rand         // Random source used to decide on faults.
+var faultsSeed int64              // Seed of faultsRand, 0 to seed from the clock.
+var faultsFile string             // Path to the faults config file, if any.
+var faultsModified time.Time      // Last modification time of the faults config file.
+var faultsInFlight sync.WaitGroup // Messages that are still being delivered.
+
+// registerFaultFlags registers the command line flags that configure the
+// injected faults.
+func registerFaultFlags() {
+	flag.Float64Var(&nodeFaults.Drop, "drop", 0, "Probability of dropping a message.")
+	flag.DurationVar(&nodeFaults.Delay, "delay", 0, "Fixed delay added to every message, e.g. 100ms.")
+	flag.DurationVar(&nodeFaults.Jitter, "jitter", 0, "Upper bound of a random delay added to every message.")
+	flag.Float64Var(&nodeFaults.Duplicate, "duplicate", 0, "Probability of duplicating a message.")
+	flag.Float64Var(&nodeFaults.Reorder, "reorder", 0, "Probability of holding back a message so later ones overtake it.")
+	flag.DurationVar(&nodeFaults.Hold, "hold", 1*time.Second, "How long a reordered message is held back.")
+	flag.Var(partitionFlag{&nodeFaults.Partition}, "partition", "Groups of ports that can reach each other, e.g. 10001,10002/10003,10004.")
+	flag.StringVar(&faultsFile, "faults", "", "Path to a faults config file that is reloaded when it changes.")
+	flag.Int64Var(&faultsSeed, "fault-seed", 0, "Seed for the random fault decisions, 0 to seed from the clock.")
+}
+
+// setupFaults checks the faults given as flags, seeds the random source used
+// to decide on faults and starts watching the faults config file, if one was
+// given.
+func setupFaults() {
+	for _, p := range []float64{nodeFaults.Drop, nodeFaults.Duplicate, nodeFaults.Reorder} {
+		if p < 0 || p > 1 {
+			panic("Invalid fault probability, probabilities must be between 0 and 1.")
+		}
+	}
+
+	seed := faultsSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	faultsRand = rand.New(rand.NewSource(seed))
+
+	if faultsFile == "" {
+		return
+	}
+
+	loadFaults()
+	go func() {
+		for {
+			time.Sleep(1 * time.Second)
+			loadFaults()
+		}
+	}()
+}
+
+// loadFaults reads the faults config file if it changed since it was last
+// read. Every line of the file holds a key=value pair where the key is the
+// name of one of the fault flags, for example "drop=0.1" or
+// "partition=10001,10002/10003,10004,10005". Keys that are missing keep their
+// current value, an empty value resets it.
+func loadFaults() {
+	info, err := os.Stat(faultsFile)
+	if err != nil || !info.ModTime().After(faultsModified) {
+		return
+	}
+
+	f, err := os.Open(faultsFile)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	faultsMutex.Lock()
+	defer faultsMutex.Unlock()
+
+	faultsModified = info.ModTime()
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			log.Printf("Ignoring fault setting %q.\n", line)
+			continue
+		}
+
+		if err := nodeFaults.set(strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])); err != nil {
+			log.Printf("Ignoring fault setting %q: %v\n", line, err)
+		}
+	}
+
+	log.Printf("Loaded faults from %s: %s\n", faultsFile, nodeFaults.String())
+}
+
+// set sets the fault named key to value.
+func (f *faults) set(key string, value string) error {
+	var err error
+
+	switch key {
+	case "drop":
+		f.Drop, err = parseProbability(value)
+	case "duplicate":
+		f.Duplicate, err = parseProbability(value)
+	case "reorder":
+		f.Reorder, err = parseProbability(value)
+	case "delay":
+		f.Delay, err = parseDuration(value)
+	case "jitter":
+		f.Jitter, err = parseDuration(value)
+	case "hold":
+		f.Hold, err = parseDuration(value)
+	case "partition":
+		err = partitionFlag{&f.Partition}.Set(value)
+	default:
+		err = fmt.Errorf("unknown fault %q", key)
+	}
+
+	return err
+}
+
+// String describes the faults in the format of the faults config file.
+func (f faults) String() string {
+	return fmt.Sprintf("drop=%g delay=%s jitter=%s duplicate=%g reorder=%g hold=%s partition=%s",
+		f.Drop, f.Delay, f.Jitter, f.Duplicate, f.Reorder, f.Hold, partitionFlag{&f.Partition}.String())
+}
+
+// injectFaults hands msg for recvAddr to deliver after applying the configured
+// faults. The message may be dropped, delayed, held back or delivered twice.
+// Delayed messages are delivered in the background so that later messages can
+// overtake them. If numbered, every copy that is sent is numbered on the
+// channel to recvAddr before it is delayed, in the order it was sent.
+func injectFaults(recvAddr Peer, msg Message, numbered bool, deliver func(Peer, Message)) {
+	kind := msg.Header().Kind
+
+	faultsMutex.Lock()
+	f := nodeFaults
+	partitioned := !sameGroup(f.Partition, self.Port, recvAddr.Port)
+	dropped := f.Drop > 0 && faultsRand.Float64() < f.Drop
+	copies := 1
+	if f.Duplicate > 0 && faultsRand.Float64() < f.Duplicate {
+		copies = 2
+	}
+
+	delays := make([]time.Duration, copies)
+	for idx := range delays {
+		delays[idx] = f.Delay
+		if f.Jitter > 0 {
+			delays[idx] += time.Duration(faultsRand.Int63n(int64(f.Jitter)))
+		}
+		if f.Reorder > 0 && faultsRand.Float64() < f.Reorder {
+			delays[idx] += f.Hold
+		}
+	}
+	faultsMutex.Unlock()
+
+	number := func(msg Message) Message {
+		if numbered {
+			return stampChannel(recvAddr, msg)
+		}
+		return msg
+	}
+
+	// Messages to the current node itself never cross the network.
+	if recvAddr.Port == self.Port {
+		terminationSent(kind, 1)
+		deliver(recvAddr, number(msg))
+		return
+	}
+
+	if partitioned {
+		log.Printf("Dropping %s to %s:%s, it is in another partition.\n", kind, recvAddr.Host, recvAddr.Port)
+		return
+	}
+
+	if dropped {
+		log.Printf("Dropping %s to %s:%s.\n", kind, recvAddr.Host, recvAddr.Port)
+		return
+	}
+
+	// Only the copies that are actually sent count for termination detection.
+	terminationSent(kind, copies)
+	if copies > 1 {
+		log.Printf("Duplicating %s to %s:%s.\n", kind, recvAddr.Host, recvAddr.Port)
+	}
+
+	for _, delay := range delays {
+		sent := number(msg)
+		if delay == 0 {
+			deliver(recvAddr, sent)
+			continue
+		}
+
+		faultsInFlight.Add(1)
+		go func(delay time.Duration) {
+			defer faultsInFlight.Done()
+
+			time.Sleep(delay)
+			deliver(recvAddr, sent)
+		}(delay)
+	}
+}
+
+// sameGroup checks if ports a and b are in the same group of partition. Ports
+// that are not listed in any group are grouped together, an empty partition
+// puts all ports in the same group.
+func sameGroup(partition [][]string, a string, b string) bool {
+	if len(partition) == 0 {
+		return true
+	}
+
+	groupOf := func(port string) int {
+		for idx, group := range partition {
+			for _, p := range group {
+				if p == port {
+					return idx
+				}
+			}
+		}
+		return -1
+	}
+
+	return groupOf(a) == groupOf(b)
+}
+
+// partitionFlag parses a partition of the form "10001,10002/10003,10004",
+// groups are separated by slashes and ports within a group by commas.
+type partitionFlag struct {
+	Groups *[][]string
+}
+
+// String formats the partition in the form accepted by Set.
+func (p partitionFlag) String() string {
+	if p.Groups == nil {
+		return ""
+	}
+
+	groups := make([]string, 0, len(*p.Groups))
+	for _, group := range *p.Groups {
+		groups = append(groups, strings.Join(group, ","))
+	}
+
+	return strings.Join(groups, "/")
+}
+
+// Set parses value into the partition.
+func (p partitionFlag) Set(value string) error {
+	groups := make([][]string, 0)
+
+	for _, g := range strings.Split(value, "/") {
+		group := make([]string, 0)
+		for _, port := range strings.Split(g, ",") {
+			port = strings.TrimSpace(port)
+			if port == "" {
+				continue
+			}
+			if _, err := strconv.Atoi(port); err != nil {
+				return fmt.Errorf("invalid port %q", port)
+			}
+			group = append(group, port)
+		}
+
+		if len(group) > 0 {
+			groups = append(groups, group)
+		}
+	}
+
+	*p.Groups = groups
+
+	return nil
+}
+
+// parseProbability parses a probability between 0 and 1.
+func parseProbability(value string) (float64, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	p, err := strconv.ParseFloat(value, 64)
+	if err != nil || p < 0 || p > 1 {
+		return 0, fmt.Errorf("invalid probability %q", value)
+	}
+
+	return p, nil
+}
+
+// parseDuration parses a duration such as 100ms.
+func parseDuration(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	return time.ParseDuration(value)
+}
@@ -0,0 +1,138 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Exit codes of the node, one for every outcome of its run. Codes 1 and 2 are
+// left to log.Fatal and to panics. A node disagrees when it decided although
+// the nodes did not agree on the outcome.
+const (
+	EXIT_DECIDED   = 0
+	EXIT_ABORTED   = 3
+	EXIT_TIMED_OUT = 4
+	EXIT_DISAGREED = 5
+)
+
+// outcomes names the outcomes of a run by their exit codes.
+var outcomes = map[int]string{
+	EXIT_DECIDED:   "decided",
+	EXIT_ABORTED:   "aborted",
+	EXIT_TIMED_OUT: "timed out",
+	EXIT_DISAGREED: "disagreed",
+}
+
+var nodeContext, cancelNode = context.WithCancel(context.Background()) // Done once the node stopped.
+
+var runTimeout time.Duration        // Time after which the node gives up, 0 to never give up.
+var drainTimeout time.Duration      // Time the node waits for its outbound messages when it stops.
+var exitCode int                    // Exit code of the outcome the node stopped with.
+var stopOnce sync.Once              // Only the first outcome counts.
+var outboundMessages sync.WaitGroup // Messages that are being sent.
+
+// registerLifecycleFlags registers the command line flags that bound the run
+// of the node.
+func registerLifecycleFlags() {
+	flag.DurationVar(&runTimeout, "timeout", 0, "Give up and exit if the node did not decide after this long, 0 to wait forever.")
+	flag.DurationVar(&drainTimeout, "drain-timeout", 5*time.Second, "Time to wait for outbound messages to be sent when the node stops.")
+}
+
+// setupLifecycle stops the node as aborted on SIGINT or SIGTERM and as timed
+// out once the timeout passed, and shuts it down once it stopped.
+func setupLifecycle() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		sig := <-signals
+		log.Printf("Received %v, stopping.\n", sig)
+		Stop(EXIT_ABORTED)
+	}()
+
+	if runTimeout > 0 {
+		time.AfterFunc(runTimeout, func() {
+			log.Printf("No decision after %v, stopping.\n", runTimeout)
+			Stop(EXIT_TIMED_OUT)
+		})
+	}
+
+	go shutdown()
+}
+
+// Stop stops the node with the outcome of exit code code, unless it already
+// stopped with another one. The listener is closed and no new messages are
+// sent from now on, the rest is left to shutdown.
+func Stop(code int) {
+	stopOnce.Do(func() {
+		exitCode = code
+		cancelNode()
+	})
+}
+
+// shutdown waits for the node to stop and for the messages that were being
+// sent to be delivered, at most for the drain timeout, then writes the final
+// state of the node to the log and exits with the exit code of its outcome.
+func shutdown() {
+	<-nodeContext.Done()
+
+	drained := make(chan bool)
+	go func() {
+		<-loopStopped         // The event loop may still be sending.
+		faultsInFlight.Wait() // Delayed messages become outbound messages.
+		outboundMessages.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-time.After(drainTimeout):
+		log.Printf("Outbound messages not delivered after %v, dropping them.\n", drainTimeout)
+	}
+
+	// The state is owned by the event loop, so it is only read once the loop
+	// returned. A loop that is still sending leaves it unknown.
+	var data []byte
+	select {
+	case <-loopStopped:
+		var err error
+		if data, err = json.Marshal(proto.State()); err != nil {
+			log.Printf("Error encoding the final state: %v\n", err)
+		}
+	default:
+		data = []byte("unknown")
+	}
+	log.Printf("Stopped (%s), final state: %s\n", outcomes[exitCode], data)
+	LogLocal(EVENT_STATE_CHANGE, "stopped "+outcomes[exitCode])
+
+	os.Exit(exitCode)
+}
+
+// WaitForShutdown blocks forever, so that main returning does not exit the
+// process before shutdown does.
+func WaitForShutdown() {
+	select {}
+}
+
+// SleepOrStop sleeps for d and reports whether the node is still running
+// afterwards. It returns as soon as the node stops.
+func SleepOrStop(d time.Duration) bool {
+	select {
+	case <-nodeContext.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// Done returns a channel that is closed once the node stopped.
+func Done() <-chan struct{} {
+	return nodeContext.Done()
+}
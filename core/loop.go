@@ -0,0 +1,80 @@
+package core
+
+import (
+	"time"
+)
+
+// The event loop owns the state of the node. Messages received by the
+// listener, timers that fired and commands of other goroutines are handled on
+// it one at a time, so handlers never run concurrently and need no locks. A
+// handler must not block for long and must not wait for another event.
+var inbound = make(chan Message)  // Messages received by the listener.
+var timers = make(chan func())    // Timers that fired.
+var commands = make(chan func())  // Commands of other goroutines.
+var loopStopped = make(chan bool) // Closed once the event loop returned.
+
+// runLoop runs the event loop, which handles every inbound message, until the
+// node stops.
+func runLoop() {
+	defer close(loopStopped)
+
+	for {
+		select {
+		case <-nodeContext.Done():
+			return
+		case msg := <-inbound:
+			receive(msg)
+		case fire := <-timers:
+			fire()
+		case cmd := <-commands:
+			cmd()
+		}
+	}
+}
+
+// queueMessage hands msg over to the event loop, unless the node stopped.
+func queueMessage(msg Message) {
+	select {
+	case inbound <- msg:
+	case <-nodeContext.Done():
+	}
+}
+
+// Run runs cmd on the event loop and waits until it ran. It reports false if
+// the node stopped before. It must not be called on the event loop itself.
+func Run(cmd func()) bool {
+	ran := make(chan bool)
+	select {
+	case commands <- func() { cmd(); close(ran) }:
+	case <-nodeContext.Done():
+		return false
+	}
+
+	<-ran
+	return true
+}
+
+// Post runs cmd on the event loop without waiting for it.
+func Post(cmd func()) {
+	go Run(cmd)
+}
+
+// After runs fire on the event loop once d passed, unless the node stopped.
+func After(d time.Duration, fire func()) {
+	time.AfterFunc(d, func() {
+		select {
+		case timers <- fire:
+		case <-nodeContext.Done():
+		}
+	})
+}
+
+// Every runs fire on the event loop every d until the node stops. The next
+// run is timed from the end of the previous one, like a loop that sleeps
+// between runs, so nodes started together do not stay in step.
+func Every(d time.Duration, fire func()) {
+	After(d, func() {
+		fire()
+		Every(d, fire)
+	})
+}
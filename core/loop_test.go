@@ -0,0 +1,130 @@
+package core
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+var testHandle = func(msg testMessage) {} // Handles the messages of the tests, only used on the event loop.
+var startOnce sync.Once                   // The node of the tests is only started once.
+
+// startNode starts the listener and the event loop of the node of the tests,
+// unless an earlier test did, and waits until it listens.
+func startNode(t *testing.T) {
+	t.Helper()
+
+	startOnce.Do(Start)
+	for deadline := time.Now().Add(5 * time.Second); !testNetwork.probe(self); {
+		if time.Now().After(deadline) {
+			t.Fatal("node did not listen within five seconds")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// handleOnLoop makes the event loop hand the messages of the tests to handle
+// until the test ends.
+func handleOnLoop(t *testing.T, handle func(msg testMessage)) {
+	t.Helper()
+
+	Run(func() { testHandle = handle })
+	t.Cleanup(func() {
+		Run(func() { testHandle = func(msg testMessage) {} })
+	})
+}
+
+// waitOnLoop runs check on the event loop until it reports true, failing the
+// test if it does not within five seconds.
+func waitOnLoop(t *testing.T, what string, check func() bool) {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		done := false
+		Run(func() { done = check() })
+		if done {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s within five seconds", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestLoopRunsEventsOneAtATime(t *testing.T) {
+	startNode(t)
+
+	// The counter is only touched on the event loop, so the race detector
+	// reports any two events that ran at the same time.
+	count := 0
+	var wg sync.WaitGroup
+	for idx := 0; idx < 50; idx++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			Run(func() { count++ })
+			Post(func() { count++ })
+			After(time.Millisecond, func() { count++ })
+		}()
+	}
+	wg.Wait()
+
+	waitOnLoop(t, "not all 150 events ran", func() bool { return count == 150 })
+}
+
+func TestLoopHandlesReceivedMessagesInOrder(t *testing.T) {
+	startNode(t)
+
+	handled := make([]int, 0)
+	handleOnLoop(t, func(msg testMessage) { handled = append(handled, msg.Value) })
+
+	for value := 1; value <= 100; value++ {
+		Send(self, testValue(value))
+	}
+
+	waitOnLoop(t, "not all 100 messages were handled", func() bool { return len(handled) == 100 })
+	Run(func() {
+		for idx, value := range handled {
+			if value != idx+1 {
+				t.Fatalf("handled %v, expected 1 to 100 in order", handled)
+			}
+		}
+	})
+}
+
+// resetTermination forgets the termination detected by earlier tests. It must
+// be called on the event loop.
+func resetTermination() {
+	terminationDetected = false
+	safraInitiator, safraCount, safraBlack, safraRound = false, 0, false, 0
+}
+
+func TestSafraDetectsTerminationOnceMessagesAreHandled(t *testing.T) {
+	startNode(t)
+	Run(resetTermination)
+
+	// Every value up to 20 makes the handler send the next one, so the node
+	// is active until the last one was handled.
+	handled := 0
+	handleOnLoop(t, func(msg testMessage) {
+		handled++
+		if msg.Value < 20 {
+			Send(self, testValue(msg.Value+1))
+		}
+	})
+
+	detected := -1
+	Run(func() {
+		SetupSafra(TreeRoute(func() Peer { return self }, func() []Peer { return nil }), func() { detected = handled })
+		Send(self, testValue(1))
+		StartSafra()
+	})
+
+	waitOnLoop(t, "termination was not detected", func() bool { return detected >= 0 })
+	Run(func() {
+		if detected != 20 {
+			t.Errorf("termination detected after %d of 20 messages were handled", detected)
+		}
+	})
+}
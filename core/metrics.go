@@ -0,0 +1,230 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metrics holds the counters and gauges that a node exposes over HTTP in the
+// Prometheus text format. Sent and Received count messages by their type,
+// DialRetries counts failed dials that are retried, BytesSent counts the bytes
+// written to connections, Reachable tracks whether a neighbour (keyed by
+// host:port) answered the last dial, Neighbours lists the neighbours it is
+// reported for, Gauges holds the gauges of the protocol by name and WaveStart,
+// WaveSeconds, WaveCount and WaveLast track wave completion latency.
+type metrics struct {
+	mutex       sync.Mutex
+	Sent        map[string]int
+	Received    map[string]int
+	DialRetries int
+	BytesSent   int
+	Reachable   map[string]bool
+	Neighbours  []string
+	Gauges      map[string]*gauge
+	WaveStart   time.Time
+	WaveSeconds float64
+	WaveCount   int
+	WaveLast    float64
+}
+
+// gauge is a gauge of the protocol, described by Help.
+type gauge struct {
+	Help  string
+	Value int
+}
+
+var nodeMetrics = metrics{
+	Sent:      make(map[string]int),
+	Received:  make(map[string]int),
+	Reachable: make(map[string]bool),
+	Gauges:    make(map[string]*gauge),
+}
+
+// serveMetrics starts an HTTP listener on addr that serves the metrics of the
+// node on /metrics. An empty addr disables the listener.
+func serveMetrics(addr string) {
+	if addr == "" {
+		return
+	}
+
+	nodeMetrics.mutex.Lock()
+	for _, n := range neighbours {
+		nodeMetrics.Neighbours = append(nodeMetrics.Neighbours, n.Host+":"+n.Port)
+	}
+	nodeMetrics.mutex.Unlock()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		nodeMetrics.write(w)
+	})
+
+	go func() {
+		log.Printf("Serving metrics on http://%s/metrics\n", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Printf("Metrics listener stopped: %v\n", err)
+		}
+	}()
+}
+
+// messageSent counts a message of type kind sent to a neighbour.
+func (m *metrics) messageSent(kind string) {
+	m.mutex.Lock()
+	m.Sent[kind]++
+	m.mutex.Unlock()
+}
+
+// bytesSent counts n bytes written to a connection.
+func (m *metrics) bytesSent(n int) {
+	m.mutex.Lock()
+	m.BytesSent += n
+	m.mutex.Unlock()
+}
+
+// messageReceived counts a message of type kind received from a neighbour.
+func (m *metrics) messageReceived(kind string) {
+	m.mutex.Lock()
+	m.Received[kind]++
+	m.mutex.Unlock()
+}
+
+// dialFailed counts a failed dial to recvAddr and marks it unreachable.
+func (m *metrics) dialFailed(recvAddr Peer) {
+	m.mutex.Lock()
+	m.DialRetries++
+	m.Reachable[recvAddr.Host+":"+recvAddr.Port] = false
+	m.mutex.Unlock()
+}
+
+// dialSucceeded marks recvAddr as reachable.
+func (m *metrics) dialSucceeded(recvAddr Peer) {
+	m.mutex.Lock()
+	m.Reachable[recvAddr.Host+":"+recvAddr.Port] = true
+	m.mutex.Unlock()
+}
+
+// Gauge registers the gauge name of the protocol, described by help, and
+// returns a function that sets it.
+func Gauge(name string, help string) func(value int) {
+	nodeMetrics.mutex.Lock()
+	g := &gauge{Help: help}
+	nodeMetrics.Gauges[name] = g
+	nodeMetrics.mutex.Unlock()
+
+	return func(value int) {
+		nodeMetrics.mutex.Lock()
+		g.Value = value
+		nodeMetrics.mutex.Unlock()
+	}
+}
+
+// WaveStarted marks the start of a wave, restarting any wave in progress.
+func WaveStarted() {
+	m := &nodeMetrics
+	m.mutex.Lock()
+	m.WaveStart = time.Now()
+	m.mutex.Unlock()
+}
+
+// WaveCompleted records the latency of the wave in progress, if any.
+func WaveCompleted() {
+	m := &nodeMetrics
+	m.mutex.Lock()
+	if !m.WaveStart.IsZero() {
+		m.WaveLast = time.Since(m.WaveStart).Seconds()
+		m.WaveSeconds += m.WaveLast
+		m.WaveCount++
+		m.WaveStart = time.Time{}
+	}
+	m.mutex.Unlock()
+}
+
+// Report returns a one line summary of the messages sent by type, for
+// comparing the message complexity of algorithms.
+func Report() string {
+	m := &nodeMetrics
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	total := 0
+	counts := make([]string, 0, len(m.Sent))
+	for _, kind := range sortedKeys(m.Sent) {
+		total += m.Sent[kind]
+		counts = append(counts, fmt.Sprintf("%s=%d", kind, m.Sent[kind]))
+	}
+
+	return fmt.Sprintf("%d messages sent (%s)", total, strings.Join(counts, " "))
+}
+
+// write writes all metrics to w in the Prometheus text exposition format.
+func (m *metrics) write(w io.Writer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	fmt.Fprintln(w, "# HELP node_messages_sent_total Messages sent by type.")
+	fmt.Fprintln(w, "# TYPE node_messages_sent_total counter")
+	for _, kind := range sortedKeys(m.Sent) {
+		fmt.Fprintf(w, "node_messages_sent_total{type=%q} %d\n", kind, m.Sent[kind])
+	}
+
+	fmt.Fprintln(w, "# HELP node_messages_received_total Messages received by type.")
+	fmt.Fprintln(w, "# TYPE node_messages_received_total counter")
+	for _, kind := range sortedKeys(m.Received) {
+		fmt.Fprintf(w, "node_messages_received_total{type=%q} %d\n", kind, m.Received[kind])
+	}
+
+	fmt.Fprintln(w, "# HELP node_bytes_sent_total Bytes written to connections, including the codec byte.")
+	fmt.Fprintln(w, "# TYPE node_bytes_sent_total counter")
+	fmt.Fprintf(w, "node_bytes_sent_total %d\n", m.BytesSent)
+
+	fmt.Fprintln(w, "# HELP node_dial_retries_total Failed dials to neighbours that were retried.")
+	fmt.Fprintln(w, "# TYPE node_dial_retries_total counter")
+	fmt.Fprintf(w, "node_dial_retries_total %d\n", m.DialRetries)
+
+	fmt.Fprintln(w, "# HELP node_neighbour_up Whether the last dial to a neighbour succeeded.")
+	fmt.Fprintln(w, "# TYPE node_neighbour_up gauge")
+	for _, addr := range m.Neighbours {
+		up := 0
+		if m.Reachable[addr] {
+			up = 1
+		}
+		fmt.Fprintf(w, "node_neighbour_up{neighbour=%q} %d\n", addr, up)
+	}
+
+	names := make([]string, 0, len(m.Gauges))
+	for name := range m.Gauges {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "# HELP %s %s\n", name, m.Gauges[name].Help)
+		fmt.Fprintf(w, "# TYPE %s gauge\n", name)
+		fmt.Fprintf(w, "%s %d\n", name, m.Gauges[name].Value)
+	}
+
+	fmt.Fprintln(w, "# HELP node_wave_completion_seconds Time from the start of a wave to its last reply.")
+	fmt.Fprintln(w, "# TYPE node_wave_completion_seconds summary")
+	fmt.Fprintf(w, "node_wave_completion_seconds_sum %f\n", m.WaveSeconds)
+	fmt.Fprintf(w, "node_wave_completion_seconds_count %d\n", m.WaveCount)
+
+	fmt.Fprintln(w, "# HELP node_wave_last_completion_seconds Latency of the most recently completed wave.")
+	fmt.Fprintln(w, "# TYPE node_wave_last_completion_seconds gauge")
+	fmt.Fprintf(w, "node_wave_last_completion_seconds %f\n", m.WaveLast)
+}
+
+// sortedKeys returns the keys of counts in sorted order.
+func sortedKeys(counts map[string]int) []string {
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
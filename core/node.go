@@ -0,0 +1,335 @@
+// Package core runs the nodes of the labs. It carries their messages over the
+// chosen transport and codec, injects faults, runs the event loop that owns
+// the state of a node, bounds its run, detects termination, takes snapshots
+// and exposes metrics and events. A lab only describes the messages of its
+// protocol and handles them.
+//
+// A process runs a single node, so the state of the core is kept in package
+// variables, like the state of the labs themselves.
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"io"
+	"log"
+	"time"
+)
+
+// Peer is a node of the network: its NodeId, 0 if the protocol does not number
+// its nodes, its Host and Port and the path of its Unix Socket, empty for the
+// default path.
+type Peer struct {
+	NodeId int
+	Host   string
+	Port   string
+	Socket string
+}
+
+// Header holds the fields that the messages of every protocol share: the
+// NodeId, Host and Port of the sender, the Kind of the message, the Lamport
+// Clock of the sender when it sent the message, the ID of the Snapshot a
+// marker belongs to, the place of the message on its Channel and the Safra
+// token of the termination detection.
+type Header struct {
+	NodeId   int
+	Host     string
+	Port     string
+	Kind     string
+	Clock    int
+	Snapshot string
+	Channel  *ChannelSeq
+	Safra    *SafraToken
+}
+
+// Message is a message of a protocol. The fields it shares with the messages
+// of every protocol are read and written through its header.
+type Message interface {
+	// Header returns the shared fields of the message.
+	Header() Header
+	// WithHeader returns a copy of the message with the shared fields of h.
+	WithHeader(h Header) Message
+}
+
+// Protocol describes the protocol a node runs. Name and Version have to match
+// for nodes to accept each other's messages, Types numbers the kinds of its
+// messages, Control lists the kinds that do not belong to the computation
+// whose termination is detected and Quiet the kinds that are sent too often
+// to be logged. Handle handles a received message on the event loop and State
+// returns the local state of the node, which is recorded in snapshots and
+// logged when the node stops.
+type Protocol[M Message] struct {
+	Name    string
+	Version int
+	Types   map[string]MessageType
+	Control []string
+	Quiet   []string
+	Handle  func(msg M)
+	State   func() any
+}
+
+// protocol is the protocol of the current node with the type of its messages
+// erased. New returns a message without any fields set, Encode writes a
+// message sealed in an envelope and Decode reads one.
+type protocol struct {
+	Name    string
+	Version int
+	Types   map[string]MessageType
+	Control map[string]bool
+	Quiet   map[string]bool
+	New     func() Message
+	Encode  func(w io.Writer, msg Message) error
+	Decode  func(r *bufio.Reader, c codec) (Message, error)
+	Handle  func(msg Message)
+	State   func() any
+}
+
+var self Peer         // Current node.
+var neighbours []Peer // Neighbours of the current node.
+var proto protocol    // Protocol the current node runs.
+
+var metricsAddr string          // Address to serve metrics on, if any.
+var eventsFile string           // Path to write events to, if any.
+var snapshotDir string          // Directory to write snapshots to.
+var snapshotAfter time.Duration // Delay after which a snapshot is started, if positive.
+
+// RegisterFlags registers the command line flags of the core: metrics, events,
+// snapshots, faults, codec, transport and the bounds of the run.
+func RegisterFlags() {
+	flag.StringVar(&metricsAddr, "metrics", "", "Address to serve Prometheus metrics on, e.g. 127.0.0.1:9101.")
+	flag.StringVar(&eventsFile, "events", "", "Path to write structured JSON events to.")
+	flag.StringVar(&snapshotDir, "snapshot-dir", ".", "Directory to write snapshots to.")
+	flag.DurationVar(&snapshotAfter, "snapshot-after", 0, "Start a snapshot after this delay, e.g. 2s.")
+	registerFaultFlags()
+	registerCodecFlags()
+	registerTransportFlags()
+	registerLifecycleFlags()
+}
+
+// Setup makes the current node run protocol p as node current with the given
+// neighbours. It opens the event log, checks the flags, serves the metrics and
+// takes snapshots as requested, and stops the node on signals and timeouts.
+// The node receives messages once it started.
+func Setup[M Message](p Protocol[M], current Peer, peers []Peer) {
+	self = current
+	neighbours = append([]Peer(nil), peers...)
+	proto = eraseProtocol(p)
+
+	openEventLog(eventsFile)
+	setupFaults()
+	setupCodec()
+	setupTransport()
+	setupLifecycle()
+	serveMetrics(metricsAddr)
+	setupSnapshots()
+}
+
+// eraseProtocol returns protocol p with the type of its messages erased.
+func eraseProtocol[M Message](p Protocol[M]) protocol {
+	erased := protocol{
+		Name:    p.Name,
+		Version: p.Version,
+		Types:   p.Types,
+		Control: make(map[string]bool),
+		Quiet:   make(map[string]bool),
+		New: func() Message {
+			var msg M
+			return msg
+		},
+		Encode: func(w io.Writer, msg Message) error {
+			return writeMessage(w, msg.(M))
+		},
+		Decode: func(r *bufio.Reader, c codec) (Message, error) {
+			return readEnvelope[M](r, c)
+		},
+		Handle: func(msg Message) {
+			p.Handle(msg.(M))
+		},
+		State: p.State,
+	}
+	for _, kind := range p.Control {
+		erased.Control[kind] = true
+	}
+	for _, kind := range p.Quiet {
+		erased.Quiet[kind] = true
+	}
+
+	return erased
+}
+
+// Start starts listening for messages and runs the event loop that handles
+// them.
+func Start() {
+	go listen()
+	go runLoop()
+}
+
+// listen listens for messages and hands them over to the event loop.
+func listen() {
+	incoming := nodeTransport.listen(nodeContext, self)
+
+	log.Printf("Listening on %s:%s over %s\n", self.Host, self.Port, transportName)
+
+	for payload := range incoming {
+		msg, err := readMessage(bytes.NewReader(payload))
+		if err != nil {
+			// If there is an error or the message was rejected, skip the
+			// message.
+			log.Printf("Skipping message: %v.\n", err)
+			continue
+		}
+
+		queueMessage(msg)
+	}
+}
+
+// receive handles msg on the event loop, along with the messages it released
+// that were held back for snapshots.
+func receive(msg Message) {
+	for _, next := range inOrder(msg) {
+		handle(next)
+	}
+}
+
+// handle handles msg on the event loop. Snapshot markers and the signals and
+// tokens of the termination detection are handled by the core, every other
+// message is recorded for snapshots and termination detection and handed to
+// the protocol.
+func handle(msg Message) {
+	h := msg.Header()
+	nodeMetrics.messageReceived(h.Kind)
+	logReceive(msg)
+
+	if h.Kind == MARKER {
+		handleMarker(h)
+		return
+	}
+
+	if handleTerminationMessage(h) {
+		return
+	}
+	terminationReceived(h)
+	recordInFlight(msg)
+
+	proto.Handle(msg)
+}
+
+// Send sends msg to node to, subject to the injected faults, and retries until
+// it is delivered. It does not wait for the delivery, the message is queued in
+// the outbox of the node. Once the node stopped no new messages are sent.
+// Over an unreliable transport the message may be lost like one sent once, so
+// it is not numbered on its channel either: a lost message would hold back
+// every later message on it.
+func Send(to Peer, msg Message) {
+	send(to, msg, nodeTransport.reliable(), func(to Peer, msg Message) {
+		enqueue(to, msg, 0)
+	})
+}
+
+// SendOnce sends msg to node to like Send, but gives it up if the node cannot
+// be reached within timeout. Since it may be lost it is not numbered on its
+// channel, so snapshots do not wait for it.
+func SendOnce(to Peer, msg Message, timeout time.Duration) {
+	send(to, msg, false, func(to Peer, msg Message) {
+		enqueue(to, msg, timeout)
+	})
+}
+
+// send stamps msg with the Lamport clock and hands it to deliver after
+// applying the injected faults, numbering every copy on its channel if
+// numbered. It counts as outbound until then, deliver counts the message
+// itself.
+func send(to Peer, msg Message, numbered bool, deliver func(Peer, Message)) {
+	if nodeContext.Err() != nil {
+		return
+	}
+	outboundMessages.Add(1)
+	defer outboundMessages.Done()
+
+	if kind := msg.Header().Kind; !proto.Quiet[kind] {
+		log.Printf("Sending %s to %s:%s.\n", kind, to.Host, to.Port)
+	}
+	msg = logSend(to, msg)
+	injectFaults(to, msg, numbered, deliver)
+}
+
+// deliverMessage delivers msg to node to. Retries sending indefinitely. It is
+// only called by the outbox of the node.
+func deliverMessage(to Peer, msg Message) {
+	var payload bytes.Buffer
+	if err := proto.Encode(&payload, msg); err != nil {
+		log.Fatal(err)
+	}
+
+	for {
+		if err := nodeTransport.transmit(to, payload.Bytes()); err == nil {
+			nodeMetrics.dialSucceeded(to)
+			break
+		}
+
+		nodeMetrics.dialFailed(to)
+		time.Sleep(1 * time.Second)
+	}
+
+	kind := msg.Header().Kind
+	nodeMetrics.messageSent(kind)
+	if !proto.Quiet[kind] {
+		log.Printf("Sent %s to %s:%s.\n", kind, to.Host, to.Port)
+	}
+}
+
+// deliverMessageOnce delivers msg to node to, giving up if it cannot be
+// reached within timeout. It is only called by the outbox of the node.
+func deliverMessageOnce(to Peer, msg Message, timeout time.Duration) {
+	kind := msg.Header().Kind
+
+	var payload bytes.Buffer
+	if err := proto.Encode(&payload, msg); err != nil {
+		log.Printf("Error sending %s to %s:%s: %v\n", kind, to.Host, to.Port, err)
+		return
+	}
+
+	if err := nodeTransport.transmitOnce(to, payload.Bytes(), timeout); err != nil {
+		nodeMetrics.dialFailed(to)
+		return
+	}
+
+	nodeMetrics.dialSucceeded(to)
+	nodeMetrics.messageSent(kind)
+}
+
+// WaitForPeers waits until all peers can be reached, checking every second. It
+// reports false if the node stopped before.
+func WaitForPeers(peers []Peer) bool {
+	for _, p := range peers {
+		for {
+			log.Printf("Trying to dial %s:%s\n", p.Host, p.Port)
+			if nodeTransport.probe(p) {
+				log.Printf("Successfully dialled %s:%s\n", p.Host, p.Port)
+				nodeMetrics.dialSucceeded(p)
+				break
+			}
+
+			nodeMetrics.dialFailed(p)
+
+			if !SleepOrStop(1 * time.Second) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// Probe checks whether node p is up.
+func Probe(p Peer) bool {
+	return nodeTransport.probe(p)
+}
+
+// control returns a message of the protocol of kind, sent by the current node,
+// that carries the fields of h besides.
+func control(kind string, h Header) Message {
+	h.NodeId, h.Host, h.Port, h.Kind = self.NodeId, self.Host, self.Port, kind
+	return proto.New().WithHeader(h)
+}
@@ -0,0 +1,86 @@
+package core
+
+import (
+	"sync"
+	"time"
+)
+
+// outgoing is a message waiting in an outbox. Timeout is how long to wait for
+// the node to be reachable before giving the message up, 0 to retry until it
+// is delivered.
+type outgoing struct {
+	Msg     Message
+	Timeout time.Duration
+}
+
+// outbox queues the messages to one node in the order they were sent. A
+// goroutine of its own delivers them one at a time, so a handler that sends to
+// a node that is slow or down never waits for it, and later messages to the
+// node never overtake earlier ones that are still being retried. ready is
+// signalled whenever a message is queued.
+type outbox struct {
+	to    Peer
+	mutex sync.Mutex
+	queue []outgoing
+	ready chan struct{}
+}
+
+var outboxes = make(map[string]*outbox) // Outboxes by the host:port of their node.
+var outboxMutex sync.Mutex              // Mutex to manage access to outboxes.
+
+// enqueue queues msg for delivery to node to, giving it up after timeout if
+// it is positive. The message counts as outbound until it is delivered or
+// given up.
+func enqueue(to Peer, msg Message, timeout time.Duration) {
+	outboundMessages.Add(1)
+
+	box := outboxOf(to)
+	box.mutex.Lock()
+	box.queue = append(box.queue, outgoing{Msg: msg, Timeout: timeout})
+	box.mutex.Unlock()
+
+	select {
+	case box.ready <- struct{}{}:
+	default:
+	}
+}
+
+// outboxOf returns the outbox of node to, starting it on first use.
+func outboxOf(to Peer) *outbox {
+	outboxMutex.Lock()
+	defer outboxMutex.Unlock()
+
+	key := to.Host + ":" + to.Port
+	box, ok := outboxes[key]
+	if !ok {
+		box = &outbox{to: to, ready: make(chan struct{}, 1)}
+		outboxes[key] = box
+		go box.run()
+	}
+
+	return box
+}
+
+// run delivers the queued messages in order. It keeps running once the node
+// stopped, so that shutdown can drain the outbox.
+func (box *outbox) run() {
+	for range box.ready {
+		for {
+			box.mutex.Lock()
+			if len(box.queue) == 0 {
+				box.mutex.Unlock()
+				break
+			}
+			next := box.queue[0]
+			box.queue = box.queue[1:]
+			box.mutex.Unlock()
+
+			if next.Timeout > 0 {
+				deliverMessageOnce(box.to, next.Msg, next.Timeout)
+			} else {
+				deliverMessage(box.to, next.Msg)
+			}
+			outboundMessages.Done()
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+// listenAt makes node addr listen on the network of the tests until the test
+// ends, and returns the channel its payloads arrive on.
+func listenAt(t *testing.T, addr Peer) <-chan []byte {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		cancel()
+		for testNetwork.probe(addr) {
+			time.Sleep(time.Millisecond)
+		}
+	})
+
+	return testNetwork.listen(ctx, addr)
+}
+
+// receiveValue reads the next message from incoming, failing the test if none
+// arrives within five seconds.
+func receiveValue(t *testing.T, incoming <-chan []byte) int {
+	t.Helper()
+
+	select {
+	case payload := <-incoming:
+		msg, err := readMessage(bytes.NewReader(payload))
+		if err != nil {
+			t.Fatalf("reading message: %v", err)
+		}
+		return msg.(testMessage).Value
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message delivered within five seconds")
+	}
+
+	return 0
+}
+
+func TestSendDoesNotWaitForUnreachableNode(t *testing.T) {
+	down := Peer{Host: "127.0.0.1", Port: "10102"}
+	up := Peer{Host: "127.0.0.1", Port: "10103"}
+	incoming := listenAt(t, up)
+
+	start := time.Now()
+	Send(down, testValue(1))
+	Send(up, testValue(2))
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("sending to a node that is down took %v", elapsed)
+	}
+
+	if value := receiveValue(t, incoming); value != 2 {
+		t.Errorf("delivered value %d, sent 2", value)
+	}
+
+	// The message to the node that was down is delivered once it is up.
+	incoming = listenAt(t, down)
+	if value := receiveValue(t, incoming); value != 1 {
+		t.Errorf("delivered value %d, sent 1", value)
+	}
+}
+
+func TestSendKeepsOrderPerNode(t *testing.T) {
+	to := Peer{Host: "127.0.0.1", Port: "10104"}
+	incoming := listenAt(t, to)
+
+	for value := 1; value <= 100; value++ {
+		Send(to, testValue(value))
+	}
+	for value := 1; value <= 100; value++ {
+		if got := receiveValue(t, incoming); got != value {
+			t.Fatalf("delivered value %d, expected %d", got, value)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// MARKER is a special message that carries a Chandy-Lamport snapshot marker.
+const (
+	MARKER = "#MARKER#"
+)
+
+// snapshot is the part of a global snapshot recorded by the current node. Id
+// identifies the snapshot by its initiator, the run of the initiator and a
+// counter, for example 127.0.0.1:6001/1700000000000/1, Node is the host:port of the current node, State is
+// its recorded local state and Channels holds the messages that were in
+// flight on each incoming channel, keyed by the host:port of the sender.
+// recording tracks the channels that are still being recorded.
+type snapshot struct {
+	Id        string
+	Node      string
+	State     any
+	Channels  map[string][]Message
+	recording map[string]bool
+}
+
+var snapshots = make(map[string]*snapshot) // Snapshots in progress by ID.
+var snapshotsDone = make(map[string]bool)  // IDs of the snapshots the current node finished.
+var snapshotRun int64                      // Time the current node started in milliseconds, identifies its run.
+var snapshotCount int                      // Snapshots started by the current node.
+var snapshotMutex sync.Mutex               // Mutex to manage access to the snapshots.
+
+// setupSnapshots starts a snapshot whenever SIGUSR1 is received, or once
+// after the snapshot delay if it is positive.
+func setupSnapshots() {
+	snapshotRun = time.Now().UnixNano() / int64(time.Millisecond)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+
+	go func() {
+		for range signals {
+			startSnapshot()
+		}
+	}()
+
+	if snapshotAfter > 0 {
+		time.AfterFunc(snapshotAfter, startSnapshot)
+	}
+}
+
+// startSnapshot starts a new snapshot with the current node as initiator. The
+// marker is sent to the current node itself so that the local state is
+// recorded on the event loop, between two received messages.
+func startSnapshot() {
+	snapshotMutex.Lock()
+	snapshotCount++
+	id := fmt.Sprintf("%s:%s/%d/%d", self.Host, self.Port, snapshotRun, snapshotCount)
+	snapshotMutex.Unlock()
+
+	log.Printf("Starting snapshot %s.\n", id)
+
+	Send(self, control(MARKER, Header{Snapshot: id}))
+}
+
+// handleMarker handles the marker with header h on the event loop. The first
+// marker of a snapshot records the local state and sends markers to all
+// neighbours, any marker stops recording the channel it arrived on. Markers of
+// snapshots the current node finished, such as duplicated ones, are ignored.
+func handleMarker(h Header) {
+	snapshotMutex.Lock()
+	if snapshotsDone[h.Snapshot] {
+		snapshotMutex.Unlock()
+		return
+	}
+	s, ok := snapshots[h.Snapshot]
+	if !ok {
+		s = &snapshot{
+			Id:        h.Snapshot,
+			Node:      self.Host + ":" + self.Port,
+			State:     proto.State(),
+			Channels:  make(map[string][]Message),
+			recording: make(map[string]bool),
+		}
+
+		for _, n := range neighbours {
+			s.Channels[n.Host+":"+n.Port] = make([]Message, 0)
+			s.recording[n.Host+":"+n.Port] = true
+		}
+		snapshots[s.Id] = s
+
+		log.Printf("Recorded local state for snapshot %s.\n", s.Id)
+	}
+
+	delete(s.recording, h.Host+":"+h.Port)
+	done := len(s.recording) == 0
+	if done {
+		delete(snapshots, s.Id)
+		snapshotsDone[s.Id] = true
+	}
+	snapshotMutex.Unlock()
+
+	if !ok {
+		for _, n := range neighbours {
+			Send(n, control(MARKER, Header{Snapshot: s.Id}))
+		}
+	}
+
+	if done {
+		writeSnapshot(s)
+	}
+}
+
+// recordInFlight records msg as in flight on every snapshot that is still
+// recording the channel msg arrived on.
+func recordInFlight(msg Message) {
+	snapshotMutex.Lock()
+	defer snapshotMutex.Unlock()
+
+	h := msg.Header()
+	channel := h.Host + ":" + h.Port
+	for _, s := range snapshots {
+		if s.recording[channel] {
+			s.Channels[channel] = append(s.Channels[channel], msg)
+		}
+	}
+}
+
+// writeSnapshot writes the part of snapshot s recorded by the current node to
+// the snapshot directory.
+func writeSnapshot(s *snapshot) {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		log.Printf("Error encoding snapshot %s: %v\n", s.Id, err)
+		return
+	}
+
+	name := strings.NewReplacer(":", "-", "/", "-").Replace(s.Id)
+	path := filepath.Join(snapshotDir, fmt.Sprintf("snapshot_%s_%s.json", name, self.Port))
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		log.Printf("Error writing snapshot %s: %v\n", s.Id, err)
+		return
+	}
+
+	log.Println("Wrote snapshot to: " + path)
+}
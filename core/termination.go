@@ -0,0 +1,273 @@
+package core
+
+import (
+	"log"
+	"strconv"
+)
+
+// Special messages of the termination detection. SIGNAL acknowledges a basic
+// message of a diffusing computation, SAFRA carries the token of Safra's
+// algorithm.
+const (
+	SIGNAL = "#SIGNAL#"
+	SAFRA  = "#SAFRA#"
+)
+
+// SafraToken is the token of Safra's algorithm. Round numbers the trips of the
+// token, Count sums the message counters of the nodes it visited in the round
+// and Black is set if one of them received a message since its last visit.
+type SafraToken struct {
+	Round int
+	Count int
+	Black bool
+}
+
+// Route names the node the Safra token goes to next, given the node it came
+// from (the current node itself when a round starts). Done means the token is
+// back at the initiator and the round is over. It is called on the event loop.
+type Route func(from Peer) (next Peer, done bool)
+
+// The state of the termination detection is only touched on the event loop,
+// or before the node starts.
+var terminated func()                   // Called once termination is detected.
+var terminationDetected bool            // Termination has been detected.
+var controlSeen = make(map[string]bool) // Signals and tokens received, by sender and clock.
+
+// State of the Dijkstra-Scholten algorithm, if enabled. A node is engaged
+// while it takes part in the diffusing computation, its parent is the node
+// that engaged it and its deficit the number of basic messages it sent that
+// were not signalled yet.
+var dsEnabled bool
+var dsEngaged bool
+var dsRoot bool
+var dsStarting bool
+var dsParent Peer
+var dsDeficit int
+
+// State of Safra's algorithm. The counter is the number of basic messages sent
+// minus the number received, a node turns black when it receives one.
+var safraRoute Route
+var safraInitiator bool
+var safraCount int
+var safraBlack bool
+var safraRound int
+
+// SetupDiffusion makes the current node take part in a diffusing computation
+// and calls done once termination has been detected. It must be called before
+// the node starts.
+func SetupDiffusion(done func()) {
+	dsEnabled = true
+	terminated = done
+}
+
+// SetupSafra makes the current node pass the Safra token along next and calls
+// done once termination has been detected. It must be called before the node
+// starts.
+func SetupSafra(next Route, done func()) {
+	safraRoute = next
+	terminated = done
+}
+
+// isBasic checks if messages of kind belong to the algorithm itself rather
+// than to snapshots, termination or the control messages of the protocol.
+func isBasic(kind string) bool {
+	switch kind {
+	case MARKER, SIGNAL, SAFRA:
+		return false
+	}
+
+	return !proto.Control[kind]
+}
+
+// terminationSent counts copies of a message of kind that are on their way,
+// if it is a basic message.
+func terminationSent(kind string, copies int) {
+	if !isBasic(kind) {
+		return
+	}
+
+	dsDeficit += copies
+	safraCount += copies
+}
+
+// terminationReceived counts the message with header h if it is a basic
+// message. In a diffusing computation a node that is not engaged is engaged by
+// it, otherwise it is signalled back right away.
+func terminationReceived(h Header) {
+	if !isBasic(h.Kind) {
+		return
+	}
+
+	safraCount--
+	safraBlack = true
+
+	sender := Peer{NodeId: h.NodeId, Host: h.Host, Port: h.Port}
+	if !dsEnabled {
+		return
+	}
+	if dsEngaged {
+		sendControl(sender, SIGNAL, nil)
+		return
+	}
+
+	dsEngaged = true
+	dsParent = sender
+}
+
+// TerminationIdle tells the Dijkstra-Scholten algorithm that the current node
+// is passive. Once all its basic messages are signalled it signals its parent
+// and leaves the computation, or detects termination if it is the root. It
+// must be called on the event loop.
+func TerminationIdle() {
+	if !dsEngaged || dsStarting || dsDeficit > 0 {
+		return
+	}
+
+	if dsRoot {
+		detectTermination("the diffusing computation")
+		return
+	}
+
+	dsEngaged = false
+	sendControl(dsParent, SIGNAL, nil)
+}
+
+// Diffuse starts a diffusing computation with the current node as its root,
+// which sends the first basic messages in start. The node counts as active
+// until start returns. It must be called on the event loop.
+func Diffuse(start func()) {
+	dsEngaged, dsRoot, dsStarting = true, true, true
+	start()
+	dsStarting = false
+
+	TerminationIdle()
+}
+
+// StartSafra starts the first round of Safra's algorithm with the current node
+// as initiator. It must be called on the event loop.
+func StartSafra() {
+	safraInitiator = true
+	passToken(self, SafraToken{})
+}
+
+// handleTerminationMessage handles the message with header h if it is a
+// signal or token and reports whether it was one. The event loop handles one
+// event at a time, so the current node is passive whenever it handles the
+// token. Duplicates, which
+// carry the same Lamport clock from the same sender, are skipped, since a
+// signal counted twice would detect termination too early.
+func handleTerminationMessage(h Header) bool {
+	if h.Kind != SIGNAL && h.Kind != SAFRA {
+		return false
+	}
+
+	key := h.Host + ":" + h.Port + "/" + strconv.Itoa(h.Clock)
+	if controlSeen[key] {
+		return true
+	}
+	controlSeen[key] = true
+
+	switch h.Kind {
+	case SIGNAL:
+		dsDeficit--
+		TerminationIdle()
+	case SAFRA:
+		if h.Safra != nil {
+			passToken(Peer{NodeId: h.NodeId, Host: h.Host, Port: h.Port}, *h.Safra)
+		}
+	}
+
+	return true
+}
+
+// passToken passes token, which came from node from, on along the route. A
+// node adds its counter and colour on its first visit in a round and turns
+// white. Back at the initiator the round ends, with termination if the token
+// and initiator stayed white and no basic message is in flight, otherwise the
+// next round starts. The first round starts with token round 0.
+func passToken(from Peer, token SafraToken) {
+	if safraRoute == nil || terminationDetected {
+		return
+	}
+
+	next, done := safraRoute(from)
+	if token.Round == 0 || done {
+		if done && !token.Black && !safraBlack && token.Count+safraCount == 0 {
+			detectTermination("Safra's algorithm")
+			return
+		}
+		if done {
+			log.Printf("Safra round %d found no termination (count %d).\n", token.Round, token.Count+safraCount)
+		}
+
+		token = SafraToken{Round: token.Round + 1}
+		safraRound = token.Round
+		safraBlack = false
+		if next, done = safraRoute(self); done {
+			next = self // The initiator is alone, the token comes back right away.
+		}
+	} else if token.Round > safraRound {
+		safraRound = token.Round
+		token.Count += safraCount
+		token.Black = token.Black || safraBlack
+		safraBlack = false
+	}
+
+	sendControl(next, SAFRA, &token)
+}
+
+// detectTermination calls the termination callback once, after termination
+// was detected by algorithm.
+func detectTermination(algorithm string) {
+	if terminationDetected {
+		return
+	}
+	terminationDetected = true
+
+	log.Printf("Termination detected by %s.\n", algorithm)
+	LogLocal(EVENT_STATE_CHANGE, "termination detected")
+	if terminated != nil {
+		terminated()
+	}
+}
+
+// sendControl sends a control message of kind, carrying token if it is not
+// nil, to node recvAddr.
+func sendControl(recvAddr Peer, kind string, token *SafraToken) {
+	Send(recvAddr, control(kind, Header{Safra: token}))
+}
+
+// RingRoute passes the Safra token around a ring to the node returned by next.
+func RingRoute(next func() Peer) Route {
+	return func(from Peer) (Peer, bool) {
+		if safraInitiator && from.Port != self.Port {
+			return Peer{}, true
+		}
+
+		return next(), false
+	}
+}
+
+// TreeRoute walks the Safra token depth first around the spanning tree given
+// by parent and children: a node passes it on to its first child, from every
+// child to the next one and from the last one back to its parent.
+func TreeRoute(parent func() Peer, children func() []Peer) Route {
+	return func(from Peer) (Peer, bool) {
+		kids := children()
+		next := 0
+		for idx, child := range kids {
+			if child.Port == from.Port {
+				next = idx + 1
+			}
+		}
+
+		if next < len(kids) {
+			return kids[next], false
+		}
+		if safraInitiator {
+			return Peer{}, true
+		}
+
+		return parent(), false
+	}
+}
@@ -0,0 +1,168 @@
+package core
+
+import (
+	"context"
+	"flag"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// transport carries the encoded messages of the current node to other nodes.
+// Every payload is delivered whole, as one message.
+type transport interface {
+	// listen listens for messages on the address of node addr and returns the
+	// channel their payloads are delivered on, one at a time, until ctx is
+	// done. The channel is closed once the transport stopped listening.
+	listen(ctx context.Context, addr Peer) <-chan []byte
+	// transmit sends payload to node recvAddr. An error means it could not be
+	// sent and has to be sent again.
+	transmit(recvAddr Peer, payload []byte) error
+	// transmitOnce sends payload to node recvAddr without waiting longer than
+	// timeout for it to be reachable and without sending it again.
+	transmitOnce(recvAddr Peer, payload []byte, timeout time.Duration) error
+	// probe checks whether node addr is up.
+	probe(addr Peer) bool
+	// reliable reports whether every payload that is transmitted arrives.
+	reliable() bool
+}
+
+var transportName string              // Name of the transport messages are sent with.
+var nodeTransport transport           // Transport messages are sent with.
+var sockets = make(map[string]string) // Unix socket paths of the nodes by host:port.
+
+// transports maps the names of the transports to their implementations.
+var transports = map[string]transport{
+	"tcp":            streamTransport{Network: "tcp"},
+	"unix":           streamTransport{Network: "unix"},
+	"udp":            udpTransport{Reliable: true},
+	"udp-unreliable": udpTransport{},
+}
+
+// registerTransportFlags registers the command line flags that select the
+// transport.
+func registerTransportFlags() {
+	flag.StringVar(&transportName, "transport", "tcp", "Transport to send messages with: tcp, udp, udp-unreliable or unix.")
+	flag.DurationVar(&retransmitInterval, "retransmit", 200*time.Millisecond, "Interval after which unacknowledged UDP messages are sent again.")
+}
+
+// setupTransport checks the transport given as flag and learns the socket
+// paths of the current node and its neighbours.
+func setupTransport() {
+	t, ok := transports[transportName]
+	if !ok {
+		panic("Invalid transport, please pass tcp, udp, udp-unreliable or unix.")
+	}
+	nodeTransport = t
+
+	for _, n := range append([]Peer{self}, neighbours...) {
+		if n.Socket == "" {
+			n.Socket = filepath.Join(os.TempDir(), "node-"+n.Host+"-"+n.Port+".sock")
+		}
+		sockets[n.Host+":"+n.Port] = n.Socket
+	}
+
+	setupUDP()
+}
+
+// streamTransport sends every message over its own connection of a stream
+// network, tcp or unix. Over unix the nodes are addressed by the socket paths
+// of the config file instead of their host and port.
+type streamTransport struct {
+	Network string
+}
+
+// address returns the address of node addr in the network of t.
+func (t streamTransport) address(addr Peer) string {
+	if t.Network == "unix" {
+		return sockets[addr.Host+":"+addr.Port]
+	}
+
+	return addr.Host + ":" + addr.Port
+}
+
+// listen accepts a connection for every message. Connections that only check
+// whether the node is up carry no payload and are skipped.
+func (t streamTransport) listen(ctx context.Context, addr Peer) <-chan []byte {
+	if t.Network == "unix" {
+		os.Remove(t.address(addr)) // Remove the socket of a previous run.
+	}
+
+	l, err := net.Listen(t.Network, t.address(addr))
+	if err != nil {
+		panic("Error listening: " + err.Error())
+	}
+
+	go func() {
+		<-ctx.Done()
+		l.Close() // Also removes the Unix socket.
+	}()
+
+	incoming := make(chan []byte)
+	go func() {
+		defer close(incoming)
+
+		for {
+			conn, err := l.Accept()
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				continue
+			}
+
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			payload, err := io.ReadAll(io.LimitReader(conn, MAX_FRAME_SIZE+1))
+			conn.Close()
+			if err != nil || len(payload) == 0 {
+				continue
+			}
+			if len(payload) > MAX_FRAME_SIZE {
+				log.Printf("Skipping message of more than %d bytes.\n", MAX_FRAME_SIZE)
+				continue
+			}
+
+			select {
+			case incoming <- payload:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return incoming
+}
+
+func (t streamTransport) transmit(recvAddr Peer, payload []byte) error {
+	return t.transmitOnce(recvAddr, payload, 0)
+}
+
+// transmitOnce dials node recvAddr, waiting at most timeout unless it is 0,
+// and writes payload.
+func (t streamTransport) transmitOnce(recvAddr Peer, payload []byte, timeout time.Duration) error {
+	conn, err := net.DialTimeout(t.Network, t.address(recvAddr), timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write(payload)
+	return err
+}
+
+func (streamTransport) reliable() bool {
+	return true
+}
+
+func (t streamTransport) probe(addr Peer) bool {
+	conn, err := net.Dial(t.Network, t.address(addr))
+	if err != nil {
+		return false
+	}
+
+	conn.Close()
+	return true
+}
@@ -0,0 +1,108 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var testNetwork = newMemoryTransport() // Network of the tests.
+
+// memoryTransport passes messages over Go channels to nodes listening in the
+// same process, by their host and port. It needs no sockets or ports at all.
+// A process runs a single node, so it only connects the node of the tests to
+// the fake peers the tests listen with.
+type memoryTransport struct {
+	mutex     sync.Mutex
+	listeners map[string]memoryListener
+}
+
+// memoryListener is a node listening in memory. Messages are queued on
+// Incoming until the node stops listening, when Done is closed.
+type memoryListener struct {
+	Incoming chan []byte
+	Done     <-chan struct{}
+}
+
+// newMemoryTransport returns a memory transport without any node listening.
+func newMemoryTransport() *memoryTransport {
+	return &memoryTransport{listeners: make(map[string]memoryListener)}
+}
+
+func (t *memoryTransport) listen(ctx context.Context, addr Peer) <-chan []byte {
+	key := addr.Host + ":" + addr.Port
+	l := memoryListener{Incoming: make(chan []byte, 1024), Done: ctx.Done()}
+
+	t.mutex.Lock()
+	if _, ok := t.listeners[key]; ok {
+		t.mutex.Unlock()
+		panic("Error listening: " + key + " is already in use.")
+	}
+	t.listeners[key] = l
+	t.mutex.Unlock()
+
+	incoming := make(chan []byte)
+	go func() {
+		defer close(incoming)
+
+		for {
+			select {
+			case payload := <-l.Incoming:
+				select {
+				case incoming <- payload:
+				case <-ctx.Done():
+				}
+			case <-ctx.Done():
+				t.mutex.Lock()
+				delete(t.listeners, key)
+				t.mutex.Unlock()
+				return
+			}
+		}
+	}()
+
+	return incoming
+}
+
+func (t *memoryTransport) transmit(recvAddr Peer, payload []byte) error {
+	return t.transmitOnce(recvAddr, payload, 0)
+}
+
+// transmitOnce hands payload to the channel of node recvAddr, waiting at most
+// timeout for room in it unless timeout is 0.
+func (t *memoryTransport) transmitOnce(recvAddr Peer, payload []byte, timeout time.Duration) error {
+	t.mutex.Lock()
+	l, ok := t.listeners[recvAddr.Host+":"+recvAddr.Port]
+	t.mutex.Unlock()
+	if !ok {
+		return errors.New("no node listening on " + recvAddr.Host + ":" + recvAddr.Port)
+	}
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		expired = time.After(timeout)
+	}
+
+	payload = append([]byte(nil), payload...) // The sender may reuse its buffer.
+	select {
+	case l.Incoming <- payload:
+		return nil
+	case <-l.Done:
+		return errors.New(recvAddr.Host + ":" + recvAddr.Port + " stopped listening")
+	case <-expired:
+		return errors.New("timed out sending to " + recvAddr.Host + ":" + recvAddr.Port)
+	}
+}
+
+func (*memoryTransport) reliable() bool {
+	return true
+}
+
+func (t *memoryTransport) probe(addr Peer) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	_, ok := t.listeners[addr.Host+":"+addr.Port]
+	return ok
+}
@@ -0,0 +1,401 @@
+package core
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Kinds of the packets of the UDP transport. Every packet starts with its kind,
+// the epoch of the node that sent the data it belongs to, the epoch of the node
+// the data is sent to as far as the sender knows it and a sequence number,
+// followed by the payload for data packets.
+const (
+	PACKET_DATA      = 1
+	PACKET_ACK       = 2
+	PACKET_PROBE     = 3
+	PACKET_PROBE_ACK = 4
+	PACKET_RESET     = 5
+)
+
+// PACKET_HEADER is the size of the header of a packet: kind, both epochs and
+// sequence number.
+const PACKET_HEADER = 1 + 8 + 8 + 8
+
+// SEQ_UNRELIABLE numbers the data packets that are sent once. They are neither
+// acknowledged nor ordered, but delivered as they come.
+const SEQ_UNRELIABLE = 0
+
+// MAX_BUFFERED bounds the reliable packets to one node that are not
+// acknowledged yet, and the packets from one node that a receiver buffers
+// because they overtook an earlier one. A receiver drops packets beyond it
+// without acknowledging them, so they are sent again later.
+const MAX_BUFFERED = 1024
+
+// udpTransport sends every message in a datagram. Reliable messages get
+// sequence numbers and are retransmitted until they are acknowledged, so that
+// the receiver delivers them once and in order. Unreliable messages are sent
+// once and delivered as they come.
+type udpTransport struct {
+	Reliable bool
+}
+
+// udpSender is the state of the messages sent to one node over UDP. Every
+// message gets the next sequence number and is retransmitted until it is
+// acknowledged. PeerEpoch is the epoch of the run of the receiver that
+// acknowledged the messages so far, 0 until the first acknowledgement.
+type udpSender struct {
+	Addr      *net.UDPAddr
+	PeerEpoch uint64
+	NextSeq   uint64
+	Unacked   map[uint64][]byte
+}
+
+// udpReceiver is the state of the messages received from one node over UDP.
+// Messages are delivered in the order of their sequence numbers, Expected is
+// the next one to deliver and Buffered holds the ones that overtook it. Epoch
+// identifies the run of the sender, a later epoch means it restarted and
+// numbers its messages from 1 again.
+type udpReceiver struct {
+	Epoch    uint64
+	Expected uint64
+	Buffered map[uint64][]byte
+}
+
+var retransmitInterval time.Duration // Interval after which unacknowledged UDP messages are sent again.
+var udpConn *net.UDPConn             // Socket of the UDP transport.
+var udpEpoch uint64                  // Epoch of the current node, later for every run.
+var udpMutex sync.Mutex              // Mutex to manage access to the UDP state.
+var udpSenders = make(map[string]*udpSender)
+var udpReceivers = make(map[string]*udpReceiver)
+var udpProbes = make(map[uint64]chan bool)
+
+// setupUDP sets the epoch of the current node to the time it started, so that
+// the epochs of the runs of a node increase.
+func setupUDP() {
+	udpEpoch = uint64(time.Now().UnixNano())
+}
+
+// listen reads the packets sent to node addr. Data packets are acknowledged
+// and delivered in order, once, unless they are numbered SEQ_UNRELIABLE, in
+// which case they are delivered as they come. Once ctx is done no
+// more data is delivered, but the socket stays open until the messages sent
+// are acknowledged.
+func (udpTransport) listen(ctx context.Context, addr Peer) <-chan []byte {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr.Host+":"+addr.Port)
+	if err != nil {
+		panic("Error resolving " + addr.Host + ":" + addr.Port + ".")
+	}
+
+	udpMutex.Lock()
+	udpConn, err = net.ListenUDP("udp", udpAddr)
+	udpMutex.Unlock()
+	if err != nil {
+		panic("Error listening: " + err.Error())
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		<-loopStopped // The event loop may still be sending.
+		faultsInFlight.Wait()
+		outboundMessages.Wait() // Unacknowledged packets are outbound messages.
+		udpConn.Close()
+		close(closed)
+	}()
+
+	incoming := make(chan []byte)
+	go retransmit(closed)
+	go func() {
+		defer close(incoming)
+
+		buf := make([]byte, 65536)
+		for {
+			n, from, err := udpConn.ReadFromUDP(buf)
+			select {
+			case <-closed:
+				return
+			default:
+			}
+			if err != nil || n < PACKET_HEADER {
+				continue
+			}
+
+			kind := buf[0]
+			epoch := binary.LittleEndian.Uint64(buf[1:])
+			peer := binary.LittleEndian.Uint64(buf[9:])
+			seq := binary.LittleEndian.Uint64(buf[17:])
+			payload := append([]byte(nil), buf[PACKET_HEADER:n]...)
+
+			switch kind {
+			case PACKET_DATA:
+				if ctx.Err() != nil {
+					continue // Not listening any more.
+				}
+				for _, p := range receiveData(from, epoch, peer, seq, payload) {
+					select {
+					case incoming <- p:
+					case <-ctx.Done():
+						return
+					}
+				}
+			case PACKET_ACK:
+				receiveAck(from, epoch, peer, seq)
+			case PACKET_RESET:
+				receiveReset(from, epoch, peer)
+			case PACKET_PROBE:
+				udpConn.WriteToUDP(packet(PACKET_PROBE_ACK, epoch, udpEpoch, seq, nil), from)
+			case PACKET_PROBE_ACK:
+				udpMutex.Lock()
+				if answered, ok := udpProbes[seq]; ok && epoch == udpEpoch {
+					answered <- true
+					delete(udpProbes, seq)
+				}
+				udpMutex.Unlock()
+			}
+		}
+	}()
+
+	return incoming
+}
+
+// transmit sends payload to node recvAddr in a data packet. A reliable packet
+// gets the next sequence number of the node and is kept until it is
+// acknowledged, an unreliable one is numbered SEQ_UNRELIABLE and forgotten.
+// Reliable packets are refused while MAX_BUFFERED packets to the node are not
+// acknowledged.
+func (t udpTransport) transmit(recvAddr Peer, payload []byte) error {
+	if len(payload) > 65507-PACKET_HEADER {
+		return errors.New("message too large for a UDP packet")
+	}
+
+	key := recvAddr.Host + ":" + recvAddr.Port
+	udpMutex.Lock()
+	defer udpMutex.Unlock()
+
+	if udpConn == nil {
+		return errors.New("not listening on UDP yet")
+	}
+
+	s, ok := udpSenders[key]
+	if !ok {
+		addr, err := net.ResolveUDPAddr("udp", key)
+		if err != nil {
+			return err
+		}
+		s = &udpSender{Addr: addr, NextSeq: 1, Unacked: make(map[uint64][]byte)}
+		udpSenders[addr.String()] = s
+		udpSenders[key] = s
+	}
+
+	if !t.Reliable {
+		_, err := udpConn.WriteToUDP(packet(PACKET_DATA, udpEpoch, s.PeerEpoch, SEQ_UNRELIABLE, payload), s.Addr)
+		return err
+	}
+
+	if len(s.Unacked) >= MAX_BUFFERED {
+		return errors.New("too many unacknowledged messages to " + key)
+	}
+
+	seq := s.NextSeq
+	s.NextSeq++
+	s.Unacked[seq] = payload
+	outboundMessages.Add(1) // Sent until it is acknowledged.
+
+	// The packet is retransmitted until it is acknowledged.
+	udpConn.WriteToUDP(packet(PACKET_DATA, udpEpoch, s.PeerEpoch, seq, payload), s.Addr)
+	return nil
+}
+
+// transmitOnce sends payload to node recvAddr once, in a datagram numbered
+// SEQ_UNRELIABLE even over the reliable transport: a message that is given up
+// must not hold back the reliable ones, so it is neither acknowledged nor
+// ordered with them. A datagram is sent without waiting, so timeout is not
+// needed.
+func (udpTransport) transmitOnce(recvAddr Peer, payload []byte, timeout time.Duration) error {
+	return udpTransport{}.transmit(recvAddr, payload)
+}
+
+func (t udpTransport) reliable() bool {
+	return t.Reliable
+}
+
+// probe sends node addr a probe that has to be answered within a second.
+func (udpTransport) probe(addr Peer) bool {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr.Host+":"+addr.Port)
+	if err != nil {
+		return false
+	}
+
+	var b [8]byte
+	rand.Read(b[:])
+	nonce := binary.LittleEndian.Uint64(b[:])
+	answered := make(chan bool, 1)
+
+	udpMutex.Lock()
+	if udpConn == nil {
+		udpMutex.Unlock()
+		return false
+	}
+	udpProbes[nonce] = answered
+	udpMutex.Unlock()
+
+	defer func() {
+		udpMutex.Lock()
+		delete(udpProbes, nonce)
+		udpMutex.Unlock()
+	}()
+
+	udpConn.WriteToUDP(packet(PACKET_PROBE, udpEpoch, 0, nonce, nil), udpAddr)
+	select {
+	case <-answered:
+		return true
+	case <-time.After(1 * time.Second):
+		return false
+	}
+}
+
+// packet builds a packet of kind with the given epochs, sequence number and
+// payload.
+func packet(kind byte, epoch uint64, peer uint64, seq uint64, payload []byte) []byte {
+	buf := make([]byte, PACKET_HEADER, PACKET_HEADER+len(payload))
+	buf[0] = kind
+	binary.LittleEndian.PutUint64(buf[1:], epoch)
+	binary.LittleEndian.PutUint64(buf[9:], peer)
+	binary.LittleEndian.PutUint64(buf[17:], seq)
+	return append(buf, payload...)
+}
+
+// receiveData acknowledges a data packet of the run epoch of its sender and
+// returns the payloads that can be delivered in order now. Duplicates are
+// acknowledged again, since the first acknowledgement may have been lost, but
+// not delivered. Packets of an earlier run of the sender are dropped, and so
+// are packets too far ahead of the one that is expected. Packets sent to an
+// earlier run of the current node, whose sequence numbers it forgot, are
+// answered with a reset so that the sender numbers them from 1 again.
+func receiveData(from *net.UDPAddr, epoch uint64, peer uint64, seq uint64, payload []byte) [][]byte {
+	if seq == SEQ_UNRELIABLE {
+		return [][]byte{payload}
+	}
+
+	udpMutex.Lock()
+	defer udpMutex.Unlock()
+
+	if peer != 0 && peer != udpEpoch {
+		udpConn.WriteToUDP(packet(PACKET_RESET, epoch, udpEpoch, seq, nil), from)
+		return nil
+	}
+
+	r, ok := udpReceivers[from.String()]
+	if ok && epoch < r.Epoch {
+		return nil
+	}
+	if !ok || epoch > r.Epoch {
+		r = &udpReceiver{Epoch: epoch, Expected: 1, Buffered: make(map[uint64][]byte)}
+		udpReceivers[from.String()] = r
+	}
+
+	if seq >= r.Expected+MAX_BUFFERED {
+		return nil
+	}
+	udpConn.WriteToUDP(packet(PACKET_ACK, epoch, udpEpoch, seq, nil), from)
+
+	if seq < r.Expected || r.Buffered[seq] != nil {
+		return nil
+	}
+	r.Buffered[seq] = payload
+
+	ready := make([][]byte, 0)
+	for r.Buffered[r.Expected] != nil {
+		ready = append(ready, r.Buffered[r.Expected])
+		delete(r.Buffered, r.Expected)
+		r.Expected++
+	}
+
+	return ready
+}
+
+// receiveAck forgets the packet seq sent in the current run to the run peer of
+// the node at from. The first acknowledgement tells the sender which run of
+// the receiver it talks to.
+func receiveAck(from *net.UDPAddr, epoch uint64, peer uint64, seq uint64) {
+	udpMutex.Lock()
+	defer udpMutex.Unlock()
+
+	s, ok := udpSenders[from.String()]
+	if !ok || epoch != udpEpoch || s.Unacked[seq] == nil {
+		return
+	}
+	if s.PeerEpoch == 0 {
+		s.PeerEpoch = peer
+	}
+	if peer != s.PeerEpoch {
+		return
+	}
+
+	delete(s.Unacked, seq)
+	outboundMessages.Done()
+}
+
+// receiveReset starts a new session with the run peer of the node at from,
+// which restarted and forgot the sequence numbers of the current run. The
+// messages it has not acknowledged are numbered from 1 again, in their order,
+// and sent to it by the next retransmission.
+func receiveReset(from *net.UDPAddr, epoch uint64, peer uint64) {
+	udpMutex.Lock()
+	defer udpMutex.Unlock()
+
+	s, ok := udpSenders[from.String()]
+	if !ok || epoch != udpEpoch || peer <= s.PeerEpoch {
+		return
+	}
+
+	seqs := make([]uint64, 0, len(s.Unacked))
+	for seq := range s.Unacked {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	unacked := make(map[uint64][]byte, len(seqs))
+	for idx, seq := range seqs {
+		unacked[uint64(idx+1)] = s.Unacked[seq]
+	}
+
+	log.Printf("%s restarted, sending %d unacknowledged messages again.\n", from, len(seqs))
+	s.PeerEpoch = peer
+	s.NextSeq = uint64(len(seqs) + 1)
+	s.Unacked = unacked
+}
+
+// retransmit sends all unacknowledged packets again every retransmit
+// interval, until the socket is closed.
+func retransmit(closed <-chan struct{}) {
+	for {
+		select {
+		case <-closed:
+			return
+		case <-time.After(retransmitInterval):
+		}
+
+		udpMutex.Lock()
+		for key, s := range udpSenders {
+			if key != s.Addr.String() {
+				continue // Senders are also kept by the address they were given by.
+			}
+
+			for seq, payload := range s.Unacked {
+				p := packet(PACKET_DATA, udpEpoch, s.PeerEpoch, seq, payload)
+				if _, err := udpConn.WriteToUDP(p, s.Addr); err != nil {
+					log.Printf("Error retransmitting to %s: %v\n", key, err)
+				}
+			}
+		}
+		udpMutex.Unlock()
+	}
+}
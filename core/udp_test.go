@@ -0,0 +1,186 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// listenUDP opens the socket of the UDP transport and one for the node at the
+// other end, and closes both when the test ends.
+func listenUDP(t *testing.T) *net.UDPConn {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	udpMutex.Lock()
+	udpConn, udpEpoch = conn, 100
+	udpSenders = make(map[string]*udpSender)
+	udpReceivers = make(map[string]*udpReceiver)
+	udpMutex.Unlock()
+
+	t.Cleanup(func() {
+		udpMutex.Lock()
+		udpConn = nil
+		udpMutex.Unlock()
+		conn.Close()
+		other.Close()
+	})
+
+	return other
+}
+
+// readPacket reads the next packet the node at the other end receives and
+// returns its kind, epochs and sequence number.
+func readPacket(t *testing.T, conn *net.UDPConn) (byte, uint64, uint64, uint64) {
+	t.Helper()
+
+	buf := make([]byte, PACKET_HEADER)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := conn.ReadFromUDP(buf); err != nil {
+		t.Fatalf("no packet received: %v", err)
+	}
+
+	epoch := binary.LittleEndian.Uint64(buf[1:])
+	peer := binary.LittleEndian.Uint64(buf[9:])
+	seq := binary.LittleEndian.Uint64(buf[17:])
+	return buf[0], epoch, peer, seq
+}
+
+func TestUDPReceiverResetsSessionOfEarlierRun(t *testing.T) {
+	other := listenUDP(t)
+	from := other.LocalAddr().(*net.UDPAddr)
+
+	// The sender still numbers its messages for run 99 of the current node.
+	if ready := receiveData(from, 7, 99, 12, []byte("late")); len(ready) != 0 {
+		t.Errorf("delivered %d messages sent to an earlier run", len(ready))
+	}
+
+	kind, epoch, peer, _ := readPacket(t, other)
+	if kind != PACKET_RESET || epoch != 7 || peer != udpEpoch {
+		t.Errorf("answered with packet %d of epochs %d and %d, expected a reset of epochs 7 and %d", kind, epoch, peer, udpEpoch)
+	}
+
+	// Numbered from 1 again the messages are delivered.
+	if ready := receiveData(from, 7, udpEpoch, 1, []byte("first")); len(ready) != 1 {
+		t.Errorf("delivered %d messages after the reset, expected 1", len(ready))
+	}
+}
+
+func TestUDPReceiverBoundsBuffer(t *testing.T) {
+	other := listenUDP(t)
+	from := other.LocalAddr().(*net.UDPAddr)
+
+	if ready := receiveData(from, 7, 0, 1+MAX_BUFFERED, []byte("ahead")); len(ready) != 0 {
+		t.Errorf("delivered %d messages out of order", len(ready))
+	}
+	if ready := receiveData(from, 7, 0, MAX_BUFFERED, []byte("last")); len(ready) != 0 {
+		t.Errorf("delivered %d messages out of order", len(ready))
+	}
+
+	// Only the packet within the window is acknowledged and buffered.
+	if kind, _, _, seq := readPacket(t, other); kind != PACKET_ACK || seq != MAX_BUFFERED {
+		t.Errorf("answered with packet %d for %d, expected an acknowledgement for %d", kind, seq, MAX_BUFFERED)
+	}
+	udpMutex.Lock()
+	buffered := len(udpReceivers[from.String()].Buffered)
+	udpMutex.Unlock()
+	if buffered != 1 {
+		t.Errorf("buffered %d packets, expected 1", buffered)
+	}
+}
+
+func TestUDPSenderRenumbersAfterReset(t *testing.T) {
+	other := listenUDP(t)
+	from := other.LocalAddr().(*net.UDPAddr)
+
+	udpMutex.Lock()
+	udpSenders[from.String()] = &udpSender{
+		Addr:      from,
+		PeerEpoch: 50,
+		NextSeq:   9,
+		Unacked:   map[uint64][]byte{8: []byte("b"), 5: []byte("a")},
+	}
+	udpMutex.Unlock()
+
+	// Resets of another run of the current node or an earlier run of the
+	// receiver are ignored.
+	receiveReset(from, udpEpoch+1, 60)
+	receiveReset(from, udpEpoch, 40)
+	receiveReset(from, udpEpoch, 60)
+
+	udpMutex.Lock()
+	s := udpSenders[from.String()]
+	udpMutex.Unlock()
+	if s.PeerEpoch != 60 || s.NextSeq != 3 {
+		t.Errorf("session with run %d at %d, expected run 60 at 3", s.PeerEpoch, s.NextSeq)
+	}
+	if string(s.Unacked[1]) != "a" || string(s.Unacked[2]) != "b" {
+		t.Errorf("unacknowledged messages %q, expected a and b numbered 1 and 2", s.Unacked)
+	}
+}
+
+// readData reads the next data packet the node at the other end receives
+// and returns the message it carries.
+func readData(t *testing.T, conn *net.UDPConn) Message {
+	t.Helper()
+
+	buf := make([]byte, 65536)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("no packet received: %v", err)
+	}
+	if buf[0] != PACKET_DATA {
+		t.Fatalf("received packet %d, expected data", buf[0])
+	}
+
+	msg, err := readMessage(bytes.NewReader(buf[PACKET_HEADER:n]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestUnreliableUDPLosesMessagesWithoutHoldingBackMarkers(t *testing.T) {
+	other := listenUDP(t)
+	to := Peer{Host: "127.0.0.1", Port: strconv.Itoa(other.LocalAddr().(*net.UDPAddr).Port)}
+	resetChannels()
+
+	// The outboxes of earlier tests are done with the transport.
+	outboundMessages.Wait()
+	nodeTransport = udpTransport{}
+	t.Cleanup(func() {
+		outboundMessages.Wait()
+		nodeTransport = testNetwork
+	})
+
+	from := testMessage{Host: self.Host, Port: self.Port, Kind: "value"}
+	Send(to, from)
+	Send(to, control(MARKER, Header{Snapshot: "lost"}))
+	Send(to, from)
+
+	// The first message is lost, the marker and the message sent after it
+	// arrive and are handled at once.
+	readData(t, other)
+	ready := inOrder(readData(t, other))
+	ready = append(ready, inOrder(readData(t, other))...)
+	if len(ready) != 2 || ready[0].Header().Kind != MARKER {
+		t.Fatalf("handled %d messages, expected the marker and the message after it", len(ready))
+	}
+	for _, msg := range ready {
+		if msg.Header().Channel != nil {
+			t.Errorf("%s numbered %d on its channel, expected none", msg.Header().Kind, msg.Header().Channel.Seq)
+		}
+	}
+}
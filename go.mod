@@ -0,0 +1,3 @@
+module distributed-systems
+
+go 1.22
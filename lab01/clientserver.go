@@ -6,26 +6,61 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
-	"net"
 	"os"
 	"strconv"
 	"strings"
+
+	"distributed-systems/core"
 )
 
+// TEXT is the kind of the messages that carry a line typed on the console.
+const TEXT = "text"
+
+// message is a line of Text typed on the console of the sender. It carries
+// the ID, Host (IP) and Port of the sender, its kind as Message, the Lamport
+// Clock of the sender when it was sent, the ID of the Snapshot a marker
+// belongs to, the place of the message on its Channel and the Safra token of
+// the termination detection, which the core reads and writes.
+type message struct {
+	NodeId   int
+	Host     string
+	Port     string
+	Message  string
+	Text     string
+	Clock    int
+	Snapshot string
+	Channel  *core.ChannelSeq
+	Safra    *core.SafraToken
+}
+
 // address stores the IP address as well as nature of a node.
 // In addition to this, it also store the port, the ID of the node if it is
-// the listening address for a node and a flag that tells if a node if the
-// address is to be used for listening or sending messages to.
+// the listening address for a node, the path of its Unix socket and a flag
+// that tells if a node if the address is to be used for listening or sending
+// messages to.
 type address struct {
 	id         int
 	host       string
 	port       string
+	socket     string
 	willListen bool
 }
 
+// localState is the state of the current node recorded in a snapshot and
+// logged when it stops: the number of lines it Sent and Received.
+type localState struct {
+	Sent     int
+	Received int
+}
+
+var self address    // Address the current node listens on.
+var peers []address // Peer nodes the typed messages are sent to.
+var state localState
+
 func main() {
 	// Setup and parse CLI flags.
 	configFile := flag.String("config", "this is not a path", "Path to config file.")
+	core.RegisterFlags()
 	flag.Parse()
 
 	// Check if a config file has been passed as a flag.
@@ -48,10 +83,21 @@ func main() {
 	addresses := make([]address, 0)
 
 	for scanner.Scan() {
-		line := strings.Split(scanner.Text(), ":")
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		line := strings.Split(fields[0], ":")
 		addr := line[0]
 		port := line[1]
 
+		// The path of the Unix socket of the node may follow its address.
+		socket := ""
+		if len(fields) > 1 {
+			socket = fields[1]
+		}
+
 		// The first line of the config file has 3 ':' separated values, the IP,
 		// the port and the ID of the node. This address is the one that the
 		// node is configured to listen on for incoming messages.
@@ -60,22 +106,38 @@ func main() {
 		if len(line) == 3 {
 			log.Println("Will listen for messages on: " + addr + ":" + port)
 			id, _ := strconv.Atoi(line[2])
-			addresses = append(addresses, address{id, addr, port, true})
+			addresses = append(addresses, address{id, addr, port, socket, true})
 
 		} else if len(line) == 2 {
 			log.Println("Will broadcast messages to: " + addr + ":" + port)
-			addresses = append(addresses, address{-1, addr, port, false})
+			addresses = append(addresses, address{-1, addr, port, socket, false})
 		}
 	}
 
-	// Channel to receive input from the stdin.
-	ch := make(chan string)
+	// Since the first line of the file is the address at which the node will
+	// listen for incoming messages, it is indexed directly from the array
+	// here.
+	self = addresses[0]
+	corePeers := make([]core.Peer, 0)
+	for _, addrItem := range addresses {
+		// If this address is a peer node, then the messages are sent to it.
+		if !addrItem.willListen {
+			peers = append(peers, addrItem)
+			corePeers = append(corePeers, addrItem.peer())
+		}
+	}
+
+	// The core listens for messages over the transport given as flag and
+	// handles them on its event loop. It also stops the node on SIGINT,
+	// SIGTERM and the timeout.
+	core.Setup(clientServer(), self.peer(), corePeers)
+	core.Start()
 
-	// Non-blocking read from standard input. This goroutine checks for text
-	// text input from the stdin and passes it to the previously defined channel
-	// in case any input is provided by the user and then the return key is
-	// pressed.
-	go func(ch chan string) {
+	// This goroutine checks for text input from the stdin and forwards it to
+	// all the addresses that were initially registered as peers of the node,
+	// once the return key is pressed. If the input ends, the node stops with
+	// the exit code of a node that decided.
+	go func() {
 		fmt.Println("Type messages in the console and hit return to send.")
 		reader := bufio.NewReader(os.Stdin)
 
@@ -83,95 +145,51 @@ func main() {
 			// Read stdin till a new line is encountered.
 			s, err := reader.ReadString('\n')
 			if err != nil {
-				close(ch)
-				log.Fatal(err.Error())
+				if err.Error() != "EOF" {
+					log.Println(err.Error())
+				}
+				log.Println("Input ended, stopping.")
+				core.Stop(core.EXIT_DECIDED)
 				return
 			}
 
-			// The text input is passed to the channel after trimming spaces.
-			ch <- strings.TrimSpace(s)
-		}
-	}(ch)
-
-	// Instantiate TCP listener. Since the first line of the file is the address
-	// at which the node will listen for incoming messages, it is indexed
-	// directly from the array here.
-	l, err := net.Listen("tcp", addresses[0].host+":"+addresses[0].port)
-	if err != nil && err.Error() != "EOF" {
-		log.Fatal(err)
-	}
-	defer l.Close()
-
-	// This goroutine is checks for incoming connections to the previously
-	// defined listener. If a message is received, it logs it to the stdout
-	// alongwith information about the remote address it received the
-	// message from.
-	go func() {
-		for {
-			// Wait for a connection.
-			conn, err := l.Accept()
-			if err != nil {
-				log.Fatal(err)
+			// The text input is sent after trimming spaces. It is sent on
+			// the event loop and the loop is waited for, so that a line typed
+			// right before the input ends is still sent.
+			data := strings.TrimSpace(s)
+			if !core.Run(func() { broadcast(data) }) {
+				return
 			}
-
-			// This goroutine enables handling a new connection in a concurrent
-			// way.
-			go func(c net.Conn) {
-				// Read and parse data from the connection to a string till a
-				// newline is encountered.
-				netData, err := bufio.NewReader(c).ReadString('\n')
-				if err != nil {
-					log.Println(err.Error())
-				}
-
-				defer c.Close()
-
-				// Log received message to stdin.
-				log.Print("Message from " + c.RemoteAddr().String() + " > " + string(netData))
-			}(conn)
 		}
 	}()
 
-	// eventloop label is used to check for messages in the previously defined
-	// channel for stdin. If a message is received, all the addresses that were
-	// initially registered as peers of the node are dialled to with a TCP
-	// connection and the corresponding message from the channel is forwarded to
-	// them.
-	// If there is any issue with the channel, then the control exits from the
-	// loop and the program exits.
-eventloop:
-	for {
-		select {
-		case stdin, ok := <-ch:
-			if !ok {
-				break eventloop
-			} else {
-				data := stdin
-
-				for _, addrItem := range addresses {
-					// If this address is a peer node, then send the message.
-					if !addrItem.willListen {
-
-						// This goroutine dials to a given address (addr) of a
-						// peer node and send it the message from stdin (data).
-						go func(addr address, data string) {
-							conn, err := net.Dial("tcp", addr.host+":"+addr.port)
-							if err != nil {
-								log.Fatalf("Failed to dial: %v", err)
-							}
-
-							defer conn.Close()
-
-							log.Println("Sending `" + data + "` to " + addr.host + ":" + addr.port + ".")
-
-							// Data is sent to the peer node here as a byte stream.
-							if _, err := conn.Write([]byte(data + "\n")); err != nil {
-								log.Fatal(err)
-							}
-						}(addrItem, data)
-					}
-				}
-			}
-		}
+	core.WaitForShutdown()
+}
+
+// broadcast sends data to every peer node. It must be called on the event
+// loop.
+func broadcast(data string) {
+	for _, addr := range peers {
+		log.Println("Sending `" + data + "` to " + addr.host + ":" + addr.port + ".")
+		core.Send(addr.peer(), message{
+			NodeId:  self.id,
+			Host:    self.host,
+			Port:    self.port,
+			Message: TEXT,
+			Text:    data,
+		})
+		state.Sent++
 	}
 }
+
+// handleMessage logs a received message to the stdout along with the address
+// of the node it received the message from. It is called on the event loop.
+func handleMessage(msg message) {
+	state.Received++
+	log.Print("Message from " + msg.Host + ":" + msg.Port + " > " + msg.Text + "\n")
+}
+
+// currentState returns the local state of the current node.
+func currentState() localState {
+	return state
+}
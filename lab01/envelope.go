@@ -0,0 +1,64 @@
+package main
+
+import "distributed-systems/core"
+
+// PROTOCOL_VERSION is the version of the messages exchanged by the nodes. It
+// has to be raised whenever the fields of a message or their meaning change,
+// so that nodes of different versions reject each other's messages.
+const PROTOCOL_VERSION = 1
+
+// Kinds of the messages of the client/server.
+const (
+	TYPE_TEXT core.MessageType = core.TYPE_PROTOCOL + iota
+)
+
+// messageTypes maps the Message of a message to its kind.
+var messageTypes = map[string]core.MessageType{
+	TEXT: TYPE_TEXT,
+}
+
+// PROTOCOL is the name of the protocol the nodes run.
+const PROTOCOL = "clientserver"
+
+// clientServer describes the client/server to the core.
+func clientServer() core.Protocol[message] {
+	return core.Protocol[message]{
+		Name:    PROTOCOL,
+		Version: PROTOCOL_VERSION,
+		Types:   messageTypes,
+		Handle:  handleMessage,
+		State:   func() any { return currentState() },
+	}
+}
+
+// Header returns the fields of msg that every protocol shares.
+func (msg message) Header() core.Header {
+	return core.Header{
+		NodeId:   msg.NodeId,
+		Host:     msg.Host,
+		Port:     msg.Port,
+		Kind:     msg.Message,
+		Clock:    msg.Clock,
+		Snapshot: msg.Snapshot,
+		Channel:  msg.Channel,
+		Safra:    msg.Safra,
+	}
+}
+
+// WithHeader returns a copy of msg with the shared fields of h.
+func (msg message) WithHeader(h core.Header) core.Message {
+	msg.NodeId = h.NodeId
+	msg.Host = h.Host
+	msg.Port = h.Port
+	msg.Message = h.Kind
+	msg.Clock = h.Clock
+	msg.Snapshot = h.Snapshot
+	msg.Channel = h.Channel
+	msg.Safra = h.Safra
+	return msg
+}
+
+// peer returns addr as a peer of the core.
+func (addr address) peer() core.Peer {
+	return core.Peer{NodeId: addr.id, Host: addr.host, Port: addr.port, Socket: addr.socket}
+}
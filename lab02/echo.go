@@ -2,16 +2,13 @@ package main
 
 import (
 	"bufio"
-	"encoding/gob"
 	"flag"
 	"io/ioutil"
 	"log"
-	"net"
-	"os"
 	"strconv"
 	"strings"
-	"sync"
-	"time"
+
+	"distributed-systems/core"
 )
 
 // TERMINATE is a special message that is sent to terminate a child node.
@@ -21,36 +18,46 @@ const (
 
 // message is used to send payloads from one node to another.
 // messages carry ID of the sender node, Host (IP) of the sender, Port of the
-// sender and a string Message.
+// sender, a string Message, the Lamport Clock of the sender when the message
+// was sent, the ID of the Snapshot a marker belongs to, the place of the
+// message on its Channel and the Safra token of the termination detection.
 type message struct {
-	NodeId  int
-	Host    string
-	Port    string
-	Message string
+	NodeId   int
+	Host     string
+	Port     string
+	Message  string
+	Clock    int
+	Snapshot string
+	Channel  *core.ChannelSeq
+	Safra    *core.SafraToken
 }
 
 // node represents details pertaining to different nodes in the network graph.
 // NodeId is the ID of a node, Host is the IP address, Port is the port used,
-// IsInitiator indicates if a node is an initiator, HaveSent and HasReplied are
-// used to track whether nodes have sent and replied to messages, ParentMessage
-// is used to keep track of the parent of a node.
+// Socket is the path of its Unix socket, IsInitiator indicates if a node is an
+// initiator, HaveSent and HasReplied are used to track whether nodes have sent
+// and replied to messages, IsChild marks neighbours that replied with a pong,
+// ParentMessage is used to keep track of the parent of a node.
 type node struct {
 	NodeId        int
 	Host          string
 	Port          string
+	Socket        string
 	IsInitiator   bool
 	HaveSent      bool
 	HasReplied    bool
+	IsChild       bool
 	ParentMessage message
 }
 
-var neighbours []node    // Neighbours of the current node.
-var self node            // Current node (self)
-var selfMutex sync.Mutex // Mutex to manage access to member of self.
+var neighbours []node  // Neighbours of the current node.
+var self node          // Current node (self)
+var echoCompleted bool // All neighbours of the current node have replied.
 
 func main() {
 	// Setup and parse CLI flags.
 	configFile := flag.String("config", "this is not a path", "Path to config file.")
+	core.RegisterFlags()
 	flag.Parse()
 
 	// Check if a config file has been passed as a flag.
@@ -73,7 +80,12 @@ func main() {
 	addresses := make([]node, 0)
 
 	for scanner.Scan() {
-		line := strings.Split(scanner.Text(), ":")
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		line := strings.Split(fields[0], ":")
 		host := line[0]
 		port := line[1]
 
@@ -82,6 +94,11 @@ func main() {
 			Port: port,
 		}
 
+		// The path of the Unix socket of the node may follow its address.
+		if len(fields) > 1 {
+			addr.Socket = fields[1]
+		}
+
 		if len(line) == 4 || len(line) == 3 {
 			nodeId, _ := strconv.Atoi(line[2])
 			addr.NodeId = nodeId
@@ -102,175 +119,157 @@ func main() {
 		}
 	}
 
-	self = addresses[0]        // Populate current node.
-	neighbours = addresses[1:] // Populate neighbours.
-	hasInitiated := false      // Track if initiation message has been sent.
-
-	go listener() // Run goroutine to listen for messages.
-
-	// Main event loop.
-	if allNeighboursUp() {
-		// If all neighbours are up then proceed with main event loop.
-		for {
-			// Initiate communication from initiator node.
-			if self.IsInitiator && !hasInitiated {
-				// Send ping message to neighbours.
-				msg := message{
-					NodeId:  self.NodeId,
-					Host:    self.Host,
-					Port:    self.Port,
-					Message: "ping",
-				}
+	self = addresses[0]             // Populate current node.
+	neighbours = addresses[1:]      // Populate neighbours.
+	peers := peersOf(addresses[1:]) // Dialled while the event loop owns neighbours.
 
-				for idx, recvAddr := range neighbours {
-					sendMessage(recvAddr, msg)
-					neighbours[idx].HaveSent = true
-				}
-				hasInitiated = true
-			} else {
-				time.Sleep(1 * time.Second)
-
-				// Check if all neighbours have replied.
-				if allNeighboursReplied() {
-					if self.IsInitiator {
-						// Send message to terminate.
-						terminateNeighbours()
-					} else {
-						// Send pong message to parent.
-						parent := node{
-							Host: self.ParentMessage.Host,
-							Port: self.ParentMessage.Port,
-						}
-
-						msg := message{
-							NodeId:  self.NodeId,
-							Host:    self.Host,
-							Port:    self.Port,
-							Message: "pong",
-						}
-
-						sendMessage(parent, msg)
-					}
-				}
-			}
-		}
+	core.Setup(echo(), self.peer(), peers)   // Run the echo algorithm over the network.
+	defer core.WaitForShutdown()             // Let shutdown exit once the node stopped.
+	core.SetupDiffusion(terminateNeighbours) // Terminate once the echo is over.
+	core.Start()                             // Listen for messages and handle them on the event loop.
+
+	// Initiate communication from initiator node once all neighbours are up,
+	// the rest of the echo algorithm runs on the event loop.
+	if core.WaitForPeers(peers) && self.IsInitiator {
+		core.Run(startEcho)
 	}
 }
 
-// listener listens for incoming connections.
-func listener() {
-	l, _ := net.Listen("tcp", self.Host+":"+self.Port)
-	defer l.Close()
-
-	log.Printf("Listening on %s:%s\n", self.Host, self.Port)
-
-	for {
-		conn, _ := l.Accept()
-
-		decoder := gob.NewDecoder(conn)
-		var payloadData message
-		if err := decoder.Decode(&payloadData); err != nil {
-			// If there is an error, skip the message.
-			continue
+// startEcho starts the echo at the initiator as the root of a diffusing
+// computation by sending a ping to all neighbours.
+func startEcho() {
+	core.Diffuse(func() {
+		msg := message{
+			NodeId:  self.NodeId,
+			Host:    self.Host,
+			Port:    self.Port,
+			Message: "ping",
 		}
 
-		var id int
-		for nid, n := range neighbours {
-			if n.Port == payloadData.Port {
-				id = nid
-				break
-			}
+		core.WaveStarted()
+		for idx, recvAddr := range neighbours {
+			neighbours[idx].HaveSent = true
+			sendMessage(recvAddr, msg)
 		}
+	})
+}
 
-		// Invalid message.
-		if payloadData.NodeId == 0 {
-			continue
+// handleMessage handles a message of the echo algorithm on the event loop.
+// Snapshot markers and the signals of the termination detection never get
+// here, the core handles them.
+func handleMessage(msg message) {
+	var id int
+	for nid, n := range neighbours {
+		if n.Port == msg.Port {
+			id = nid
+			break
 		}
+	}
 
-		log.Printf("Received %s from node %d.\n", payloadData.Message, payloadData.NodeId)
+	log.Printf("Received %s from node %d.\n", msg.Message, msg.NodeId)
 
-		// Message to terminate received from parent.
-		if payloadData.Message == TERMINATE {
-			terminateNeighbours()
-		}
+	// Message to terminate received from parent.
+	if msg.Message == TERMINATE {
+		terminateNeighbours()
+		return
+	}
 
-		if self.IsInitiator {
-			if neighbours[id].HaveSent {
-				// Reply received from a node that was previously contacted.
-				neighbours[id].HasReplied = true
+	if self.IsInitiator {
+		if neighbours[id].HaveSent {
+			// Reply received from a node that was previously contacted.
+			neighbours[id].HasReplied = true
+		}
+	} else {
+		// If node has no parent. Make node that sent this message the
+		// parent.
+		if (message{} == self.ParentMessage) {
+			self.ParentMessage = msg
+			neighbours[id].HasReplied = true
+
+			log.Printf("Parent of node %d is node %d.\n", self.NodeId, msg.NodeId)
+			core.LogLocal(core.EVENT_STATE_CHANGE, "parent "+strconv.Itoa(msg.NodeId))
+			core.WaveStarted()
+
+			// // Send ping message to neighbours.
+			for idx, receivingNode := range neighbours {
+				if receivingNode.Port != self.ParentMessage.Port {
+					ping := message{
+						NodeId:  self.NodeId,
+						Host:    self.Host,
+						Port:    self.Port,
+						Message: "ping",
+					}
+					sendMessage(receivingNode, ping)
+				}
+				// Mark message as being sent to node.
+				neighbours[idx].HaveSent = true
 			}
 		} else {
-			// If node has no parent. Make node that sent this message the
-			// parent. Mutex used to restrict access to members of self struct.
-			selfMutex.Lock()
-			if (message{} == self.ParentMessage) {
-				self.ParentMessage = payloadData
+			if neighbours[id].HaveSent {
+				// Reply received from a node that was previously contacted.
 				neighbours[id].HasReplied = true
-
-				log.Printf("Parent of node %d is node %d.\n", self.NodeId, payloadData.NodeId)
-
-				// // Send ping message to neighbours.
-				for idx, receivingNode := range neighbours {
-					if receivingNode.Port != self.ParentMessage.Port {
-						msg := message{
-							self.NodeId,
-							self.Host,
-							self.Port,
-							"ping"}
-						sendMessage(receivingNode, msg)
-					}
-					// Mark message as being sent to node.
-					neighbours[idx].HaveSent = true
-				}
-			} else {
-				if neighbours[id].HaveSent {
-					// Reply received from a node that was previously contacted.
-					neighbours[id].HasReplied = true
-				}
 			}
-			selfMutex.Unlock()
 		}
 	}
+
+	// Only children reply with a pong, the other neighbours with a ping.
+	if msg.Message == "pong" {
+		neighbours[id].IsChild = true
+	}
+	checkEchoCompleted()
+
+	// The node is passive until the next message arrives.
+	core.TerminationIdle()
 }
 
-// terminateNeighbours send messages to non parent neighbours of node to
-// terminate.
-func terminateNeighbours() {
-	for _, n := range neighbours {
-		selfMutex.Lock()
-		if self.ParentMessage.Port != n.Port {
-			msg := message{
-				self.NodeId,
-				self.Host,
-				self.Port,
-				TERMINATE}
-			sendMessage(n, msg)
-		}
-		selfMutex.Unlock()
+// checkEchoCompleted checks if all neighbours have replied to the node, once.
+// The initiator then decides, the other nodes send a pong message to their
+// parent.
+func checkEchoCompleted() {
+	if echoCompleted || !allNeighboursReplied() {
+		return
+	}
+	echoCompleted = true
+	core.WaveCompleted()
+
+	if self.IsInitiator {
+		core.LogLocal(core.EVENT_DECIDE, "echo wave completed")
+		return
+	}
+
+	// Send pong message to parent.
+	parent := node{
+		Host: self.ParentMessage.Host,
+		Port: self.ParentMessage.Port,
+	}
+
+	msg := message{
+		NodeId:  self.NodeId,
+		Host:    self.Host,
+		Port:    self.Port,
+		Message: "pong",
 	}
 
-	os.Exit(0)
+	sendMessage(parent, msg)
 }
 
-// allNeighboursUp checks if all neighbours can be reached if not, it will
-// block till all neighbours are up.
-func allNeighboursUp() bool {
-	for _, addr := range neighbours {
-		for {
-			log.Printf("Trying to dial %s:%s\n", addr.Host, addr.Port)
-			conn, err := net.Dial("tcp", addr.Host+":"+addr.Port)
-
-			if err == nil {
-				conn.Close()
-				log.Printf("Successfully dialled %s:%s\n", addr.Host, addr.Port)
-				break
+// terminateNeighbours sends messages to the children of the node to terminate
+// and stops the node as decided. It is called once termination has been
+// detected, so no message of the echo algorithm is in flight any more.
+func terminateNeighbours() {
+	for _, n := range neighbours {
+		if n.IsChild {
+			msg := message{
+				NodeId:  self.NodeId,
+				Host:    self.Host,
+				Port:    self.Port,
+				Message: TERMINATE,
 			}
-
-			time.Sleep(1 * time.Second)
+			sendMessage(n, msg)
 		}
 	}
 
-	return true
+	core.Stop(core.EXIT_DECIDED)
 }
 
 // allNeighboursReplied checks if all neighbours have replied to a node.
@@ -285,22 +284,8 @@ func allNeighboursReplied() bool {
 	return allReplied
 }
 
-// sendMessage sends msg of type message to node recvAddr. Retries sending
-// indefinitely.
+// sendMessage sends msg of type message to node recvAddr, subject to the
+// injected faults. Retries sending until it is delivered.
 func sendMessage(recvAddr node, msg message) {
-	log.Printf("Sending %s to %s:%s.\n", msg.Message, recvAddr.Host, recvAddr.Port)
-	for {
-		conn, err := net.Dial("tcp", recvAddr.Host+":"+recvAddr.Port)
-
-		if err == nil && msg.NodeId != 0 {
-			encoder := gob.NewEncoder(conn)
-			if err := encoder.Encode(msg); err != nil {
-				log.Fatal(err)
-			}
-
-			conn.Close()
-			break
-		}
-	}
-	log.Println("Sent " + msg.Message + " to " + recvAddr.Host + ":" + recvAddr.Port + ".")
+	core.Send(recvAddr.peer(), msg)
 }
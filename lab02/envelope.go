@@ -0,0 +1,80 @@
+package main
+
+import "distributed-systems/core"
+
+// PROTOCOL_VERSION is the version of the messages exchanged by the nodes. It
+// has to be raised whenever the fields of a message or their meaning change,
+// so that nodes of different versions reject each other's messages.
+const PROTOCOL_VERSION = 4
+
+// Kinds of the messages of the echo algorithm.
+const (
+	TYPE_PING core.MessageType = core.TYPE_PROTOCOL + iota
+	TYPE_PONG
+	TYPE_TERMINATE
+)
+
+// messageTypes maps the Message of a message to its kind.
+var messageTypes = map[string]core.MessageType{
+	"ping":    TYPE_PING,
+	"pong":    TYPE_PONG,
+	TERMINATE: TYPE_TERMINATE,
+}
+
+// PROTOCOL is the name of the algorithm the nodes run.
+const PROTOCOL = "echo"
+
+// echo describes the echo algorithm to the core. TERMINATE is not part of the
+// diffusing computation whose termination is detected.
+func echo() core.Protocol[message] {
+	return core.Protocol[message]{
+		Name:    PROTOCOL,
+		Version: PROTOCOL_VERSION,
+		Types:   messageTypes,
+		Control: []string{TERMINATE},
+		Handle:  handleMessage,
+		State:   func() any { return currentState() },
+	}
+}
+
+// Header returns the fields of msg that every protocol shares.
+func (msg message) Header() core.Header {
+	return core.Header{
+		NodeId:   msg.NodeId,
+		Host:     msg.Host,
+		Port:     msg.Port,
+		Kind:     msg.Message,
+		Clock:    msg.Clock,
+		Snapshot: msg.Snapshot,
+		Channel:  msg.Channel,
+		Safra:    msg.Safra,
+	}
+}
+
+// WithHeader returns a copy of msg with the shared fields of h.
+func (msg message) WithHeader(h core.Header) core.Message {
+	msg.NodeId = h.NodeId
+	msg.Host = h.Host
+	msg.Port = h.Port
+	msg.Message = h.Kind
+	msg.Clock = h.Clock
+	msg.Snapshot = h.Snapshot
+	msg.Channel = h.Channel
+	msg.Safra = h.Safra
+	return msg
+}
+
+// peer returns node n as a peer of the core.
+func (n node) peer() core.Peer {
+	return core.Peer{NodeId: n.NodeId, Host: n.Host, Port: n.Port, Socket: n.Socket}
+}
+
+// peersOf returns nodes as peers of the core.
+func peersOf(nodes []node) []core.Peer {
+	out := make([]core.Peer, 0, len(nodes))
+	for _, n := range nodes {
+		out = append(out, n.peer())
+	}
+
+	return out
+}
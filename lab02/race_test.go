@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"distributed-systems/clustertest"
+	"distributed-systems/core"
+)
+
+// TestEchoIsRaceFree runs the echo algorithm with the first node as initiator
+// on a ring and on a fully connected network of clustertest.NODES
+// nodes built with the race detector, while their metrics are scraped.
+func TestEchoIsRaceFree(t *testing.T) {
+	c := clustertest.New(t, "echo")
+
+	// initiator returns the config line of node n, the first node initiates.
+	initiator := func(n int) string {
+		if n == 1 {
+			return c.Address(n, fmt.Sprintf(":%d:*", n*10))
+		}
+		return c.Address(n, fmt.Sprintf(":%d", n*10))
+	}
+	ring := c.Network(t, "ring", func(n int) []string {
+		next := n%clustertest.NODES + 1
+		prev := (n+clustertest.NODES-2)%clustertest.NODES + 1
+		return []string{initiator(n), c.Address(next, ""), c.Address(prev, "")}
+	})
+	mesh := c.Network(t, "mesh", func(n int) []string {
+		lines := []string{initiator(n)}
+		for m := 1; m <= clustertest.NODES; m++ {
+			if m != n {
+				lines = append(lines, c.Address(m, ""))
+			}
+		}
+		return lines
+	})
+
+	metrics := clustertest.FreeAddrs(t, clustertest.NODES)
+	requests := clustertest.MetricsRequests(metrics)
+	nodeArgs := func(n int) []string {
+		return []string{"-metrics", metrics[n-1]}
+	}
+
+	t.Run("ring", func(t *testing.T) {
+		c.Run(t, ring, core.EXIT_DECIDED, nodeArgs, requests)
+	})
+	t.Run("mesh", func(t *testing.T) {
+		c.Run(t, mesh, core.EXIT_DECIDED, nodeArgs, requests)
+	})
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+
+	"distributed-systems/core"
+)
+
+// Messages used to announce the leader and confirm the agreement on it.
+const (
+	LEADER = "leader"
+	ACK    = "ack"
+)
+
+// member is an entry of the membership list collected by the acknowledgements
+// of a leader announcement. Agree is false if the node disagreed with the
+// announced leader, Reason then says why.
+type member struct {
+	NodeId int
+	Host   string
+	Port   string
+	Leader int
+	Agree  bool
+	Reason string
+}
+
+var secret string       // Shared secret used to sign leader announcements.
+var term = 1            // Term of the election.
+var announced message   // Leader announcement accepted by the current node.
+var members []member    // Membership list collected from the subtree.
+var disagreement string // Why the current node disagrees with the leader.
+
+// signLeader returns the signature of the announcement of leader in term by
+// the initiator of the completed wave.
+func signLeader(leader int, term int, initiator int) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d|%d|%d", leader, term, initiator)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// announceLeader is called by the initiator of the completed wave. It
+// broadcasts a signed announcement of the decided leader down the spanning
+// tree of the wave and waits for every node to acknowledge it. It must be
+// called on the event loop.
+func announceLeader() {
+	msg := message{
+		NodeId:    self.NodeId,
+		Host:      self.Host,
+		Port:      self.Port,
+		Message:   LEADER,
+		Leader:    self.Leader,
+		Initiator: waveTag,
+		Term:      term,
+		Signature: signLeader(self.Leader, term, waveTag),
+	}
+
+	log.Printf("Announcing leader %d in term %d.\n", self.Leader, term)
+	acceptLeader(msg)
+}
+
+// acceptLeader checks the leader announcement msg against the view of the
+// current node, records any disagreement and sends the announcement on to the
+// children of the node. It must be called on the event loop.
+func acceptLeader(msg message) {
+	announced = msg
+	members = []member{}
+	disagreement = ""
+
+	switch {
+	case !hmac.Equal([]byte(msg.Signature), []byte(signLeader(msg.Leader, msg.Term, msg.Initiator))):
+		disagreement = "invalid signature on leader announcement"
+	case msg.Term != term:
+		disagreement = fmt.Sprintf("announcement is for term %d, expected term %d", msg.Term, term)
+	case msg.Leader < self.Leader:
+		disagreement = fmt.Sprintf("announced leader %d, but node %d is known", msg.Leader, self.Leader)
+	default:
+		self.Leader = msg.Leader
+		leaderGauge(self.Leader)
+		if persistent {
+			followLeader(msg.Leader, msg.Term)
+		}
+	}
+
+	if disagreement != "" {
+		log.Printf("ERROR: Disagreeing with leader %d: %s.\n", msg.Leader, disagreement)
+	}
+
+	// Send the announcement on as it was signed.
+	forward := msg
+	forward.NodeId = self.NodeId
+	forward.Host = self.Host
+	forward.Port = self.Port
+
+	// Children that failed count as acknowledged.
+	for idx, n := range neighbours {
+		neighbours[idx].HasAcked = !isUp(n)
+		if n.IsChild && isUp(n) {
+			sendMessage(n, forward)
+		}
+	}
+
+	checkAcknowledged()
+}
+
+// handleAck records the acknowledgement of the child at index id along with
+// the membership list of its subtree. It must be called on the event loop.
+func handleAck(msg message, id int) {
+	if compareWave(msg) != 0 || !neighbours[id].IsChild {
+		return
+	}
+
+	neighbours[id].HasAcked = true
+	members = append(members, msg.Members...)
+
+	checkAcknowledged()
+}
+
+// checkAcknowledged acknowledges the announcement to the parent once all
+// children acknowledged it. The initiator of the wave instead prints the
+// confirmed membership list and starts detecting the termination of the
+// election, to terminate the network. It must be called on the event loop.
+func checkAcknowledged() {
+	for _, n := range neighbours {
+		if n.IsChild && !n.HasAcked {
+			return
+		}
+	}
+
+	members = append(members, member{
+		NodeId: self.NodeId,
+		Host:   self.Host,
+		Port:   self.Port,
+		Leader: self.Leader,
+		Agree:  disagreement == "",
+		Reason: disagreement,
+	})
+
+	if waveTag == self.NodeId {
+		confirmMembership()
+		if !persistent {
+			core.StartSafra()
+		}
+		return
+	}
+
+	parent := node{
+		Host: self.ParentMessage.Host,
+		Port: self.ParentMessage.Port,
+	}
+
+	msg := message{
+		NodeId:    self.NodeId,
+		Host:      self.Host,
+		Port:      self.Port,
+		Message:   ACK,
+		Leader:    self.Leader,
+		Initiator: waveTag,
+		Term:      term,
+		Members:   members,
+	}
+
+	sendMessage(parent, msg)
+}
+
+// confirmMembership prints the membership list confirmed by the
+// acknowledgements and records a disagreement if any node disagreed.
+func confirmMembership() {
+	sort.Slice(members, func(i, j int) bool { return members[i].NodeId < members[j].NodeId })
+
+	log.Printf("Leader %d in term %d acknowledged by %d nodes:\n", announced.Leader, term, len(members))
+
+	w := tabwriter.NewWriter(os.Stderr, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NODE\tADDRESS\tLEADER\tAGREES")
+	for _, m := range members {
+		agrees := "yes"
+		if !m.Agree {
+			agrees = "no: " + m.Reason
+		}
+		fmt.Fprintf(w, "%d\t%s:%s\t%d\t%s\n", m.NodeId, m.Host, m.Port, m.Leader, agrees)
+	}
+	w.Flush()
+
+	for _, m := range members {
+		if !m.Agree && disagreement == "" {
+			disagreement = "node " + strconv.Itoa(m.NodeId) + " disagrees with the leader"
+		}
+	}
+
+	if disagreement != "" {
+		log.Printf("ERROR: Leader %d is not confirmed: %s.\n", announced.Leader, disagreement)
+	} else {
+		log.Printf("Leader %d confirmed by all nodes.\n", announced.Leader)
+		leaderMembers = members
+	}
+}
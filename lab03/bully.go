@@ -0,0 +1,246 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"time"
+
+	"distributed-systems/core"
+)
+
+// Messages used by the Bully algorithm.
+const (
+	ELECTION    = "election"
+	ANSWER      = "answer"
+	COORDINATOR = "coordinator"
+)
+
+var bullyElecting bool         // An election of the current node is in progress.
+var bullyAnswered bool         // A higher node answered the current election.
+var bullyRound int             // Number of the current election, to match its timeouts and the stop of the node.
+var bullyDecided bool          // A coordinator has been decided on.
+var coordinatorHeard time.Time // Last time the coordinator was heard of.
+
+// runBully runs the Bully algorithm. It needs every other node to be listed
+// with its ID in the config file. Every node starts an election when it comes
+// up, so a higher node that comes back takes over from a lower coordinator.
+// With -persistent the coordinator sends a heartbeat to all other nodes every
+// heartbeat interval and a node that does not hear from it for longer than
+// the suspect timeout starts an election, otherwise the nodes terminate once
+// the coordinator has been decided.
+func runBully() {
+	for _, n := range neighbours {
+		if n.NodeId == 0 {
+			panic("Bully election needs the ID of every node in the config file.")
+		}
+	}
+
+	log.Println("Running Bully election.")
+
+	startBullyElection()
+	if persistent {
+		core.Every(heartbeatInterval, watchCoordinator)
+	}
+}
+
+// watchCoordinator makes the coordinator send a heartbeat to all other nodes
+// and the other nodes start an election once the coordinator stayed silent
+// for longer than the suspect timeout.
+func watchCoordinator() {
+	if bullyDecided && self.Leader == self.NodeId {
+		for _, n := range neighbours {
+			msg := message{
+				NodeId:  self.NodeId,
+				Host:    self.Host,
+				Port:    self.Port,
+				Message: HEARTBEAT,
+				Leader:  self.NodeId,
+			}
+			sendMessageOnce(n, msg)
+		}
+	} else if bullyDecided && time.Since(coordinatorHeard) > suspectTimeout {
+		log.Printf("Coordinator %d failed.\n", self.Leader)
+		startBullyElection()
+	}
+}
+
+// startBullyElection sends an election message to every node with a higher ID
+// and waits for their answers. The current node becomes the coordinator if
+// there is no higher node or none answers within the suspect timeout. It must
+// be called on the event loop.
+func startBullyElection() {
+	bullyRound++
+	bullyElecting = true
+	bullyAnswered = false
+	bullyDecided = false
+
+	log.Printf("Starting election %d.\n", bullyRound)
+	core.LogLocal(core.EVENT_STATE_CHANGE, "election "+strconv.Itoa(bullyRound))
+	core.WaveStarted()
+
+	higher := 0
+	for _, n := range neighbours {
+		if n.NodeId > self.NodeId {
+			msg := message{
+				NodeId:  self.NodeId,
+				Host:    self.Host,
+				Port:    self.Port,
+				Message: ELECTION,
+			}
+			sendMessageOnce(n, msg)
+			higher++
+		}
+	}
+
+	if higher == 0 {
+		becomeCoordinator()
+		return
+	}
+
+	round := bullyRound
+	core.After(suspectTimeout, func() { bullyTimeout(round) })
+}
+
+// bullyTimeout handles the timeout of election round. Without an answer the
+// current node becomes the coordinator, with an answer but no coordinator
+// message the election is started again.
+func bullyTimeout(round int) {
+	if round != bullyRound || !bullyElecting {
+		return
+	}
+
+	if !bullyAnswered {
+		log.Println("No higher node answered.")
+		becomeCoordinator()
+		return
+	}
+
+	log.Println("No coordinator announced after an answer.")
+	startBullyElection()
+}
+
+// handleBullyMessage handles a message of the Bully algorithm on the event
+// loop.
+func handleBullyMessage(msg message) {
+	switch msg.Message {
+	case ELECTION:
+		// Bully the lower node and take over its election. A coordinator
+		// only has to tell the lower node that it is still there.
+		sender := node{Host: msg.Host, Port: msg.Port}
+		sendMessageOnce(sender, message{
+			NodeId:  self.NodeId,
+			Host:    self.Host,
+			Port:    self.Port,
+			Message: ANSWER,
+		})
+
+		if bullyDecided && self.Leader == self.NodeId {
+			sendMessageOnce(sender, message{
+				NodeId:  self.NodeId,
+				Host:    self.Host,
+				Port:    self.Port,
+				Message: COORDINATOR,
+				Leader:  self.NodeId,
+			})
+		} else if !bullyElecting {
+			startBullyElection()
+		}
+	case ANSWER:
+		if !bullyElecting || bullyAnswered {
+			return
+		}
+
+		// Wait for the coordinator message of the higher node.
+		bullyAnswered = true
+		bullyRound++
+		round := bullyRound
+		core.After(suspectTimeout, func() { bullyTimeout(round) })
+	case COORDINATOR, HEARTBEAT:
+		if msg.NodeId < self.NodeId {
+			// A lower coordinator, for example while the current node was
+			// down, is replaced.
+			if !bullyElecting {
+				log.Printf("Rejecting lower coordinator %d.\n", msg.NodeId)
+				startBullyElection()
+			}
+			return
+		}
+
+		coordinatorHeard = time.Now()
+		if !bullyDecided || self.Leader != msg.NodeId {
+			acceptCoordinator(msg.NodeId)
+		}
+	}
+}
+
+// becomeCoordinator makes the current node the coordinator and announces it to
+// all other nodes. It must be called on the event loop.
+func becomeCoordinator() {
+	log.Println("Becoming coordinator.")
+
+	for _, n := range neighbours {
+		msg := message{
+			NodeId:  self.NodeId,
+			Host:    self.Host,
+			Port:    self.Port,
+			Message: COORDINATOR,
+			Leader:  self.NodeId,
+		}
+		sendMessageOnce(n, msg)
+	}
+
+	acceptCoordinator(self.NodeId)
+}
+
+// acceptCoordinator records coordinator as the leader. Unless the nodes keep
+// running it terminates the current node. It must be called on the event
+// loop.
+func acceptCoordinator(coordinator int) {
+	bullyRound++
+	bullyElecting = false
+	bullyDecided = true
+	coordinatorHeard = time.Now()
+
+	self.Leader = coordinator
+	leaderGauge(self.Leader)
+	core.WaveCompleted()
+	log.Printf("Coordinator is node %d.\n", coordinator)
+	core.LogLocal(core.EVENT_DECIDE, "leader "+strconv.Itoa(coordinator))
+
+	if !persistent {
+		terminateBully()
+	}
+}
+
+// terminateBully terminates the current node once the messages of the
+// election it may still have to answer are over: a second longer than the
+// suspect timeout, 3 seconds by default. It keeps answering while it waits, so
+// that lower nodes still electing learn about the coordinator. It must be
+// called on the event loop.
+//
+// The Bully election does not detect its termination with Safra's algorithm
+// like the other elections. It is built to survive crashed nodes: its
+// messages are sent once and given up after the suspect timeout, so a message
+// to a node that is down is counted as sent but never as received, and the
+// token could not visit that node either. Its timeouts also make a node start
+// an election without receiving a message, while Safra's algorithm assumes a
+// passive node only becomes active on a message. The nodes instead wait out
+// the suspect timeout, after which no lower node still waits for an answer of
+// the current node. An election started in the meantime cancels the stop, the
+// coordinator it decides on schedules its own.
+func terminateBully() {
+	wait := suspectTimeout + time.Second
+	log.Printf("Sleeping for %v before terminating.\n", wait)
+
+	round := bullyRound
+	core.After(wait, func() {
+		if round != bullyRound {
+			log.Println("Not terminating, another election started in the meantime.")
+			return
+		}
+
+		log.Println("Leader is:", self.Leader)
+		log.Println(core.Report())
+		core.Stop(core.EXIT_DECIDED)
+	})
+}
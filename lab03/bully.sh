@@ -0,0 +1,70 @@
+#! /bin/bash
+
+# Usage: ./bully.sh
+#
+# Runs the persistent Bully election on the 5 fully connected nodes of the
+# config/bully directory, kills the coordinator, checks that the next highest
+# node takes over, restarts the old coordinator and checks that it bullies its
+# way back.
+
+set -u
+
+WAIT=${WAIT:-8}
+DIR=$(mktemp -d)
+PIDS=()
+
+cleanup() {
+    kill $(jobs -p) 2>/dev/null
+    wait 2>/dev/null
+}
+trap cleanup EXIT
+
+# leaders prints the leader of every node given by the last digit of its port.
+leaders() {
+    for n in "$@"; do
+        curl -s http://127.0.0.1:910$n/metrics | awk '/^node_leader / { print $2 }'
+    done
+}
+
+# expect checks that the nodes given after the leader all agree on it.
+expect() {
+    local want=$1
+    local step=$2
+    shift 2
+
+    for got in $(leaders "$@"); do
+        if [ "$got" != "$want" ]; then
+            echo "FAIL: $step, nodes $* should have leader $want, got: $(leaders "$@" | tr '\n' ' ')"
+            exit 1
+        fi
+    done
+    echo "OK: $step, nodes $* have leader $want."
+}
+
+# start starts the node given by the last digit of its port.
+start() {
+    $DIR/election -config config/bully/configFile_600$1.txt -algorithm bully \
+        -persistent -metrics 127.0.0.1:910$1 >> $DIR/node_600$1.log 2>&1 &
+    PIDS[$1]=$!
+}
+
+go build -o $DIR/election *.go || exit 1
+
+for n in 1 2 3 4 5; do
+    start $n
+done
+
+echo "Logs are in $DIR."
+
+sleep $WAIT
+expect 50 "before the failure" 1 2 3 4 5
+
+kill ${PIDS[5]}
+sleep $WAIT
+expect 40 "after the coordinator failed" 1 2 3 4
+
+start 5
+sleep $WAIT
+expect 50 "after the old coordinator restarted" 1 2 3 4 5
+
+echo "PASS"
@@ -0,0 +1,28 @@
+#! /bin/bash
+
+# Usage: ./compare.sh [config_dir]
+#
+# Runs every election algorithm that fits the network of config_dir (the
+# config/ring directory by default) on its 5 nodes and prints the total number
+# of messages sent by each, as reported by the nodes before terminating.
+
+set -u
+
+CONFIG=${1:-config/ring}
+DIR=$(mktemp -d)
+
+go build -o $DIR/election *.go || exit 1
+
+echo "Logs are in $DIR."
+
+for algorithm in extinction chang-roberts hirschberg-sinclair; do
+    for n in 1 2 3 4 5; do
+        timeout 60 $DIR/election -config $CONFIG/configFile_600$n.txt -algorithm $algorithm \
+            > $DIR/${algorithm}_600$n.log 2>&1 &
+    done
+    wait
+
+    total=$(cat $DIR/${algorithm}_600*.log | awk '/messages sent/ { sum += $3 } END { print sum + 0 }')
+    leaders=$(cat $DIR/${algorithm}_600*.log | awk '/Leader is:/ { print $5 }' | sort -u | tr '\n' ' ')
+    printf "%-20s %5d messages, leader %s\n" $algorithm $total "$leaders"
+done
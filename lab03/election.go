@@ -2,16 +2,14 @@ package main
 
 import (
 	"bufio"
-	"encoding/gob"
 	"flag"
 	"io/ioutil"
 	"log"
-	"net"
-	"os"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
+
+	"distributed-systems/core"
 )
 
 // TERMINATE is a special message that is sent to terminate a child node.
@@ -21,41 +19,97 @@ const (
 
 // message is used to send payloads from one node to another.
 // messages carry ID of the sender node, Host (IP) of the sender, Port of the
-// sender and a string Message.
+// sender, a string Message, the Leader known to the sender, the Lamport Clock
+// of the sender when the message was sent, the ID of the Snapshot a marker
+// belongs to, the place of the message on its Channel, the Epoch and Initiator
+// of an election wave, the Term, Signature and Members of a leader
+// announcement and its acknowledgements, the Beat number of the heartbeats of
+// the leader along with the Acks of the heartbeats by node ID, the Phase and
+// Hop count of a probe of the ring election, the fields of a Raft or Paxos
+// message and the Safra token of the termination detection.
 type message struct {
-	NodeId  int
-	Host    string
-	Port    string
-	Message string
-	Leader  int
+	NodeId    int
+	Host      string
+	Port      string
+	Message   string
+	Leader    int
+	Clock     int
+	Snapshot  string
+	Channel   *core.ChannelSeq
+	Epoch     int
+	Initiator int
+	Term      int
+	Signature string
+	Members   []member
+	Beat      int
+	Acks      map[int]int
+	Phase     int
+	Hop       int
+	Raft      *raftMessage
+	Paxos     *paxosMessage
+	Safra     *core.SafraToken
 }
 
 // node represents details pertaining to different nodes in the network graph.
 // NodeId is the ID of a node, Host is the IP address, Port is the port used,
-// IsInitiator indicates if a node is an initiator, HaveSent and HasReplied are
-// used to track whether nodes have sent and replied to messages, ParentMessage
-// is used to keep track of the parent of a node.
+// Socket is the path of its Unix socket, IsInitiator indicates if a node is an
+// initiator, HaveSent and HasReplied are used to track whether nodes have sent
+// and replied to messages of the current wave, IsChild marks neighbours that
+// are children of the current node in the current wave, HasAcked tracks whether
+// a child acknowledged the leader announcement, ParentMessage is used to keep
+// track of the parent of a node in the current wave.
 type node struct {
 	NodeId        int
 	Host          string
 	Port          string
+	Socket        string
 	IsInitiator   bool
 	HaveSent      bool
 	HasReplied    bool
+	IsChild       bool
+	HasAcked      bool
 	Leader        int
 	ParentMessage message
 }
 
-var neighbours []node    // Neighbours of the current node.
-var self node            // Current node (self)
-var selfMutex sync.Mutex // Mutex to manage access to member of self.
-var hasInitiated bool    // Track if initiation message has been sent.
+var neighbours []node // Neighbours of the current node.
+var self node         // Current node (self)
+var waveTag int       // ID of the initiator of the wave the node takes part in.
+var waveMax int       // Highest node ID seen in the current wave.
+var waveDone bool     // Track if the current wave has completed at this node.
+var algorithm string  // Election algorithm to run.
 
 func main() {
 	// Setup and parse CLI flags.
 	configFile := flag.String("config", "this is not a path", "Path to config file.")
+	flag.StringVar(&algorithm, "algorithm", "extinction", "Election algorithm to run: extinction, bully, chang-roberts, hirschberg-sinclair, raft or paxos.")
+	raftDir := flag.String("raft-dir", ".", "Directory to persist the Raft state in.")
+	kvAddr := flag.String("kv", "", "Address to serve the Raft key/value store on, e.g. 127.0.0.1:9301.")
+	flag.StringVar(&paxosMode, "paxos-mode", "multi", "Paxos variant to run: single or multi.")
+	paxosDir := flag.String("paxos-dir", ".", "Directory to persist the Paxos acceptor state in.")
+	roles := flag.String("roles", "", "Path to the file with the Paxos roles of the nodes.")
+	paxosAddr := flag.String("paxos", "", "Address to serve Paxos proposals on, e.g. 127.0.0.1:9401.")
+	core.RegisterFlags()
+	flag.StringVar(&secret, "secret", "election", "Shared secret used to sign leader announcements.")
+	flag.BoolVar(&partitionAware, "partition-aware", false, "Keep running and elect a leader per connected component.")
+	flag.BoolVar(&persistent, "persistent", false, "Keep the leader running and re-elect it when it fails.")
+	flag.DurationVar(&heartbeatInterval, "heartbeat", 500*time.Millisecond, "Interval between heartbeats.")
+	flag.Float64Var(&maxDrift, "max-drift", 0.01, "Bound on the clock drift rate between nodes used for leader leases.")
+	leaseAddr := flag.String("lease", "", "Address to serve the leader lease on, e.g. 127.0.0.1:9201 or unix:/tmp/lease.sock.")
+	flag.DurationVar(&suspectTimeout, "suspect-timeout", 2*time.Second, "Silence after which a neighbour or the leader is considered failed.")
 	flag.Parse()
 
+	// Check if a known algorithm has been passed as a flag.
+	switch algorithm {
+	case "extinction", "bully", "chang-roberts", "hirschberg-sinclair", "raft":
+	case "paxos":
+		// The stable leader of Multi-Paxos is the leader of the persistent
+		// leader service.
+		persistent = true
+	default:
+		panic("Invalid algorithm, please pass extinction, bully, chang-roberts, hirschberg-sinclair, raft or paxos.")
+	}
+
 	// Check if a config file has been passed as a flag.
 	if *configFile == "this is not a path" {
 		panic("Invalid config file, please pass a valid config file.")
@@ -76,7 +130,12 @@ func main() {
 	addresses := make([]node, 0)
 
 	for scanner.Scan() {
-		line := strings.Split(scanner.Text(), ":")
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		line := strings.Split(fields[0], ":")
 		host := line[0]
 		port := line[1]
 
@@ -85,6 +144,11 @@ func main() {
 			Port: port,
 		}
 
+		// The path of the Unix socket of the node may follow its address.
+		if len(fields) > 1 {
+			addr.Socket = fields[1]
+		}
+
 		if len(line) == 4 || len(line) == 3 {
 			nodeId, _ := strconv.Atoi(line[2])
 			addr.NodeId = nodeId
@@ -105,222 +169,381 @@ func main() {
 		}
 	}
 
-	self = addresses[0]        // Populate current node.
-	self.Leader = self.NodeId  // Initialize current node to leader.
-	neighbours = addresses[1:] // Populate neighbours.
-	hasInitiated := false
+	self = addresses[0]             // Populate current node.
+	self.Leader = self.NodeId       // Initialize current node to leader.
+	neighbours = addresses[1:]      // Populate neighbours.
+	peers := peersOf(addresses[1:]) // Dialled while the event loop owns neighbours.
 
 	// Current leader for each node is set to the ID of self.
 	log.Println("Current leader is", self.Leader)
+	leaderGauge(self.Leader)
+	termGauge(term)
+
+	core.Setup(election(), self.peer(), peers) // Run the election over the network.
+	defer core.WaitForShutdown()               // Let shutdown exit once the node stopped.
+	core.LogLocal(core.EVENT_STATE_CHANGE, "leader "+strconv.Itoa(self.Leader))
+
+	serveLease(*leaseAddr)                    // Serve the leader lease if requested.
+	setupService()                            // Run the leader service if requested.
+	setupRaft(*raftDir, *kvAddr)              // Load the Raft state if requested.
+	setupPaxos(*paxosDir, *roles, *paxosAddr) // Load the Paxos state if requested.
+	setupTermination()                        // Detect the end of the election.
+	core.Start()                              // Listen for messages and handle them on the event loop.
+
+	if partitionAware {
+		core.Run(runPartitionAware)
+		return
+	}
 
-	go listener() // Run goroutine to listen for messages.
-
-	// Main event loop.
-	if allNeighboursUp() {
-		// If all neighbours are up then proceed with main event loop.
-		for {
-			// Initiate communication from initiator node.
-			if self.IsInitiator && !hasInitiated {
-				// Send ping message to neighbours.
-				msg := message{
-					NodeId:  self.NodeId,
-					Host:    self.Host,
-					Port:    self.Port,
-					Message: "ping",
-					Leader:  self.NodeId,
-				}
-
-				for idx, recvAddr := range neighbours {
-					sendMessage(recvAddr, msg)
-					neighbours[idx].HaveSent = true
-				}
-				hasInitiated = true
-			} else {
-				time.Sleep(1 * time.Second)
-
-				// Check if all neighbours have replied.
-				if allNeighboursReplied() {
-					if self.IsInitiator {
-						// Send message to terminate.
-						terminateNeighbours()
-					} else {
-						// Send pong message to parent.
-						parent := node{
-							Host: self.ParentMessage.Host,
-							Port: self.ParentMessage.Port,
-						}
-
-						msg := message{
-							NodeId:  self.NodeId,
-							Host:    self.Host,
-							Port:    self.Port,
-							Message: "pong",
-							Leader:  self.Leader,
-						}
-
-						sendMessage(parent, msg)
-					}
-				}
-			}
-		}
+	// Raft copes with nodes that are down, so it does not wait for all
+	// neighbours to be up.
+	if algorithm == "raft" {
+		core.Run(runRaft)
+		return
+	}
+
+	// The persistent Bully election copes with nodes that are down, so it
+	// does not wait for all neighbours to be up.
+	if algorithm == "bully" && persistent {
+		core.Run(runBully)
+		return
+	}
+
+	if !core.WaitForPeers(peers) {
+		return
+	}
+
+	switch algorithm {
+	case "bully":
+		core.Run(runBully)
+		return
+	case "chang-roberts", "hirschberg-sinclair":
+		core.Run(runRing)
+		return
+	}
+
+	// If all neighbours are up then initiators start a wave tagged with their
+	// own ID. The rest of the election is driven by the messages handled on
+	// the event loop, which terminates the node once the leader has been
+	// decided. The persistent leader service keeps running instead.
+	if persistent {
+		core.Run(runService)
+	}
+
+	if self.IsInitiator {
+		core.Run(initiateWave)
 	}
 }
 
-// listener listens for incoming connections.
-func listener() {
-	l, _ := net.Listen("tcp", self.Host+":"+self.Port)
-	defer l.Close()
+// handleMessage handles a message of the election on the event loop. Snapshot
+// markers and the signals of the termination detection never get here, the
+// core handles them.
+func handleMessage(msg message) {
+	var id int
+	for nid, n := range neighbours {
+		if n.Port == msg.Port {
+			id = nid
+			break
+		}
+	}
 
-	log.Printf("Listening on %s:%s\n", self.Host, self.Port)
+	if msg.Message != HEARTBEAT {
+		log.Printf("Received %s from node %d.\n", msg.Message, msg.NodeId)
+	}
 
-	for {
-		conn, _ := l.Accept()
+	if partitionAware {
+		handlePartitionMessage(msg)
+		return
+	}
 
-		decoder := gob.NewDecoder(conn)
-		var payloadData message
-		if err := decoder.Decode(&payloadData); err != nil {
-			// If there is an error, skip the message.
-			continue
+	switch algorithm {
+	case "bully":
+		handleBullyMessage(msg)
+		return
+	case "chang-roberts", "hirschberg-sinclair":
+		handleRingMessage(msg)
+		return
+	case "raft":
+		handleRaftMessage(msg)
+		return
+	case "paxos":
+		if msg.Paxos != nil {
+			handlePaxosMessage(msg)
+			return
 		}
+	}
 
-		var id int
-		for nid, n := range neighbours {
-			if n.Port == payloadData.Port {
-				id = nid
-				break
-			}
+	if persistent && msg.Message == HEARTBEAT {
+		handleHeartbeat(msg)
+		return
+	}
+
+	handleElectionMessage(msg, id)
+}
+
+// initiateWave starts a wave tagged with the ID of the current node, unless
+// the node already joined a wave with a higher tag, already accepted the
+// announcement of a leader or already follows a leader confirmed in the
+// current term. An announced wave visited every node, so a later wave could
+// not change its leader, and it would run on while termination is detected
+// along the tree of the announced one.
+func initiateWave() {
+	if waveTag > self.NodeId {
+		log.Printf("Not initiating, already part of the wave of node %d.\n", waveTag)
+		return
+	}
+
+	if announced.Leader != 0 && disagreement == "" {
+		log.Printf("Not initiating, leader %d was already announced.\n", announced.Leader)
+		return
+	}
+
+	if following {
+		log.Printf("Not initiating, already following leader %d in term %d.\n", leaderId, leaderTerm)
+		return
+	}
+
+	log.Printf("Initiating wave of node %d.\n", self.NodeId)
+	joinWave(term, self.NodeId, message{})
+}
+
+// compareWave compares the tag of the wave of msg, made of its term and the ID
+// of its initiator, with the tag of the current wave and returns -1, 0 or 1 if
+// it is lower, equal or higher.
+func compareWave(msg message) int {
+	switch {
+	case msg.Term < term, msg.Term == term && msg.Initiator < waveTag:
+		return -1
+	case msg.Term > term, msg.Initiator > waveTag:
+		return 1
+	}
+
+	return 0
+}
+
+// handleElectionMessage handles a message of the election received from the
+// neighbour at index id. Waves with a lower tag than the current one are
+// extinguished, a wave with a higher tag is joined and messages of the current
+// wave count as replies.
+func handleElectionMessage(msg message, id int) {
+	// Leader announcement or message to terminate received from parent.
+	if msg.Message == LEADER || msg.Message == TERMINATE {
+		if compareWave(msg) != 0 || msg.Port != self.ParentMessage.Port {
+			return
 		}
 
-		// Invalid message.
-		if payloadData.NodeId == 0 {
-			continue
+		if msg.Message == LEADER {
+			acceptLeader(msg)
+		} else {
+			terminateNeighbours()
 		}
+		return
+	}
 
-		log.Printf("Received %s from node %d.\n", payloadData.Message, payloadData.NodeId)
+	// Acknowledgement of the leader announcement received from a child.
+	if msg.Message == ACK {
+		handleAck(msg, id)
+		return
+	}
 
-		// Message to terminate received from parent.
-		if payloadData.Message == TERMINATE && payloadData.NodeId == self.ParentMessage.NodeId {
-			terminateNeighbours()
+	switch compareWave(msg) {
+	case 1:
+		if persistent && leaderAlive() && msg.Initiator != leaderId {
+			log.Printf("Ignoring wave of node %d in term %d, leader %d is alive.\n", msg.Initiator, msg.Term, leaderId)
+			return
 		}
 
-		leaderChanged := false
+		log.Printf("Joining wave of node %d, parent is node %d.\n", msg.Initiator, msg.NodeId)
+		joinWave(msg.Term, msg.Initiator, msg)
+		return
+	case -1:
+		log.Printf("Extinguishing wave of node %d, current wave is of node %d.\n", msg.Initiator, waveTag)
+		return
+	}
+
+	// Ping from a neighbour that is not a child or pong from a child.
+	neighbours[id].HasReplied = true
+	if msg.Message == "pong" {
+		neighbours[id].IsChild = true
+	}
+	updateWaveMax(msg.Leader)
+	checkWaveCompleted()
+}
+
+// joinWave resets the parent and reply state of the current node for the wave
+// of term t tagged with tag and sends the wave on to all neighbours except the
+// parent. The parent of the initiator of a wave is empty. A later term starts
+// without a leader. It must be called on the event loop.
+func joinWave(t int, tag int, parent message) {
+	if t > term {
+		term = t
+		self.Leader = self.NodeId
+		termGauge(term)
+		leaderGauge(self.Leader)
+	}
+
+	waveTag = tag
+	waveMax = 0
+	waveDone = false
+	following = false
+	leaderHeard = time.Now()
+	self.ParentMessage = parent
+
+	// Neighbours that failed count as replied.
+	for idx, n := range neighbours {
+		neighbours[idx].HaveSent = false
+		neighbours[idx].HasReplied = n.Port == parent.Port || !isUp(n)
+		neighbours[idx].IsChild = false
+	}
 
-		// Change leader if a node with higher ID is received.
-		selfMutex.Lock()
-		if payloadData.Leader > self.Leader || self.Leader == 0 {
-			log.Printf("Changing leader to node %d.\n", payloadData.Leader)
-			self.Leader = payloadData.Leader
-			leaderChanged = true
+	if parent.NodeId != 0 {
+		log.Printf("Parent of node %d is node %d.\n", self.NodeId, parent.NodeId)
+	}
+	core.LogLocal(core.EVENT_STATE_CHANGE, "wave "+strconv.Itoa(tag)+" parent "+strconv.Itoa(parent.NodeId))
+	core.WaveStarted()
+	updateWaveMax(self.NodeId)
+	updateWaveMax(parent.Leader)
+
+	// Send ping message to neighbours.
+	for idx, n := range neighbours {
+		if n.Port == parent.Port || !isUp(n) {
+			continue
 		}
-		selfMutex.Unlock()
-
-		// If leader has changed for current node then broadcast to all nodes
-		// about it.
-		if leaderChanged {
-			for nid, n := range neighbours {
-				neighbours[nid].HaveSent = true    // Mark message as sent.
-				neighbours[nid].HasReplied = false // Mark reply as false.
-				hasInitiated = false               // Initiator needs to reinitiate.
-
-				msg := message{
-					NodeId:  self.NodeId,
-					Host:    self.Host,
-					Port:    self.Port,
-					Message: "leader changed",
-					Leader:  self.Leader,
-				}
-
-				sendMessage(n, msg)
-			}
+
+		msg := message{
+			NodeId:    self.NodeId,
+			Host:      self.Host,
+			Port:      self.Port,
+			Message:   "ping",
+			Leader:    waveMax,
+			Initiator: waveTag,
+			Term:      term,
 		}
+		sendMessage(n, msg)
+		neighbours[idx].HaveSent = true
+	}
 
-		if self.IsInitiator {
-			if neighbours[id].HaveSent {
-				// Reply received from a node that was previously contacted.
-				neighbours[id].HasReplied = true
-			}
-		} else {
-			// If node has no parent or wave tagged with higher id hits node.
-			// Make node that sent this message the parent.
-			// Mutex used to restrict access to members of self struct.
-			selfMutex.Lock()
-
-			if (message{} == self.ParentMessage) {
-				self.ParentMessage = payloadData
-				neighbours[id].HasReplied = true
-
-				log.Printf("Parent of node %d is node %d.\n", self.NodeId, payloadData.NodeId)
-
-				// Send ping message to neighbours.
-				for idx, receivingNode := range neighbours {
-					if receivingNode.Port != self.ParentMessage.Port {
-						msg := message{
-							NodeId:  self.NodeId,
-							Host:    self.Host,
-							Port:    self.Port,
-							Message: "ping",
-							Leader:  self.Leader,
-						}
-						sendMessage(receivingNode, msg)
-					}
-					// Mark message as being sent to node.
-					neighbours[idx].HaveSent = true
-				}
-			} else {
-				if neighbours[id].HaveSent {
-					// Reply received from a node that was previously contacted.
-					neighbours[id].HasReplied = true
-				}
-			}
-			selfMutex.Unlock()
+	checkWaveCompleted()
+}
+
+// updateWaveMax records id as the highest node ID of the current wave if it
+// is higher than the ones seen so far. It must be called on the event loop.
+func updateWaveMax(id int) {
+	if id <= waveMax {
+		return
+	}
+
+	waveMax = id
+	if waveMax > self.Leader {
+		log.Printf("Changing leader to node %d.\n", waveMax)
+		self.Leader = waveMax
+		leaderGauge(self.Leader)
+		core.LogLocal(core.EVENT_STATE_CHANGE, "leader "+strconv.Itoa(self.Leader))
+	}
+}
+
+// checkWaveCompleted completes the current wave once all neighbours replied.
+// The initiator of the wave decides on the highest ID seen by the wave as
+// leader, every other node sends a pong carrying the highest ID in its subtree
+// to its parent. It must be called on the event loop.
+func checkWaveCompleted() {
+	if waveDone || !allNeighboursReplied() {
+		return
+	}
+	waveDone = true
+	core.WaveCompleted()
+
+	if waveTag == self.NodeId {
+		log.Printf("Wave of node %d completed.\n", waveTag)
+		self.Leader = waveMax
+		announceLeader()
+		return
+	}
+
+	// Send pong message to parent.
+	parent := node{
+		Host: self.ParentMessage.Host,
+		Port: self.ParentMessage.Port,
+	}
+
+	msg := message{
+		NodeId:    self.NodeId,
+		Host:      self.Host,
+		Port:      self.Port,
+		Message:   "pong",
+		Leader:    waveMax,
+		Initiator: waveTag,
+		Term:      term,
+	}
+
+	sendMessage(parent, msg)
+}
+
+// setupTermination detects the end of the extinction and ring elections with
+// Safra's algorithm, whose token walks the spanning tree of the completed wave
+// or goes around the ring. The other elections keep running or wait on their
+// own.
+func setupTermination() {
+	if persistent || partitionAware {
+		return
+	}
+
+	switch algorithm {
+	case "extinction":
+		core.SetupSafra(core.TreeRoute(waveParent, waveChildren), terminateNeighbours)
+	case "chang-roberts", "hirschberg-sinclair":
+		core.SetupSafra(core.RingRoute(func() core.Peer { return next().peer() }), terminateRing)
+	}
+}
+
+// waveParent returns the parent of the current node in the current wave.
+func waveParent() core.Peer {
+	return core.Peer{Host: self.ParentMessage.Host, Port: self.ParentMessage.Port}
+}
+
+// waveChildren returns the children of the current node in the current wave.
+func waveChildren() []core.Peer {
+	children := make([]core.Peer, 0)
+	for _, n := range neighbours {
+		if n.IsChild {
+			children = append(children, n.peer())
 		}
 	}
+
+	return children
 }
 
-// terminateNeighbours send messages to non parent neighbours of node to
-// terminate.
+// terminateNeighbours sends the decided leader to the children of the node in
+// the completed wave and stops the node as decided. It is called once
+// termination has been detected, so no message of the election is in flight
+// any more. It must be called on the event loop.
 func terminateNeighbours() {
 	for _, n := range neighbours {
-		selfMutex.Lock()
-		if self.ParentMessage.Port != n.Port {
+		if n.IsChild {
 			msg := message{
-				NodeId:  self.NodeId,
-				Host:    self.Host,
-				Port:    self.Port,
-				Message: TERMINATE,
-				Leader:  self.Leader,
+				NodeId:    self.NodeId,
+				Host:      self.Host,
+				Port:      self.Port,
+				Message:   TERMINATE,
+				Leader:    self.Leader,
+				Initiator: waveTag,
+				Term:      term,
 			}
 			sendMessage(n, msg)
 		}
-		selfMutex.Unlock()
 	}
 
 	log.Println("Leader is:", self.Leader)
-	log.Println("Sleeping for 3 seconds before terminating.")
-	time.Sleep(3 * time.Second)
-
-	os.Exit(0)
-}
+	log.Println(core.Report())
+	core.LogLocal(core.EVENT_DECIDE, "leader "+strconv.Itoa(self.Leader))
 
-// allNeighboursUp checks if all neighbours can be reached if not, it will
-// block till all neighbours are up.
-func allNeighboursUp() bool {
-	for _, addr := range neighbours {
-		for {
-			log.Printf("Trying to dial %s:%s\n", addr.Host, addr.Port)
-			conn, err := net.Dial("tcp", addr.Host+":"+addr.Port)
-
-			if err == nil {
-				conn.Close()
-				log.Printf("Successfully dialled %s:%s\n", addr.Host, addr.Port)
-				break
-			}
-
-			time.Sleep(1 * time.Second)
-		}
+	if disagreement != "" {
+		log.Printf("ERROR: Terminating without agreement on the leader: %s.\n", disagreement)
+		core.Stop(core.EXIT_DISAGREED)
+		return
 	}
 
-	return true
+	core.Stop(core.EXIT_DECIDED)
 }
 
 // allNeighboursReplied checks if all neighbours have replied to a node.
@@ -335,24 +558,15 @@ func allNeighboursReplied() bool {
 	return allReplied
 }
 
-// sendMessage sends msg of type message to node recvAddr. Retries sending
-// indefinitely.
+// sendMessage sends msg of type message to node recvAddr, subject to the
+// injected faults. The persistent leader service sends every message once, so
+// that it does not block on failed neighbours. Once the node stopped no new
+// messages are sent.
 func sendMessage(recvAddr node, msg message) {
-	log.Printf("Sending %s to %s:%s.\n", msg.Message, recvAddr.Host, recvAddr.Port)
-	for {
-		conn, err := net.Dial("tcp", recvAddr.Host+":"+recvAddr.Port)
-
-		if err == nil && msg.NodeId != 0 {
-			encoder := gob.NewEncoder(conn)
-			if err := encoder.Encode(msg); err != nil {
-				log.Fatal(err)
-			}
-
-			conn.Close()
-			break
-		}
-
-		time.Sleep(1 * time.Second)
+	if persistent {
+		sendMessageOnce(recvAddr, msg)
+		return
 	}
-	log.Printf("Sent %s to %s:%s.\n", msg.Message, recvAddr.Host, recvAddr.Port)
+
+	core.Send(recvAddr.peer(), msg)
 }
@@ -0,0 +1,133 @@
+package main
+
+import "distributed-systems/core"
+
+// PROTOCOL_VERSION is the version of the messages exchanged by the nodes. It
+// has to be raised whenever the fields of a message or their meaning change,
+// so that nodes of different versions reject each other's messages.
+const PROTOCOL_VERSION = 4
+
+// Kinds of the messages of the elections.
+const (
+	TYPE_PING core.MessageType = core.TYPE_PROTOCOL + iota
+	TYPE_PONG
+	TYPE_TERMINATE
+	TYPE_LEADER
+	TYPE_ACK
+	TYPE_ELECTION
+	TYPE_ANSWER
+	TYPE_COORDINATOR
+	TYPE_HEARTBEAT
+	TYPE_WAVE
+	TYPE_ECHO
+	TYPE_ELECTED
+	TYPE_PROBE
+	TYPE_REPLY
+	TYPE_REQUEST_VOTE
+	TYPE_VOTE
+	TYPE_APPEND_ENTRIES
+	TYPE_APPEND_REPLY
+	TYPE_PREPARE
+	TYPE_PROMISE
+	TYPE_ACCEPT
+	TYPE_ACCEPTED
+	TYPE_NACK
+)
+
+// messageTypes maps the Message of a message to its kind.
+var messageTypes = map[string]core.MessageType{
+	"ping":         TYPE_PING,
+	"pong":         TYPE_PONG,
+	TERMINATE:      TYPE_TERMINATE,
+	LEADER:         TYPE_LEADER,
+	ACK:            TYPE_ACK,
+	ELECTION:       TYPE_ELECTION,
+	ANSWER:         TYPE_ANSWER,
+	COORDINATOR:    TYPE_COORDINATOR,
+	HEARTBEAT:      TYPE_HEARTBEAT,
+	WAVE:           TYPE_WAVE,
+	ECHO:           TYPE_ECHO,
+	ELECTED:        TYPE_ELECTED,
+	PROBE:          TYPE_PROBE,
+	REPLY:          TYPE_REPLY,
+	REQUEST_VOTE:   TYPE_REQUEST_VOTE,
+	VOTE:           TYPE_VOTE,
+	APPEND_ENTRIES: TYPE_APPEND_ENTRIES,
+	APPEND_REPLY:   TYPE_APPEND_REPLY,
+	PREPARE:        TYPE_PREPARE,
+	PROMISE:        TYPE_PROMISE,
+	ACCEPT:         TYPE_ACCEPT,
+	ACCEPTED:       TYPE_ACCEPTED,
+	NACK:           TYPE_NACK,
+}
+
+// protocolName returns the name of the election the current node runs, its
+// algorithm followed by the mode of the nodes that keep running. Nodes only
+// accept messages of the same election, so that for example a Bully node does
+// not read the waves of the extinction election as its own messages.
+func protocolName() string {
+	switch {
+	case partitionAware:
+		return "election/partition-aware"
+	case persistent && algorithm != "paxos":
+		return "election/" + algorithm + "/persistent"
+	}
+
+	return "election/" + algorithm
+}
+
+// election describes the election to the core. TERMINATE and the heartbeats
+// are not part of the election whose termination is detected.
+func election() core.Protocol[message] {
+	return core.Protocol[message]{
+		Name:    protocolName(),
+		Version: PROTOCOL_VERSION,
+		Types:   messageTypes,
+		Control: []string{TERMINATE, HEARTBEAT},
+		Quiet:   []string{HEARTBEAT},
+		Handle:  handleMessage,
+		State:   func() any { return currentState() },
+	}
+}
+
+// Header returns the fields of msg that every protocol shares.
+func (msg message) Header() core.Header {
+	return core.Header{
+		NodeId:   msg.NodeId,
+		Host:     msg.Host,
+		Port:     msg.Port,
+		Kind:     msg.Message,
+		Clock:    msg.Clock,
+		Snapshot: msg.Snapshot,
+		Channel:  msg.Channel,
+		Safra:    msg.Safra,
+	}
+}
+
+// WithHeader returns a copy of msg with the shared fields of h.
+func (msg message) WithHeader(h core.Header) core.Message {
+	msg.NodeId = h.NodeId
+	msg.Host = h.Host
+	msg.Port = h.Port
+	msg.Message = h.Kind
+	msg.Clock = h.Clock
+	msg.Snapshot = h.Snapshot
+	msg.Channel = h.Channel
+	msg.Safra = h.Safra
+	return msg
+}
+
+// peer returns node n as a peer of the core.
+func (n node) peer() core.Peer {
+	return core.Peer{NodeId: n.NodeId, Host: n.Host, Port: n.Port, Socket: n.Socket}
+}
+
+// peersOf returns nodes as peers of the core.
+func peersOf(nodes []node) []core.Peer {
+	out := make([]core.Peer, 0, len(nodes))
+	for _, n := range nodes {
+		out = append(out, n.peer())
+	}
+
+	return out
+}
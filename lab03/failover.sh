@@ -0,0 +1,99 @@
+#! /bin/bash
+
+# Usage: ./failover.sh
+#
+# Runs the persistent leader service on the 5 nodes of the config directory,
+# kills the leader, checks that the remaining nodes elect a new leader in a
+# later term, restarts the old leader and checks that it follows the new one.
+# The leader lease of every node is checked along the way.
+
+set -u
+
+WAIT=${WAIT:-8}
+DIR=$(mktemp -d)
+PIDS=()
+
+cleanup() {
+    kill $(jobs -p) 2>/dev/null
+    wait 2>/dev/null
+}
+trap cleanup EXIT
+
+# metric prints the value of metric name of every node given by the last digit
+# of its port.
+metric() {
+    local name=$1
+    shift
+
+    for n in "$@"; do
+        curl -s http://127.0.0.1:910$n/metrics | awk -v name=$name '$1 == name { print $2 }'
+    done
+}
+
+# expect checks that the nodes given after the leader all agree on it.
+expect() {
+    local want=$1
+    local step=$2
+    shift 2
+
+    for got in $(metric node_leader "$@"); do
+        if [ "$got" != "$want" ]; then
+            echo "FAIL: $step, nodes $* should have leader $want, got: $(metric node_leader "$@" | tr '\n' ' ')"
+            exit 1
+        fi
+    done
+    echo "OK: $step, nodes $* have leader $want in term $(metric node_term $1)."
+}
+
+# holder checks that only the node given first holds the lease among the nodes
+# given after it.
+holder() {
+    local want=$1
+    shift
+
+    for n in "$@"; do
+        got=$(curl -s http://127.0.0.1:920$n/lease | grep -o '"Holder":[a-z]*')
+        if [ "$n" = "$want" ] && [ "$got" != '"Holder":true' ] || [ "$n" != "$want" ] && [ "$got" != '"Holder":false' ]; then
+            echo "FAIL: node $want should hold the lease, node $n has $got."
+            exit 1
+        fi
+    done
+    echo "OK: node $want holds the lease."
+}
+
+# start starts the node given by the last digit of its port.
+start() {
+    $DIR/election -config config/configFile_600$1.txt -persistent \
+        -metrics 127.0.0.1:910$1 -lease 127.0.0.1:920$1 >> $DIR/node_600$1.log 2>&1 &
+    PIDS[$1]=$!
+}
+
+go build -o $DIR/election *.go || exit 1
+
+for n in 1 2 3 4 5; do
+    start $n
+done
+
+echo "Logs are in $DIR."
+
+sleep $WAIT
+expect 50 "before the failure" 1 2 3 4 5
+holder 5 1 2 3 4 5
+before=$(metric node_term 1)
+
+kill ${PIDS[5]}
+sleep $WAIT
+expect 40 "after the leader failed" 1 2 3 4
+after=$(metric node_term 1)
+if [ "$after" -le "$before" ]; then
+    echo "FAIL: term did not increase after the leader failed, $before before and $after after."
+    exit 1
+fi
+holder 4 1 2 3 4
+
+start 5
+sleep $WAIT
+expect 40 "after the old leader restarted" 1 2 3 4 5
+holder 4 1 2 3 4 5
+
+echo "PASS"
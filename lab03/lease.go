@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"distributed-systems/core"
+)
+
+// lease is the view of the current node on the leadership. Leader is the
+// leader the node follows (0 while an election is running) and Term the term
+// it was confirmed in. Holder is true if the current node is the leader and
+// holds the lease, which then lasts until Expiry. On a follower Expiry is the
+// time until which it promised the leader not to take part in another
+// election. ExpiresIn is the time left until Expiry in milliseconds, which
+// unlike Expiry does not depend on the wall clock of the node.
+type lease struct {
+	Leader    int
+	Term      int
+	Holder    bool
+	Expiry    time.Time
+	ExpiresIn int64
+}
+
+var maxDrift float64                             // Bound on the clock drift rate between nodes.
+var lastLease lease                              // Lease last published to subscribers.
+var leaseSubscribers = make(map[chan lease]bool) // Subscribers to leadership changes.
+
+// leaseDuration returns how long a lease lasts on the clock of the leader
+// after it sent a heartbeat that every member acknowledged. A follower does
+// not take part in another election for the suspect timeout on its own clock
+// after it saw the heartbeat, which is at least suspectTimeout / (1 + drift)
+// in real time. The leader has to stop using the lease before, and its clock
+// may run slow by up to the drift rate.
+func leaseDuration() time.Duration {
+	return time.Duration(float64(suspectTimeout) * (1 - maxDrift) / (1 + maxDrift))
+}
+
+// currentLease returns the current lease of the node. It must be called on
+// the event loop.
+func currentLease() lease {
+	if !following {
+		return lease{Term: term}
+	}
+
+	l := lease{
+		Leader: leaderId,
+		Term:   leaderTerm,
+		Expiry: leaderHeard.Add(suspectTimeout),
+	}
+
+	if leaderId == self.NodeId {
+		l.Expiry = time.Time{}
+
+		// The lease runs from the latest heartbeat that all members of the
+		// confirmed membership have seen.
+		acked := ackedBeat()
+		if sent, ok := beatSent[acked]; ok && acked > 0 {
+			l.Expiry = sent.Add(leaseDuration())
+			l.Holder = time.Now().Before(l.Expiry)
+		}
+
+		// Heartbeats acknowledged by all members are of no further use.
+		for beat := range beatSent {
+			if beat < acked {
+				delete(beatSent, beat)
+			}
+		}
+	}
+
+	if !l.Expiry.IsZero() {
+		l.ExpiresIn = time.Until(l.Expiry).Milliseconds()
+		if l.ExpiresIn < 0 {
+			l.ExpiresIn = 0
+		}
+	}
+
+	return l
+}
+
+// ackedBeat returns the latest heartbeat of the current node as leader that
+// all members of the confirmed membership have seen, -1 without members.
+// Heartbeat 0 stands for the announcement of the leader, which members may
+// have seen before the leader did, so it never starts a lease. It must be
+// called on the event loop.
+func ackedBeat() int {
+	acked := -1
+	for _, m := range leaderMembers {
+		beat, ok := beatAcks[m.NodeId]
+		if !ok {
+			beat = 0
+		}
+		if acked == -1 || beat < acked {
+			acked = beat
+		}
+	}
+
+	return acked
+}
+
+// leaseLapsed reports whether a member of the confirmed membership stopped
+// acknowledging the heartbeats of the current node as leader, so that the
+// lease can only be renewed with the membership of a new election. The
+// acknowledgements of the members furthest away take up to twice the
+// heartbeat interval times the diameter of the network to come back, so the
+// lease may run out for a moment while all members are alive. A member only
+// counts as failed once the latest heartbeat all members acknowledged is older
+// than twice the suspect timeout. It must be called on the event loop.
+func leaseLapsed() bool {
+	since := leaderSince
+	if sent, ok := beatSent[ackedBeat()]; ok {
+		since = sent
+	}
+
+	return time.Since(since) > 2*suspectTimeout
+}
+
+// leaseNow returns the current lease of the node.
+func leaseNow() lease {
+	var l lease
+	core.Run(func() { l = currentLease() })
+
+	return l
+}
+
+// subscribeLease returns a channel that receives the lease whenever the
+// leader, the term or the holder of the lease changes, starting with the
+// current lease, and a function that cancels the subscription. A slow
+// subscriber only misses intermediate changes, never the latest one.
+func subscribeLease() (<-chan lease, func()) {
+	c := make(chan lease, 1)
+	core.Run(func() {
+		c <- currentLease()
+		leaseSubscribers[c] = true
+	})
+
+	cancel := func() {
+		core.Run(func() { delete(leaseSubscribers, c) })
+	}
+
+	return c, cancel
+}
+
+// publishLease notifies the subscribers if the leader, the term or the holder
+// of the lease changed since the last notification. It must be called on
+// the event loop.
+func publishLease() {
+	l := currentLease()
+	if l.Leader == lastLease.Leader && l.Term == lastLease.Term && l.Holder == lastLease.Holder {
+		return
+	}
+
+	if l.Holder {
+		log.Printf("Holding the lease of term %d.\n", l.Term)
+	} else if lastLease.Holder {
+		log.Printf("Lost the lease of term %d.\n", lastLease.Term)
+	}
+	lastLease = l
+
+	for c := range leaseSubscribers {
+		// Replace a change the subscriber has not received yet.
+		select {
+		case <-c:
+		default:
+		}
+		c <- l
+	}
+}
+
+// serveLease serves the lease of the node over HTTP on addr, which is either
+// a host:port or, prefixed with unix:, the path of a Unix socket. GET /lease
+// returns the current lease as JSON, GET /lease?watch=1 streams the lease as
+// one JSON object per line whenever it changes. An empty addr disables the
+// endpoint.
+func serveLease(addr string) {
+	if addr == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/lease", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+
+		if r.URL.Query().Get("watch") == "" {
+			encoder.Encode(leaseNow())
+			return
+		}
+
+		flusher, _ := w.(http.Flusher)
+		updates, cancel := subscribeLease()
+		defer cancel()
+
+		for {
+			select {
+			case l := <-updates:
+				if err := encoder.Encode(l); err != nil {
+					return
+				}
+				if flusher != nil {
+					flusher.Flush()
+				}
+			case <-r.Context().Done():
+				return
+			}
+		}
+	})
+
+	network := "tcp"
+	if strings.HasPrefix(addr, "unix:") {
+		network = "unix"
+		addr = strings.TrimPrefix(addr, "unix:")
+		os.Remove(addr) // Remove the socket of a previous run.
+	}
+
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		panic("Error listening for lease requests: " + err.Error())
+	}
+
+	go func() {
+		log.Printf("Serving lease on %s %s/lease\n", network, addr)
+		if err := http.Serve(l, mux); err != nil {
+			log.Printf("Lease listener stopped: %v\n", err)
+		}
+	}()
+}
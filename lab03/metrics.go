@@ -0,0 +1,7 @@
+package main
+
+import "distributed-systems/core"
+
+// Gauges of the election, exposed with the metrics of the node.
+var leaderGauge = core.Gauge("node_leader", "Leader currently known to the node.")
+var termGauge = core.Gauge("node_term", "Election term currently known to the node.")
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"time"
+
+	"distributed-systems/core"
+)
+
+// Messages used by the partition aware election.
+const (
+	HEARTBEAT = "#HEARTBEAT#"
+	WAVE      = "wave"
+	ECHO      = "echo"
+	ELECTED   = "elected"
+)
+
+// wave is the state of the current node in the election wave it takes part
+// in. A wave is tagged with the Epoch it was started in and the ID of its
+// Initiator, Parent is the port of the neighbour the wave arrived from (empty
+// for the initiator), Pending holds the ports of the neighbours whose echo is
+// still awaited and Max is the highest node ID seen in the subtree of the
+// current node.
+type wave struct {
+	Epoch     int
+	Initiator int
+	Parent    string
+	Pending   map[string]bool
+	Max       int
+}
+
+var partitionAware bool                    // Run the partition aware election.
+var heartbeatInterval time.Duration        // Interval between heartbeats.
+var suspectTimeout time.Duration           // Silence after which a neighbour is unreachable.
+var currentWave wave                       // Wave the current node takes part in.
+var maxEpoch int                           // Highest epoch seen so far.
+var leaderEpoch int                        // Epoch the current leader was elected in.
+var reachable = make(map[string]bool)      // Reachability of neighbours by port.
+var lastHeard = make(map[string]time.Time) // Last message from neighbours by port.
+var topologyChanged bool                   // Reachability changed since the last wave.
+
+// runPartitionAware runs the partition aware election. Neighbours are watched
+// with heartbeats and every time a neighbour becomes unreachable or reachable
+// again a new election wave is started. Waves are tagged with an epoch and the
+// ID of their initiator and only the wave with the highest tag completes, so
+// every connected component elects the node with the highest ID in it. When
+// two components merge the new wave covers both of them and exactly one
+// leader survives.
+func runPartitionAware() {
+	log.Println("Running partition aware election.")
+
+	core.Every(heartbeatInterval, watchNeighbours)
+}
+
+// watchNeighbours sends a heartbeat to every neighbour and starts a new wave
+// if the reachability of a neighbour changed.
+func watchNeighbours() {
+	for _, n := range neighbours {
+		sendMessageOnce(n, message{
+			NodeId:  self.NodeId,
+			Host:    self.Host,
+			Port:    self.Port,
+			Message: HEARTBEAT,
+			Leader:  self.Leader,
+			Epoch:   leaderEpoch,
+		})
+
+		up := time.Since(lastHeard[n.Port]) < suspectTimeout
+		if up != reachable[n.Port] {
+			if up {
+				log.Printf("Neighbour %s:%s is reachable.\n", n.Host, n.Port)
+			} else {
+				log.Printf("Neighbour %s:%s is unreachable.\n", n.Host, n.Port)
+			}
+			reachable[n.Port] = up
+			topologyChanged = true
+		}
+	}
+
+	if topologyChanged {
+		topologyChanged = false
+		startWave()
+	}
+}
+
+// handlePartitionMessage handles a message of the partition aware election
+// on the event loop.
+func handlePartitionMessage(msg message) {
+	lastHeard[msg.Port] = time.Now()
+	if msg.Epoch > maxEpoch {
+		maxEpoch = msg.Epoch
+	}
+
+	switch msg.Message {
+	case WAVE:
+		receiveWave(msg)
+	case ECHO:
+		receiveEcho(msg)
+	case ELECTED:
+		receiveElected(msg)
+	}
+}
+
+// startWave starts a new wave in a new epoch with the current node as
+// initiator. It must be called on the event loop.
+func startWave() {
+	maxEpoch++
+	currentWave = wave{
+		Epoch:     maxEpoch,
+		Initiator: self.NodeId,
+		Pending:   make(map[string]bool),
+		Max:       self.NodeId,
+	}
+	log.Printf("Starting wave in epoch %d.\n", currentWave.Epoch)
+	core.WaveStarted()
+
+	forwardWave()
+}
+
+// receiveWave handles a wave message. Waves with a lower tag than the current
+// one are extinguished, a wave with a higher tag is joined and the wave
+// message of the current wave from another neighbour counts as its echo.
+func receiveWave(msg message) {
+	if msg.Epoch == currentWave.Epoch && msg.Initiator == currentWave.Initiator {
+		delete(currentWave.Pending, msg.Port)
+		checkWave()
+		return
+	}
+
+	if msg.Epoch < currentWave.Epoch || (msg.Epoch == currentWave.Epoch && msg.Initiator < currentWave.Initiator) {
+		log.Printf("Extinguishing wave of node %d in epoch %d.\n", msg.Initiator, msg.Epoch)
+		return
+	}
+
+	log.Printf("Joining wave of node %d in epoch %d, parent is node %d.\n", msg.Initiator, msg.Epoch, msg.NodeId)
+	currentWave = wave{
+		Epoch:     msg.Epoch,
+		Initiator: msg.Initiator,
+		Parent:    msg.Port,
+		Pending:   make(map[string]bool),
+		Max:       self.NodeId,
+	}
+	core.WaveStarted()
+
+	forwardWave()
+}
+
+// forwardWave sends the current wave to all reachable neighbours except the
+// parent. It must be called on the event loop.
+func forwardWave() {
+	for _, n := range neighbours {
+		if n.Port == currentWave.Parent || !reachable[n.Port] {
+			continue
+		}
+
+		currentWave.Pending[n.Port] = true
+		sendMessageOnce(n, message{
+			NodeId:    self.NodeId,
+			Host:      self.Host,
+			Port:      self.Port,
+			Message:   WAVE,
+			Leader:    self.NodeId,
+			Epoch:     currentWave.Epoch,
+			Initiator: currentWave.Initiator,
+		})
+	}
+
+	checkWave()
+}
+
+// receiveEcho handles the echo of a neighbour in the current wave.
+func receiveEcho(msg message) {
+	if msg.Epoch != currentWave.Epoch || msg.Initiator != currentWave.Initiator {
+		return
+	}
+
+	if msg.Leader > currentWave.Max {
+		currentWave.Max = msg.Leader
+	}
+	delete(currentWave.Pending, msg.Port)
+
+	checkWave()
+}
+
+// checkWave completes the current wave once all echoes arrived. The initiator
+// decides on the highest ID seen as leader, every other node echoes to its
+// parent. It must be called on the event loop.
+func checkWave() {
+	if currentWave.Pending == nil || len(currentWave.Pending) > 0 {
+		return
+	}
+	currentWave.Pending = nil
+	core.WaveCompleted()
+
+	if currentWave.Parent == "" {
+		log.Printf("Wave of epoch %d completed.\n", currentWave.Epoch)
+		receiveElected(message{
+			NodeId:  self.NodeId,
+			Host:    self.Host,
+			Port:    self.Port,
+			Message: ELECTED,
+			Leader:  currentWave.Max,
+			Epoch:   currentWave.Epoch,
+		})
+		return
+	}
+
+	for _, n := range neighbours {
+		if n.Port == currentWave.Parent {
+			sendMessageOnce(n, message{
+				NodeId:    self.NodeId,
+				Host:      self.Host,
+				Port:      self.Port,
+				Message:   ECHO,
+				Leader:    currentWave.Max,
+				Epoch:     currentWave.Epoch,
+				Initiator: currentWave.Initiator,
+			})
+		}
+	}
+}
+
+// receiveElected adopts the leader elected in the epoch of msg, unless a
+// leader of a later epoch is already known, and floods it to all reachable
+// neighbours.
+func receiveElected(msg message) {
+	if msg.Epoch <= leaderEpoch {
+		return
+	}
+
+	log.Printf("Leader of component is: %d (epoch %d).\n", msg.Leader, msg.Epoch)
+	core.LogLocal(core.EVENT_DECIDE, "leader "+strconv.Itoa(msg.Leader))
+
+	self.Leader = msg.Leader
+	leaderEpoch = msg.Epoch
+	leaderGauge(self.Leader)
+
+	for _, n := range neighbours {
+		if n.Port == msg.Port || !reachable[n.Port] {
+			continue
+		}
+
+		sendMessageOnce(n, message{
+			NodeId:  self.NodeId,
+			Host:    self.Host,
+			Port:    self.Port,
+			Message: ELECTED,
+			Leader:  msg.Leader,
+			Epoch:   msg.Epoch,
+		})
+	}
+}
+
+// sendMessageOnce sends msg of type message to node recvAddr, subject to the
+// injected faults. Unlike sendMessage it gives up if the node cannot be
+// dialled, since the partition aware election must not block on unreachable
+// neighbours.
+func sendMessageOnce(recvAddr node, msg message) {
+	core.SendOnce(recvAddr.peer(), msg, suspectTimeout)
+}
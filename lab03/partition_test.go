@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"testing"
+	"time"
+
+	"distributed-systems/clustertest"
+)
+
+var componentPattern = regexp.MustCompile(`Leader of component is: \d+ `) // Leader a node follows.
+
+// TestPartitionAwareElection partitions a ring of clustertest.NODES nodes
+// running the partition aware election into nodes 1 to 3 and nodes 4 to 8,
+// checks that each component elects the node with the highest ID in it, heals
+// the partition and checks that the highest node of the ring is elected again.
+func TestPartitionAwareElection(t *testing.T) {
+	c := clustertest.New(t, "election")
+
+	ring := c.Network(t, "ring", func(n int) []string {
+		next := n%clustertest.NODES + 1
+		prev := (n+clustertest.NODES-2)%clustertest.NODES + 1
+		return []string{c.Address(n, fmt.Sprintf(":%d:*", n*10)), c.Address(next, ""), c.Address(prev, "")}
+	})
+
+	// leader accepts the decision of a group whose highest node leads it.
+	leader := func(group []int, decided string) bool {
+		return decided == fmt.Sprintf("Leader of component is: %d ", group[len(group)-1]*10)
+	}
+	all := []int{1, 2, 3, 4, 5, 6, 7, 8}
+	steps := []clustertest.Partition{
+		{Name: "before the partition", Groups: [][]int{all}, Expect: leader},
+		{Name: "during the partition", Faults: "partition=10001,10002,10003/10004,10005,10006,10007,10008",
+			Groups: [][]int{{1, 2, 3}, {4, 5, 6, 7, 8}}, Expect: leader},
+		{Name: "after healing", Faults: "partition=", Groups: [][]int{all}, Expect: leader},
+	}
+
+	c.RunPartitions(t, ring, componentPattern, 20*time.Second, steps, "-partition-aware")
+}
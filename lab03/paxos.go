@@ -0,0 +1,690 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"distributed-systems/core"
+)
+
+// Kinds of Paxos messages.
+const (
+	PREPARE  = "prepare"
+	PROMISE  = "promise"
+	ACCEPT   = "accept"
+	ACCEPTED = "accepted"
+	NACK     = "nack"
+)
+
+// Roles a Paxos node can take.
+const (
+	ROLE_PROPOSER = "proposer"
+	ROLE_ACCEPTOR = "acceptor"
+	ROLE_LEARNER  = "learner"
+)
+
+// ballot is the number of a Paxos proposal. Ballots are ordered by Round and
+// then by the ID of the proposing node, so that no two proposers ever use the
+// same ballot. The zero ballot is lower than any ballot a proposer uses.
+type ballot struct {
+	Round  int
+	NodeId int
+}
+
+// less reports whether ballot b is lower than ballot o.
+func (b ballot) less(o ballot) bool {
+	return b.Round < o.Round || (b.Round == o.Round && b.NodeId < o.NodeId)
+}
+
+// proposal is a Value accepted for a Slot of the log in a Ballot.
+type proposal struct {
+	Slot   int
+	Ballot ballot
+	Value  string
+}
+
+// paxosMessage holds the fields of a Paxos message. Kind is the kind of the
+// message and Ballot the ballot it belongs to. A prepare message asks for the
+// promises of the acceptors for Slot and, unless Single is set, all later slots
+// too, and a promise carries the proposals the acceptor accepted in them as
+// Accepted. Accept and accepted messages carry the Slot and Value of a
+// proposal, and a nack carries the ballot the acceptor Promised instead.
+type paxosMessage struct {
+	Kind     string
+	Ballot   ballot
+	Promised ballot
+	Slot     int
+	Single   bool
+	Value    string
+	Accepted []proposal
+}
+
+// acceptorState is the state of an acceptor that is persisted before it
+// answers any message: the ballot it Promised not to accept lower ballots than
+// and the proposal it Accepted last for each slot.
+type acceptorState struct {
+	Promised ballot
+	Accepted map[int]proposal
+}
+
+// decision is a Value chosen for a Slot, and whether it is the value Proposed
+// by the client.
+type decision struct {
+	Slot     int
+	Value    string
+	Proposed bool
+}
+
+var paxosMode string                                       // Paxos variant to run, single or multi.
+var paxosRoles = make(map[string]map[string]bool)          // Roles of every node by port.
+var acceptor = acceptorState{Accepted: map[int]proposal{}} // Persistent state of the current node as acceptor.
+var paxosFile string                                       // File the acceptor state is written to.
+var paxosRound int                                         // Highest ballot round seen.
+var paxosPrepared bool                                     // Phase 1 of paxosBallot completed for all open slots.
+var paxosPreparedTerm int                                  // Leader term in which phase 1 completed.
+var paxosBallot ballot                                     // Ballot of the current proposal.
+var paxosNext int                                          // Next free slot of the leader.
+var paxosReplies chan message                              // Promises and nacks for the current proposal.
+var paxosVotes = make(map[int]map[ballot]map[string]bool)  // Acceptors that accepted each ballot by slot.
+var paxosChosen = make(map[int]string)                     // Values known to be chosen by slot.
+var paxosWaiting = make(map[int][]chan string)             // Proposers waiting for a slot to be chosen.
+var paxosRand *rand.Rand                                   // Source of the randomized retry delays.
+var proposeMutex sync.Mutex                                // Only one proposal of the current node runs at a time.
+
+// setupPaxos reads the roles of the nodes from rolesFile, loads the acceptor
+// state of the current node from dir, if it was written by an earlier run, and
+// serves proposals on addr when Paxos was requested. Without a roles file every
+// node is a proposer, an acceptor and a learner.
+func setupPaxos(dir string, rolesFile string, addr string) {
+	if algorithm != "paxos" {
+		return
+	}
+
+	if paxosMode != "single" && paxosMode != "multi" {
+		panic("Invalid Paxos mode, please pass single or multi.")
+	}
+
+	for _, n := range neighbours {
+		if n.NodeId == 0 {
+			panic("Paxos needs the ID of every node in the config file.")
+		}
+	}
+
+	for _, n := range paxosNodes() {
+		paxosRoles[n.Port] = map[string]bool{ROLE_PROPOSER: true, ROLE_ACCEPTOR: true, ROLE_LEARNER: true}
+	}
+
+	if rolesFile != "" {
+		readRoles(rolesFile)
+	}
+
+	roles := make([]string, 0)
+	for role := range paxosRoles[self.Port] {
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+	log.Printf("Running %s Paxos as %s with %d acceptors.\n", paxosMode, strings.Join(roles, ", "), len(paxosAcceptors()))
+
+	if len(paxosAcceptors()) == 0 {
+		panic("Paxos needs at least one acceptor.")
+	}
+
+	paxosFile = filepath.Join(dir, "paxos_"+self.Port+".json")
+	paxosRand = rand.New(rand.NewSource(time.Now().UnixNano() + int64(self.NodeId)))
+
+	data, err := ioutil.ReadFile(paxosFile)
+	if err == nil {
+		if err := json.Unmarshal(data, &acceptor); err != nil {
+			panic("Error reading acceptor state from " + paxosFile + ": " + err.Error())
+		}
+		if acceptor.Accepted == nil {
+			acceptor.Accepted = make(map[int]proposal)
+		}
+		paxosRound = acceptor.Promised.Round
+		log.Printf("Loaded promise %d.%d and %d accepted proposals from %s.\n",
+			acceptor.Promised.Round, acceptor.Promised.NodeId, len(acceptor.Accepted), paxosFile)
+	}
+
+	servePaxos(addr)
+}
+
+// readRoles reads the roles of the nodes from a file with one line per node,
+// holding the port of the node and a comma separated list of its roles, e.g.
+// 10001:proposer,learner. Nodes that are not listed keep all roles.
+func readRoles(rolesFile string) {
+	data, err := ioutil.ReadFile(rolesFile)
+	if err != nil {
+		panic("Error reading roles file.")
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	for scanner.Scan() {
+		line := strings.Split(strings.TrimSpace(scanner.Text()), ":")
+		if len(line) != 2 {
+			continue
+		}
+
+		roles := make(map[string]bool)
+		for _, role := range strings.Split(line[1], ",") {
+			switch role {
+			case ROLE_PROPOSER, ROLE_ACCEPTOR, ROLE_LEARNER:
+				roles[role] = true
+			default:
+				panic("Invalid role " + role + ", please pass proposer, acceptor or learner.")
+			}
+		}
+		paxosRoles[line[0]] = roles
+	}
+}
+
+// persistPaxos writes the acceptor state of the current node to its file. The
+// state is written to a temporary file first, so that a crash never leaves a
+// partly written file behind. It must be called on the event loop.
+func persistPaxos() {
+	data, err := json.Marshal(acceptor)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	tmp := paxosFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		log.Fatal(err)
+	}
+	if err := os.Rename(tmp, paxosFile); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// paxosNodes returns all nodes of the cluster, including the current node. It
+// must be called on the event loop, or before it started.
+func paxosNodes() []node {
+	return append([]node{self}, neighbours...)
+}
+
+// hasRole reports whether node n has role.
+func hasRole(n node, role string) bool {
+	return paxosRoles[n.Port][role]
+}
+
+// paxosAcceptors returns the nodes of the cluster that are acceptors. It must
+// be called on the event loop, or before it started.
+func paxosAcceptors() []node {
+	acceptors := make([]node, 0)
+	for _, n := range paxosNodes() {
+		if hasRole(n, ROLE_ACCEPTOR) {
+			acceptors = append(acceptors, n)
+		}
+	}
+
+	return acceptors
+}
+
+// quorum returns the number of acceptors that make up a majority. It must be
+// called on the event loop, or before it started.
+func quorum() int {
+	return len(paxosAcceptors())/2 + 1
+}
+
+// firstOpenSlot returns the first slot of the log that the current node does
+// not know to be chosen. It must be called on the event loop.
+func firstOpenSlot() int {
+	slot := 1
+	for {
+		if _, ok := paxosChosen[slot]; !ok {
+			return slot
+		}
+		slot++
+	}
+}
+
+// leadingPaxos reports whether the current node leads Multi-Paxos, which it
+// does while it is the leader of the persistent leader service. It must be
+// called on the event loop.
+func leadingPaxos() bool {
+	return following && leaderId == self.NodeId
+}
+
+// proposePaxos proposes value and returns the decision for the slot it was
+// proposed in. Single-decree Paxos always decides slot 1, so the value chosen
+// may be the value of another proposer. Multi-Paxos proposes value in the next
+// free slot of the log and only the leader accepts proposals. Attempts that
+// are preempted by a higher ballot are retried until timeout.
+func proposePaxos(value string, timeout time.Duration) (decision, error) {
+	proposeMutex.Lock()
+	defer proposeMutex.Unlock()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		var err error
+		ran := core.Run(func() {
+			if !hasRole(self, ROLE_PROPOSER) {
+				err = fmt.Errorf("not a proposer")
+				return
+			}
+			if paxosMode == "multi" && !leadingPaxos() {
+				leader := self.Leader
+				if !following {
+					leader = 0
+				}
+				err = fmt.Errorf("not the leader, the leader is node %d", leader)
+			}
+		})
+		if !ran {
+			return decision{}, fmt.Errorf("the node stopped")
+		}
+		if err != nil {
+			return decision{}, err
+		}
+
+		d, err := paxosAttempt(value, deadline)
+		if err == nil {
+			return d, nil
+		}
+
+		if time.Now().After(deadline) {
+			return decision{}, fmt.Errorf("no value was chosen within %s: %v", timeout, err)
+		}
+
+		// Back off for a random time, so that competing proposers do not keep
+		// preempting each other.
+		var delay time.Duration
+		core.Run(func() { delay = time.Duration(paxosRand.Int63n(int64(heartbeatInterval))) })
+		log.Printf("Proposal failed, %v, retrying in %s.\n", err, delay)
+		if !core.SleepOrStop(delay) {
+			return decision{}, fmt.Errorf("the node stopped")
+		}
+	}
+}
+
+// paxosAttempt makes a single attempt to get value chosen. Phase 1 is skipped
+// when the leader already completed it in the current term.
+func paxosAttempt(value string, deadline time.Time) (decision, error) {
+	single := paxosMode == "single"
+	var prepared, known bool
+	var slot, term int
+	var chosen string
+	core.Run(func() {
+		prepared = !single && paxosPrepared && paxosPreparedTerm == leaderTerm
+		slot = firstOpenSlot()
+		if single {
+			slot = 1
+			chosen, known = paxosChosen[slot]
+		}
+		term = leaderTerm
+	})
+	if known {
+		return decision{Slot: slot, Value: chosen, Proposed: chosen == value}, nil
+	}
+	proposed := value
+
+	if !prepared {
+		recovered, err := paxosPrepare(slot, single, deadline)
+		if err != nil {
+			return decision{}, err
+		}
+
+		core.Run(func() {
+			if single {
+				if p, ok := recovered[slot]; ok {
+					log.Printf("Proposing %q accepted in ballot %d.%d instead.\n", p.Value, p.Ballot.Round, p.Ballot.NodeId)
+					proposed = p.Value
+				}
+				return
+			}
+
+			// Proposals accepted by earlier leaders are proposed again, since
+			// they may have been chosen already.
+			paxosNext = slot
+			for s, p := range recovered {
+				if _, ok := paxosChosen[s]; !ok {
+					log.Printf("Recovering %q for slot %d.\n", p.Value, s)
+					sendAccept(proposal{Slot: s, Ballot: paxosBallot, Value: p.Value})
+				}
+				if s >= paxosNext {
+					paxosNext = s + 1
+				}
+			}
+			paxosPrepared = true
+			paxosPreparedTerm = term
+		})
+	}
+
+	var p proposal
+	core.Run(func() {
+		if !single {
+			if paxosNext < firstOpenSlot() {
+				paxosNext = firstOpenSlot()
+			}
+			slot = paxosNext
+			paxosNext++
+		}
+		p = proposal{Slot: slot, Ballot: paxosBallot, Value: proposed}
+	})
+
+	chosen, err := paxosAccept(p, deadline)
+	if err != nil {
+		return decision{}, err
+	}
+
+	return decision{Slot: slot, Value: chosen, Proposed: chosen == value}, nil
+}
+
+// paxosPrepare runs phase 1 with a new ballot for slot and, unless single is
+// set, all later slots. It returns the proposal with the highest ballot that
+// the acceptors of a majority accepted in each slot.
+func paxosPrepare(slot int, single bool, deadline time.Time) (map[int]proposal, error) {
+	var b ballot
+	var replies chan message
+	var majority int
+	core.Run(func() {
+		paxosRound++
+		b = ballot{Round: paxosRound, NodeId: self.NodeId}
+		paxosBallot = b
+		paxosPrepared = false
+		replies = make(chan message, 2*len(paxosNodes()))
+		paxosReplies = replies
+		majority = quorum()
+
+		log.Printf("Preparing ballot %d.%d from slot %d.\n", b.Round, b.NodeId, slot)
+		core.LogLocal(core.EVENT_STATE_CHANGE, "ballot "+strconv.Itoa(b.Round)+"."+strconv.Itoa(b.NodeId))
+		for _, n := range paxosAcceptors() {
+			sendPaxos(n, paxosMessage{Kind: PREPARE, Ballot: b, Slot: slot, Single: single})
+		}
+	})
+
+	recovered := make(map[int]proposal)
+	promised := make(map[string]bool)
+	timeout := time.After(attemptTimeout(deadline))
+	for len(promised) < majority {
+		select {
+		case msg := <-replies:
+			r := msg.Paxos
+			if r.Ballot != b {
+				continue
+			}
+			if r.Kind == NACK {
+				return nil, fmt.Errorf("ballot %d.%d was preempted by ballot %d.%d", b.Round, b.NodeId, r.Promised.Round, r.Promised.NodeId)
+			}
+			if r.Kind != PROMISE {
+				continue
+			}
+
+			promised[msg.Port] = true
+			for _, p := range r.Accepted {
+				if q, ok := recovered[p.Slot]; !ok || q.Ballot.less(p.Ballot) {
+					recovered[p.Slot] = p
+				}
+			}
+		case <-timeout:
+			return nil, fmt.Errorf("ballot %d.%d was promised by %d of %d acceptors", b.Round, b.NodeId, len(promised), majority)
+		}
+	}
+
+	log.Printf("Ballot %d.%d promised by a majority.\n", b.Round, b.NodeId)
+	return recovered, nil
+}
+
+// paxosAccept runs phase 2 for proposal p and returns the value chosen for its
+// slot.
+func paxosAccept(p proposal, deadline time.Time) (string, error) {
+	var chosen string
+	var known bool
+	var replies chan message
+	done := make(chan string, 1)
+	core.Run(func() {
+		if chosen, known = paxosChosen[p.Slot]; known {
+			return
+		}
+
+		paxosWaiting[p.Slot] = append(paxosWaiting[p.Slot], done)
+		replies = paxosReplies
+		sendAccept(p)
+	})
+	if known {
+		return chosen, nil
+	}
+
+	timeout := time.After(attemptTimeout(deadline))
+	for {
+		select {
+		case chosen := <-done:
+			return chosen, nil
+		case msg := <-replies:
+			r := msg.Paxos
+			if r.Kind != NACK || r.Ballot != p.Ballot {
+				continue
+			}
+
+			core.Run(func() { paxosPrepared = false })
+			return "", fmt.Errorf("ballot %d.%d was preempted by ballot %d.%d", p.Ballot.Round, p.Ballot.NodeId, r.Promised.Round, r.Promised.NodeId)
+		case <-timeout:
+			core.Run(func() { paxosPrepared = false })
+			return "", fmt.Errorf("slot %d was not chosen in ballot %d.%d", p.Slot, p.Ballot.Round, p.Ballot.NodeId)
+		}
+	}
+}
+
+// attemptTimeout returns how long a phase of a proposal waits for the
+// acceptors, the suspect timeout but no longer than until deadline.
+func attemptTimeout(deadline time.Time) time.Duration {
+	timeout := time.Until(deadline)
+	if timeout > suspectTimeout {
+		timeout = suspectTimeout
+	}
+
+	return timeout
+}
+
+// sendAccept sends proposal p to all acceptors. It must be called on
+// the event loop.
+func sendAccept(p proposal) {
+	for _, n := range paxosAcceptors() {
+		sendPaxos(n, paxosMessage{Kind: ACCEPT, Ballot: p.Ballot, Slot: p.Slot, Value: p.Value})
+	}
+}
+
+// handlePaxosMessage handles a Paxos message on the event loop. Promises and
+// nacks are passed on to the proposal of the current node.
+func handlePaxosMessage(msg message) {
+	p := msg.Paxos
+	if p == nil {
+		return
+	}
+
+	// A proposer always picks a higher round than it has seen.
+	for _, b := range []ballot{p.Ballot, p.Promised} {
+		if b.Round > paxosRound {
+			paxosRound = b.Round
+		}
+	}
+
+	sender := node{NodeId: msg.NodeId, Host: msg.Host, Port: msg.Port}
+	switch p.Kind {
+	case PREPARE:
+		receivePrepare(sender, p)
+	case ACCEPT:
+		receiveAccept(sender, p)
+	case ACCEPTED:
+		receiveAccepted(sender, p)
+	case PROMISE, NACK:
+		if paxosReplies == nil {
+			return
+		}
+
+		select {
+		case paxosReplies <- msg:
+		default:
+		}
+	}
+}
+
+// receivePrepare promises not to accept any ballot lower than the ballot of a
+// prepare message, unless a higher ballot was promised already, and sends back
+// the proposals accepted in the slots the prepare message is for.
+func receivePrepare(sender node, p *paxosMessage) {
+	if !hasRole(self, ROLE_ACCEPTOR) {
+		return
+	}
+
+	if p.Ballot.less(acceptor.Promised) {
+		sendPaxos(sender, paxosMessage{Kind: NACK, Ballot: p.Ballot, Promised: acceptor.Promised})
+		return
+	}
+
+	if acceptor.Promised != p.Ballot {
+		acceptor.Promised = p.Ballot
+		persistPaxos()
+		log.Printf("Promising ballot %d.%d.\n", p.Ballot.Round, p.Ballot.NodeId)
+	}
+
+	accepted := make([]proposal, 0)
+	for slot, a := range acceptor.Accepted {
+		if slot == p.Slot || (!p.Single && slot > p.Slot) {
+			accepted = append(accepted, a)
+		}
+	}
+
+	sendPaxos(sender, paxosMessage{Kind: PROMISE, Ballot: p.Ballot, Accepted: accepted})
+}
+
+// receiveAccept accepts a proposal unless a higher ballot was promised, and
+// tells the proposer and all learners.
+func receiveAccept(sender node, p *paxosMessage) {
+	if !hasRole(self, ROLE_ACCEPTOR) {
+		return
+	}
+
+	if p.Ballot.less(acceptor.Promised) {
+		sendPaxos(sender, paxosMessage{Kind: NACK, Ballot: p.Ballot, Promised: acceptor.Promised})
+		return
+	}
+
+	acceptor.Promised = p.Ballot
+	acceptor.Accepted[p.Slot] = proposal{Slot: p.Slot, Ballot: p.Ballot, Value: p.Value}
+	persistPaxos()
+	log.Printf("Accepted %q for slot %d in ballot %d.%d.\n", p.Value, p.Slot, p.Ballot.Round, p.Ballot.NodeId)
+
+	reply := paxosMessage{Kind: ACCEPTED, Ballot: p.Ballot, Slot: p.Slot, Value: p.Value}
+	sendPaxos(sender, reply)
+	for _, n := range paxosNodes() {
+		if n.Port != sender.Port && hasRole(n, ROLE_LEARNER) {
+			sendPaxos(n, reply)
+		}
+	}
+}
+
+// receiveAccepted counts the acceptors that accepted a ballot in a slot. The
+// value of the ballot is chosen once a majority of the acceptors accepted it.
+func receiveAccepted(sender node, p *paxosMessage) {
+	if _, ok := paxosChosen[p.Slot]; ok {
+		return
+	}
+
+	if paxosVotes[p.Slot] == nil {
+		paxosVotes[p.Slot] = make(map[ballot]map[string]bool)
+	}
+	if paxosVotes[p.Slot][p.Ballot] == nil {
+		paxosVotes[p.Slot][p.Ballot] = make(map[string]bool)
+	}
+	paxosVotes[p.Slot][p.Ballot][sender.Port] = true
+
+	if len(paxosVotes[p.Slot][p.Ballot]) < quorum() {
+		return
+	}
+
+	paxosChosen[p.Slot] = p.Value
+	delete(paxosVotes, p.Slot)
+	log.Printf("Chosen %q for slot %d.\n", p.Value, p.Slot)
+	core.LogLocal(core.EVENT_DECIDE, "slot "+strconv.Itoa(p.Slot)+" value "+p.Value)
+
+	for _, c := range paxosWaiting[p.Slot] {
+		c <- p.Value
+	}
+	delete(paxosWaiting, p.Slot)
+}
+
+// sendPaxos sends the Paxos message p to node recvAddr once.
+func sendPaxos(recvAddr node, p paxosMessage) {
+	msg := message{
+		NodeId:  self.NodeId,
+		Host:    self.Host,
+		Port:    self.Port,
+		Message: p.Kind,
+		Paxos:   &p,
+	}
+	sendMessageOnce(recvAddr, msg)
+}
+
+// servePaxos serves proposals over HTTP on addr. POST /propose proposes the
+// request body and returns the decisions as JSON, one for each slot that was
+// tried until the value was chosen. GET /chosen returns the values the current
+// node learned by slot. An empty addr disables the endpoint.
+func servePaxos(addr string) {
+	if addr == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/propose", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		value := strings.TrimSpace(string(body))
+
+		// In Multi-Paxos a value of an earlier leader may take the slot, in
+		// which case the value is proposed again in the next one.
+		decisions := make([]decision, 0)
+		for {
+			d, err := proposePaxos(value, 5*time.Second)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+
+			decisions = append(decisions, d)
+			if d.Proposed || paxosMode == "single" {
+				break
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(decisions)
+	})
+	mux.HandleFunc("/chosen", func(w http.ResponseWriter, r *http.Request) {
+		chosen := make(map[int]string)
+		core.Run(func() {
+			for slot, value := range paxosChosen {
+				chosen[slot] = value
+			}
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(chosen)
+	})
+
+	go func() {
+		log.Printf("Serving proposals on http://%s/propose\n", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Printf("Proposal listener stopped: %v\n", err)
+		}
+	}()
+}
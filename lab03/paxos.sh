@@ -0,0 +1,120 @@
+#! /bin/bash
+
+# Usage: ./paxos.sh
+#
+# Runs Multi-Paxos on the 5 fully connected nodes of the config/bully directory
+# with the roles of config/paxos/roles.txt, proposes values through the leader,
+# kills the leader and proposes through the new one, and checks that all nodes
+# learned the same log. Then runs single-decree Paxos, proposes two values
+# through two nodes at once and checks that both see the same value chosen.
+
+set -u
+
+WAIT=${WAIT:-10}
+DIR=$(mktemp -d)
+PIDS=()
+
+cleanup() {
+    kill $(jobs -p) 2>/dev/null
+    wait 2>/dev/null
+}
+trap cleanup EXIT
+
+# leader prints the last digit of the port of the node that is the leader
+# according to the nodes given.
+leader() {
+    for n in "$@"; do
+        curl -s http://127.0.0.1:910$n/metrics | awk '/^node_leader / { print $2 / 10 }'
+    done | sort | uniq -c | sort -rn | awk 'NR == 1 && $2 != 0 { print $2 }'
+}
+
+# propose proposes value through the node given and prints the decision.
+propose() {
+    $DIR/paxospropose -node 127.0.0.1:940$1 -value "$2"
+}
+
+# expect checks that the nodes given after the first one learned the same log
+# as the first one.
+expect() {
+    local first=$1
+    local want=$(curl -s http://127.0.0.1:940$first/chosen)
+    shift
+
+    for n in "$@"; do
+        got=$(curl -s http://127.0.0.1:940$n/chosen)
+        if [ "$got" != "$want" ]; then
+            echo "FAIL: node $n learned $got, node $first learned $want."
+            exit 1
+        fi
+    done
+    echo "OK: nodes $first $* learned $want"
+}
+
+# start starts the node given by the last digit of its port in the Paxos mode
+# given.
+start() {
+    $DIR/election -config config/bully/configFile_600$1.txt -algorithm paxos -paxos-mode $2 \
+        -roles config/paxos/roles.txt -paxos-dir $DIR/$2 -metrics 127.0.0.1:910$1 \
+        -paxos 127.0.0.1:940$1 >> $DIR/node_600$1_$2.log 2>&1 &
+    PIDS[$1]=$!
+}
+
+go build -o $DIR/election *.go || exit 1
+go build -o $DIR/paxospropose ../paxospropose/paxospropose.go || exit 1
+mkdir $DIR/multi $DIR/single
+
+echo "Logs are in $DIR."
+
+for n in 1 2 3 4 5; do
+    start $n multi
+done
+
+sleep $WAIT
+first=$(leader 1 2 3 4 5)
+echo "OK: node $first is the leader."
+propose $first a || exit 1
+propose $first b || exit 1
+
+other=$(echo 1 2 3 4 5 | tr ' ' '\n' | grep -v $first | head -1)
+if propose $other c; then
+    echo "FAIL: node $other is not the leader but accepted a proposal."
+    exit 1
+fi
+
+kill ${PIDS[$first]}
+others=$(echo 1 2 3 4 5 | tr ' ' '\n' | grep -v $first | tr '\n' ' ')
+sleep $WAIT
+second=$(leader $others)
+if [ -z "$second" ] || [ "$second" = "$first" ]; then
+    echo "FAIL: no new leader after node $first failed."
+    exit 1
+fi
+echo "OK: node $second is the new leader."
+propose $second c || exit 1
+sleep 1
+expect $second $(echo $others | tr ' ' '\n' | grep -v $second)
+if [ "$(curl -s http://127.0.0.1:940$second/chosen)" != '{"1":"a","2":"b","3":"c"}' ]; then
+    echo "FAIL: log should be a, b, c."
+    exit 1
+fi
+
+kill $(jobs -p) 2>/dev/null
+wait 2>/dev/null
+
+for n in 1 2 3 4 5; do
+    start $n single
+done
+
+sleep $WAIT
+propose 1 x > $DIR/propose_1.txt &
+propose 2 y > $DIR/propose_2.txt
+wait %%
+cat $DIR/propose_1.txt $DIR/propose_2.txt
+if [ "$(grep -o '"."' $DIR/propose_1.txt | head -1)" != "$(grep -o '"."' $DIR/propose_2.txt | head -1)" ]; then
+    echo "FAIL: the proposers saw different values chosen."
+    exit 1
+fi
+sleep 1
+expect 1 2 3 4 5
+
+echo "PASS"
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"distributed-systems/clustertest"
+	"distributed-systems/core"
+)
+
+var leaderPattern = regexp.MustCompile(`Leader is: \d+`) // Leader a node terminates with.
+
+// TestElectionsAreRaceFree runs every election algorithm on networks of
+// clustertest.NODES nodes built with the race detector: the extinction
+// election and the ring elections on a bidirectional ring, the Bully election on a fully
+// connected network, and the persistent leader service, Raft and Paxos until
+// the timeout, while their metrics, lease, key/value store and Paxos endpoints
+// are used.
+func TestElectionsAreRaceFree(t *testing.T) {
+	c := clustertest.New(t, "election")
+
+	// Every node of the ring lists its clockwise neighbour first and its
+	// anticlockwise one second.
+	ring := c.Network(t, "ring", func(n int) []string {
+		next := n%clustertest.NODES + 1
+		prev := (n+clustertest.NODES-2)%clustertest.NODES + 1
+		return []string{c.Address(n, fmt.Sprintf(":%d:*", n*10)), c.Address(next, ""), c.Address(prev, "")}
+	})
+	mesh := c.Network(t, "mesh", func(n int) []string {
+		lines := []string{c.Address(n, fmt.Sprintf(":%d", n*10))}
+		for m := 1; m <= clustertest.NODES; m++ {
+			if m != n {
+				lines = append(lines, c.Address(m, fmt.Sprintf(":%d", m*10)))
+			}
+		}
+		return lines
+	})
+
+	// The first node only proposes and learns, the others take every role.
+	roles := []string{"10001:proposer,learner"}
+	for n := 2; n <= clustertest.NODES; n++ {
+		roles = append(roles, fmt.Sprintf("%d:proposer,acceptor,learner", 10000+n))
+	}
+	rolesFile := filepath.Join(c.Dir, "roles.txt")
+	if err := os.WriteFile(rolesFile, []byte(strings.Join(roles, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	metrics := clustertest.FreeAddrs(t, clustertest.NODES)
+	endpoints := clustertest.FreeAddrs(t, clustertest.NODES)
+	requests := func(path func(addr string) []clustertest.Request) []clustertest.Request {
+		all := make([]clustertest.Request, 0)
+		for idx := range metrics {
+			all = append(all, clustertest.Request{Method: http.MethodGet, URL: "http://" + metrics[idx] + "/metrics"})
+			if path != nil {
+				all = append(all, path(endpoints[idx])...)
+			}
+		}
+		return all
+	}
+	endpoint := func(flag string) func(n int) []string {
+		return func(n int) []string {
+			args := []string{"-metrics", metrics[n-1]}
+			if flag != "" {
+				args = append(args, flag, endpoints[n-1])
+			}
+			return args
+		}
+	}
+
+	for _, algorithm := range []string{"extinction", "chang-roberts", "hirschberg-sinclair"} {
+		t.Run(algorithm, func(t *testing.T) {
+			outputs := c.Run(t, ring, core.EXIT_DECIDED, endpoint(""), requests(nil), "-algorithm", algorithm)
+			clustertest.ExpectAgreement(t, outputs, leaderPattern)
+		})
+	}
+
+	t.Run("bully", func(t *testing.T) {
+		outputs := c.Run(t, mesh, core.EXIT_DECIDED, endpoint(""), requests(nil), "-algorithm", "bully")
+		clustertest.ExpectAgreement(t, outputs, leaderPattern)
+	})
+
+	t.Run("persistent", func(t *testing.T) {
+		c.Run(t, ring, core.EXIT_TIMED_OUT, endpoint("-lease"), requests(func(addr string) []clustertest.Request {
+			return []clustertest.Request{{Method: http.MethodGet, URL: "http://" + addr + "/lease"}}
+		}), "-persistent", "-timeout", "10s")
+	})
+
+	t.Run("raft", func(t *testing.T) {
+		c.Run(t, mesh, core.EXIT_TIMED_OUT, endpoint("-kv"), requests(func(addr string) []clustertest.Request {
+			return []clustertest.Request{
+				{Method: http.MethodPut, URL: "http://" + addr + "/kv/x", Body: addr},
+				{Method: http.MethodGet, URL: "http://" + addr + "/kv/x"},
+			}
+		}), "-algorithm", "raft", "-raft-dir", t.TempDir(), "-timeout", "10s")
+	})
+
+	t.Run("paxos", func(t *testing.T) {
+		c.Run(t, mesh, core.EXIT_TIMED_OUT, endpoint("-paxos"), requests(func(addr string) []clustertest.Request {
+			return []clustertest.Request{
+				{Method: http.MethodPost, URL: "http://" + addr + "/propose", Body: addr},
+				{Method: http.MethodGet, URL: "http://" + addr + "/chosen"},
+			}
+		}), "-algorithm", "paxos", "-roles", rolesFile, "-paxos-dir", t.TempDir(), "-timeout", "10s")
+	})
+}
@@ -0,0 +1,568 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"distributed-systems/core"
+)
+
+// Kinds of Raft messages. Append entries messages without entries and their
+// replies are sent as heartbeats, so that they do not clutter the logs.
+const (
+	REQUEST_VOTE   = "request-vote"
+	VOTE           = "vote"
+	APPEND_ENTRIES = "append-entries"
+	APPEND_REPLY   = "append-reply"
+)
+
+// Roles of a Raft node.
+const (
+	ROLE_FOLLOWER  = "follower"
+	ROLE_CANDIDATE = "candidate"
+	ROLE_LEADER    = "leader"
+)
+
+// raftMessage holds the fields of a Raft message. Kind is the kind of the
+// message and Term the term of its sender. LastLogIndex and LastLogTerm
+// describe the log of a candidate, PrevLogIndex, PrevLogTerm, Entries and
+// LeaderCommit make up an append entries message, Granted is the answer to a
+// vote request and Success and MatchIndex the answer to an append entries
+// message. On failure MatchIndex is the length of the log of the follower, so
+// that the leader can skip back quickly.
+type raftMessage struct {
+	Kind         string
+	Term         int
+	LastLogIndex int
+	LastLogTerm  int
+	PrevLogIndex int
+	PrevLogTerm  int
+	Entries      []logEntry
+	LeaderCommit int
+	Granted      bool
+	Success      bool
+	MatchIndex   int
+}
+
+// logEntry is an entry of the replicated log, a Command for the key/value
+// store that was received by the leader of Term.
+type logEntry struct {
+	Term    int
+	Command string
+}
+
+// raftState is the state of a Raft node that is persisted before answering
+// any message: the CurrentTerm, the node the current node VotedFor in it and
+// the Log.
+type raftState struct {
+	CurrentTerm int
+	VotedFor    int
+	Log         []logEntry
+}
+
+var raft raftState                          // Persistent state of the current node.
+var raftFile string                         // File the persistent state is written to.
+var raftRole = ROLE_FOLLOWER                // Role of the current node.
+var raftVotes = make(map[int]bool)          // Nodes that voted for the current node in the current term.
+var raftDeadline time.Time                  // When the current node starts an election.
+var raftRand *rand.Rand                     // Source of the randomized election timeouts.
+var commitIndex int                         // Highest log index known to be committed.
+var lastApplied int                         // Highest log index applied to the store.
+var nextIndex = make(map[string]int)        // Next log index to send to each peer by port.
+var matchIndex = make(map[string]int)       // Highest log index replicated on each peer by port.
+var kvStore = make(map[string]string)       // Replicated key/value store.
+var kvWaiting = make(map[int]chan logEntry) // Clients waiting for a log index to be applied.
+
+// setupRaft loads the persistent state of the current node from dir, if it
+// was written by an earlier run, and serves the key/value store on kvAddr when
+// Raft was requested.
+func setupRaft(dir string, kvAddr string) {
+	if algorithm != "raft" {
+		return
+	}
+
+	for _, n := range neighbours {
+		if n.NodeId == 0 {
+			panic("Raft needs the ID of every node in the config file.")
+		}
+	}
+
+	raftFile = filepath.Join(dir, "raft_"+self.Port+".json")
+	raftRand = rand.New(rand.NewSource(time.Now().UnixNano() + int64(self.NodeId)))
+
+	data, err := ioutil.ReadFile(raftFile)
+	if err == nil {
+		if err := json.Unmarshal(data, &raft); err != nil {
+			panic("Error reading Raft state from " + raftFile + ": " + err.Error())
+		}
+		log.Printf("Loaded term %d and %d log entries from %s.\n", raft.CurrentTerm, len(raft.Log), raftFile)
+	}
+	termGauge(raft.CurrentTerm)
+
+	serveKV(kvAddr)
+}
+
+// persistRaft writes the persistent state of the current node to its file. The
+// state is written to a temporary file first, so that a crash never leaves a
+// partly written file behind. It must be called on the event loop.
+func persistRaft() {
+	data, err := json.Marshal(raft)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	tmp := raftFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		log.Fatal(err)
+	}
+	if err := os.Rename(tmp, raftFile); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// runRaft runs Raft on the current node and its neighbours, which have to be
+// all other nodes of the cluster. Followers and candidates start an election
+// when they do not hear from a leader before their randomized election
+// timeout, the leader sends append entries messages to all followers every
+// heartbeat interval. Nodes that are down are simply not heard from, so the
+// nodes do not wait for each other to be up.
+func runRaft() {
+	log.Printf("Running Raft with %d nodes.\n", len(neighbours)+1)
+
+	resetElectionTimeout()
+	core.Every(heartbeatInterval/5, checkRaftDeadline)
+}
+
+// checkRaftDeadline makes the leader send append entries messages once the
+// heartbeat interval passed and a follower or candidate start an election once
+// its election timeout passed.
+func checkRaftDeadline() {
+	if raftRole == ROLE_LEADER {
+		if time.Now().After(raftDeadline) {
+			sendAppendEntries()
+			raftDeadline = time.Now().Add(heartbeatInterval)
+		}
+	} else if time.Now().After(raftDeadline) {
+		startRaftElection()
+	}
+}
+
+// resetElectionTimeout sets the election deadline to a random time between one
+// and two suspect timeouts from now. It must be called on the event loop.
+func resetElectionTimeout() {
+	timeout := suspectTimeout + time.Duration(raftRand.Int63n(int64(suspectTimeout)))
+	raftDeadline = time.Now().Add(timeout)
+}
+
+// lastLog returns the index and term of the last entry of the log. It must be
+// called on the event loop.
+func lastLog() (int, int) {
+	if len(raft.Log) == 0 {
+		return 0, 0
+	}
+
+	return len(raft.Log), raft.Log[len(raft.Log)-1].Term
+}
+
+// termAt returns the term of the log entry at index, 0 for index 0. It must
+// be called on the event loop.
+func termAt(index int) int {
+	if index == 0 {
+		return 0
+	}
+
+	return raft.Log[index-1].Term
+}
+
+// startRaftElection makes the current node a candidate of the next term and
+// requests the votes of all other nodes. It must be called on the event
+// loop.
+func startRaftElection() {
+	raft.CurrentTerm++
+	raft.VotedFor = self.NodeId
+	persistRaft()
+
+	raftRole = ROLE_CANDIDATE
+	raftVotes = make(map[int]bool)
+	self.Leader = 0
+	termGauge(raft.CurrentTerm)
+	leaderGauge(self.Leader)
+	core.WaveStarted()
+	resetElectionTimeout()
+
+	log.Printf("Starting election of term %d.\n", raft.CurrentTerm)
+	core.LogLocal(core.EVENT_STATE_CHANGE, "candidate term "+strconv.Itoa(raft.CurrentTerm))
+
+	lastIndex, lastTerm := lastLog()
+	for _, n := range neighbours {
+		sendRaft(n, raftMessage{
+			Kind:         REQUEST_VOTE,
+			Term:         raft.CurrentTerm,
+			LastLogIndex: lastIndex,
+			LastLogTerm:  lastTerm,
+		})
+	}
+
+	checkVotes()
+}
+
+// becomeFollower makes the current node a follower of term t. It must be called
+// on the event loop.
+func becomeFollower(t int) {
+	if raftRole != ROLE_FOLLOWER {
+		log.Printf("Becoming follower in term %d.\n", t)
+	}
+	raftRole = ROLE_FOLLOWER
+
+	if t > raft.CurrentTerm {
+		raft.CurrentTerm = t
+		raft.VotedFor = 0
+		persistRaft()
+		termGauge(raft.CurrentTerm)
+	}
+}
+
+// checkVotes makes the current node the leader once a majority of the cluster
+// voted for it. It must be called on the event loop.
+func checkVotes() {
+	// The current node votes for itself. A vote that is received twice,
+	// duplicated by the network or sent again, is only counted once.
+	votes := len(raftVotes) + 1
+	if raftRole != ROLE_CANDIDATE || votes <= (len(neighbours)+1)/2 {
+		return
+	}
+
+	raftRole = ROLE_LEADER
+	self.Leader = self.NodeId
+	leaderGauge(self.Leader)
+	core.WaveCompleted()
+	log.Printf("Elected leader of term %d with %d votes.\n", raft.CurrentTerm, votes)
+	core.LogLocal(core.EVENT_DECIDE, "leader "+strconv.Itoa(self.NodeId)+" term "+strconv.Itoa(raft.CurrentTerm))
+
+	for _, n := range neighbours {
+		nextIndex[n.Port] = len(raft.Log) + 1
+		matchIndex[n.Port] = 0
+	}
+
+	sendAppendEntries()
+	raftDeadline = time.Now().Add(heartbeatInterval)
+}
+
+// sendAppendEntries sends every follower the entries of the log it does not
+// have yet, or none as a heartbeat. It must be called on the event loop.
+func sendAppendEntries() {
+	for _, n := range neighbours {
+		prev := nextIndex[n.Port] - 1
+		entries := append([]logEntry{}, raft.Log[prev:]...)
+
+		sendRaft(n, raftMessage{
+			Kind:         APPEND_ENTRIES,
+			Term:         raft.CurrentTerm,
+			PrevLogIndex: prev,
+			PrevLogTerm:  termAt(prev),
+			Entries:      entries,
+			LeaderCommit: commitIndex,
+		})
+	}
+}
+
+// handleRaftMessage handles a Raft message on the event loop. A message of a
+// later term makes the current node a follower of that term first.
+func handleRaftMessage(msg message) {
+	r := msg.Raft
+	if r == nil {
+		return
+	}
+
+	if r.Term > raft.CurrentTerm {
+		becomeFollower(r.Term)
+	}
+
+	sender := node{NodeId: msg.NodeId, Host: msg.Host, Port: msg.Port}
+	switch r.Kind {
+	case REQUEST_VOTE:
+		receiveRequestVote(sender, r)
+	case VOTE:
+		if raftRole == ROLE_CANDIDATE && r.Term == raft.CurrentTerm && r.Granted {
+			raftVotes[msg.NodeId] = true
+			checkVotes()
+		}
+	case APPEND_ENTRIES:
+		receiveAppendEntries(sender, r)
+	case APPEND_REPLY:
+		receiveAppendReply(sender, r)
+	}
+}
+
+// receiveRequestVote grants the vote of the current term to the first
+// candidate whose log is at least as up to date as the log of the current
+// node.
+func receiveRequestVote(sender node, r *raftMessage) {
+	lastIndex, lastTerm := lastLog()
+	upToDate := r.LastLogTerm > lastTerm || (r.LastLogTerm == lastTerm && r.LastLogIndex >= lastIndex)
+
+	granted := false
+	if r.Term == raft.CurrentTerm && (raft.VotedFor == 0 || raft.VotedFor == sender.NodeId) && upToDate {
+		granted = true
+		raft.VotedFor = sender.NodeId
+		persistRaft()
+		resetElectionTimeout()
+		log.Printf("Voting for node %d in term %d.\n", sender.NodeId, r.Term)
+	}
+
+	sendRaft(sender, raftMessage{
+		Kind:    VOTE,
+		Term:    raft.CurrentTerm,
+		Granted: granted,
+	})
+}
+
+// receiveAppendEntries appends the entries of the leader to the log, after
+// checking that the log matches the log of the leader up to them, and commits
+// the entries the leader committed.
+func receiveAppendEntries(sender node, r *raftMessage) {
+	reply := raftMessage{Kind: APPEND_REPLY, Term: raft.CurrentTerm}
+	if r.Term < raft.CurrentTerm {
+		sendRaft(sender, reply)
+		return
+	}
+
+	becomeFollower(r.Term)
+	resetElectionTimeout()
+	if self.Leader != sender.NodeId {
+		self.Leader = sender.NodeId
+		leaderGauge(self.Leader)
+		log.Printf("Following leader %d in term %d.\n", self.Leader, raft.CurrentTerm)
+		core.LogLocal(core.EVENT_DECIDE, "leader "+strconv.Itoa(self.Leader)+" term "+strconv.Itoa(raft.CurrentTerm))
+	}
+
+	if r.PrevLogIndex > len(raft.Log) || termAt(r.PrevLogIndex) != r.PrevLogTerm {
+		reply.MatchIndex = len(raft.Log)
+		if reply.MatchIndex >= r.PrevLogIndex {
+			reply.MatchIndex = r.PrevLogIndex - 1
+		}
+		sendRaft(sender, reply)
+		return
+	}
+
+	// Entries that conflict with the entries of the leader are removed along
+	// with all that follow them.
+	changed := false
+	for idx, entry := range r.Entries {
+		index := r.PrevLogIndex + 1 + idx
+		if index <= len(raft.Log) && raft.Log[index-1].Term == entry.Term {
+			continue
+		}
+
+		raft.Log = append(raft.Log[:index-1], r.Entries[idx:]...)
+		changed = true
+		break
+	}
+	if changed {
+		persistRaft()
+	}
+
+	reply.Success = true
+	reply.MatchIndex = r.PrevLogIndex + len(r.Entries)
+	if r.LeaderCommit > commitIndex {
+		commitIndex = r.LeaderCommit
+		if commitIndex > reply.MatchIndex {
+			commitIndex = reply.MatchIndex
+		}
+		applyCommitted()
+	}
+
+	sendRaft(sender, reply)
+}
+
+// receiveAppendReply records how far the log of a follower matches the log of
+// the leader and commits the entries of the current term that a majority of
+// the cluster has.
+func receiveAppendReply(sender node, r *raftMessage) {
+	if raftRole != ROLE_LEADER || r.Term != raft.CurrentTerm {
+		return
+	}
+
+	if !r.Success {
+		nextIndex[sender.Port] = r.MatchIndex + 1
+		if nextIndex[sender.Port] < 1 {
+			nextIndex[sender.Port] = 1
+		}
+		return
+	}
+
+	if r.MatchIndex > matchIndex[sender.Port] {
+		matchIndex[sender.Port] = r.MatchIndex
+	}
+	nextIndex[sender.Port] = matchIndex[sender.Port] + 1
+
+	for index := len(raft.Log); index > commitIndex; index-- {
+		if termAt(index) != raft.CurrentTerm {
+			break
+		}
+
+		replicas := 1
+		for _, match := range matchIndex {
+			if match >= index {
+				replicas++
+			}
+		}
+
+		if replicas > (len(neighbours)+1)/2 {
+			commitIndex = index
+			applyCommitted()
+			break
+		}
+	}
+}
+
+// applyCommitted applies the committed entries that have not been applied yet
+// to the key/value store. It must be called on the event loop.
+func applyCommitted() {
+	for lastApplied < commitIndex {
+		lastApplied++
+		entry := raft.Log[lastApplied-1]
+
+		fields := strings.SplitN(entry.Command, " ", 3)
+		switch {
+		case fields[0] == "set" && len(fields) == 3:
+			kvStore[fields[1]] = fields[2]
+		case fields[0] == "delete" && len(fields) >= 2:
+			delete(kvStore, fields[1])
+		}
+		log.Printf("Applied %q at index %d.\n", entry.Command, lastApplied)
+
+		if c, ok := kvWaiting[lastApplied]; ok {
+			c <- entry
+			delete(kvWaiting, lastApplied)
+		}
+	}
+}
+
+// sendRaft sends the Raft message r to node recvAddr once.
+func sendRaft(recvAddr node, r raftMessage) {
+	kind := r.Kind
+	if (r.Kind == APPEND_ENTRIES && len(r.Entries) == 0) || (r.Kind == APPEND_REPLY && r.Success) {
+		kind = HEARTBEAT
+	}
+
+	msg := message{
+		NodeId:  self.NodeId,
+		Host:    self.Host,
+		Port:    self.Port,
+		Message: kind,
+		Raft:    &r,
+	}
+	sendMessageOnce(recvAddr, msg)
+}
+
+// propose appends command to the log of the leader and waits until it has been
+// applied. It returns an error if the current node is not the leader or if the
+// command was not committed within the timeout.
+func propose(command string, timeout time.Duration) error {
+	var err error
+	var index, term int
+	applied := make(chan logEntry, 1)
+	ran := core.Run(func() {
+		if raftRole != ROLE_LEADER {
+			err = fmt.Errorf("not the leader, the leader is node %d", self.Leader)
+			return
+		}
+
+		raft.Log = append(raft.Log, logEntry{Term: raft.CurrentTerm, Command: command})
+		persistRaft()
+		index, term = lastLog()
+
+		kvWaiting[index] = applied
+		sendAppendEntries()
+		raftDeadline = time.Now().Add(heartbeatInterval)
+	})
+	if !ran {
+		return fmt.Errorf("the node stopped")
+	}
+	if err != nil {
+		return err
+	}
+
+	select {
+	case entry := <-applied:
+		if entry.Term != term {
+			return fmt.Errorf("entry %d was replaced by a leader of term %d", index, entry.Term)
+		}
+		return nil
+	case <-time.After(timeout):
+		core.Run(func() { delete(kvWaiting, index) })
+		return fmt.Errorf("entry %d was not committed within %s", index, timeout)
+	}
+}
+
+// serveKV serves the key/value store over HTTP on addr. GET /kv/key returns
+// the value of key as applied on the current node, which may lag behind the
+// leader. PUT /kv/key sets key to the request body and DELETE /kv/key deletes
+// it, both only on the leader. An empty addr disables the endpoint.
+func serveKV(addr string) {
+	if addr == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/kv/", func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, "/kv/")
+		if key == "" || strings.Contains(key, " ") {
+			http.Error(w, "invalid key", http.StatusBadRequest)
+			return
+		}
+
+		var command string
+		switch r.Method {
+		case http.MethodGet:
+			var value string
+			var ok bool
+			if !core.Run(func() { value, ok = kvStore[key] }) {
+				http.Error(w, "the node stopped", http.StatusServiceUnavailable)
+				return
+			}
+
+			if !ok {
+				http.Error(w, "no such key", http.StatusNotFound)
+				return
+			}
+			fmt.Fprintln(w, value)
+			return
+		case http.MethodPut:
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			command = "set " + key + " " + strings.TrimSpace(string(body))
+		case http.MethodDelete:
+			command = "delete " + key
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err := propose(command, 5*time.Second); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "OK")
+	})
+
+	go func() {
+		log.Printf("Serving key/value store on http://%s/kv/\n", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Printf("Key/value listener stopped: %v\n", err)
+		}
+	}()
+}
@@ -0,0 +1,96 @@
+#! /bin/bash
+
+# Usage: ./raft.sh
+#
+# Runs Raft on the 5 fully connected nodes of the config/bully directory, writes
+# a key through the leader and checks that every node applied it, kills the
+# leader, writes another key through the new leader, restarts the old leader
+# and checks that it recovers both keys from its persisted log and the new
+# leader.
+
+set -u
+
+WAIT=${WAIT:-8}
+DIR=$(mktemp -d)
+PIDS=()
+
+cleanup() {
+    kill $(jobs -p) 2>/dev/null
+    wait 2>/dev/null
+}
+trap cleanup EXIT
+
+# leader prints the last digit of the port of the node that is the leader
+# according to the nodes given.
+leader() {
+    for n in "$@"; do
+        curl -s http://127.0.0.1:910$n/metrics | awk '/^node_leader / { print $2 / 10 }'
+    done | sort | uniq -c | sort -rn | awk 'NR == 1 && $2 != 0 { print $2 }'
+}
+
+# expect checks that key has value on all nodes given.
+expect() {
+    local key=$1
+    local want=$2
+    shift 2
+
+    for n in "$@"; do
+        got=$(curl -s http://127.0.0.1:930$n/kv/$key)
+        if [ "$got" != "$want" ]; then
+            echo "FAIL: node $n should have $key=$want, got: $got"
+            exit 1
+        fi
+    done
+    echo "OK: nodes $* have $key=$want."
+}
+
+# put sets key to value through the node given.
+put() {
+    if ! curl -sf -X PUT -d "$3" http://127.0.0.1:930$1/kv/$2 > /dev/null; then
+        echo "FAIL: could not set $2=$3 through node $1."
+        exit 1
+    fi
+    echo "OK: set $2=$3 through node $1."
+}
+
+# start starts the node given by the last digit of its port.
+start() {
+    $DIR/election -config config/bully/configFile_600$1.txt -algorithm raft -raft-dir $DIR \
+        -metrics 127.0.0.1:910$1 -kv 127.0.0.1:930$1 >> $DIR/node_600$1.log 2>&1 &
+    PIDS[$1]=$!
+}
+
+go build -o $DIR/election *.go || exit 1
+
+for n in 1 2 3 4 5; do
+    start $n
+done
+
+echo "Logs are in $DIR."
+
+sleep $WAIT
+first=$(leader 1 2 3 4 5)
+echo "OK: node $first is the leader."
+put $first x 1
+sleep 1
+expect x 1 1 2 3 4 5
+
+kill ${PIDS[$first]}
+others=$(echo 1 2 3 4 5 | tr ' ' '\n' | grep -v $first | tr '\n' ' ')
+sleep $WAIT
+second=$(leader $others)
+if [ -z "$second" ] || [ "$second" = "$first" ]; then
+    echo "FAIL: no new leader after node $first failed."
+    exit 1
+fi
+echo "OK: node $second is the new leader."
+put $second y 2
+sleep 1
+expect y 2 $others
+
+start $first
+sleep $WAIT
+expect x 1 1 2 3 4 5
+expect y 2 1 2 3 4 5
+
+echo "PASS"
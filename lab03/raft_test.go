@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+// TestDuplicatedVotesCountOnce delivers the vote of a single node three times
+// to a candidate of a cluster of five nodes, which needs the votes of two
+// other nodes to be elected.
+func TestDuplicatedVotesCountOnce(t *testing.T) {
+	neighbours = []node{{NodeId: 20}, {NodeId: 30}, {NodeId: 40}, {NodeId: 50}}
+	self = node{NodeId: 10}
+	raft = raftState{CurrentTerm: 3, VotedFor: self.NodeId}
+	raftRole = ROLE_CANDIDATE
+	raftVotes = make(map[int]bool)
+	defer func() {
+		neighbours = nil
+		self = node{}
+		raft = raftState{}
+		raftRole = ROLE_FOLLOWER
+	}()
+
+	vote := message{NodeId: 20, Message: VOTE, Raft: &raftMessage{Kind: VOTE, Term: 3, Granted: true}}
+	for i := 0; i < 3; i++ {
+		handleRaftMessage(vote)
+	}
+
+	if raftRole != ROLE_CANDIDATE {
+		t.Fatalf("elected with the votes of node 20 only, role %v", raftRole)
+	}
+	if len(raftVotes) != 1 {
+		t.Errorf("counted the votes of %d nodes, expected 1", len(raftVotes))
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"log"
+	"strconv"
+
+	"distributed-systems/core"
+)
+
+// Messages used by the ring elections. Chang-Roberts sends its candidates as
+// ELECTION messages and both algorithms announce the leader with ELECTED.
+const (
+	PROBE = "probe"
+	REPLY = "reply"
+)
+
+var ringParticipant bool // The current node sent a candidate of its own.
+var ringPhase int        // Current phase of the current node in Hirschberg-Sinclair.
+var ringReplies int      // Replies received in the current phase.
+var ringElected bool     // The current node has been elected.
+
+// next returns the clockwise neighbour of the current node, which is the first
+// neighbour in the config file.
+func next() node {
+	return neighbours[0]
+}
+
+// previous returns the anticlockwise neighbour of the current node, which is
+// the second neighbour in the config file.
+func previous() node {
+	return neighbours[1]
+}
+
+// other returns the neighbour on the other side of the ring from the neighbour
+// a message was received from, so that the message keeps its direction.
+func other(msg message) node {
+	if msg.Port == next().Port {
+		return previous()
+	}
+
+	return next()
+}
+
+// runRing runs one of the ring elections. The ring is given by the config
+// files, where the first neighbour of every node is the next node clockwise and
+// the second one the previous node. Initiators start the election, other nodes
+// join it when the first message reaches them.
+func runRing() {
+	if len(neighbours) != 2 {
+		panic("Ring election needs exactly two neighbours, the next and the previous node on the ring.")
+	}
+
+	log.Printf("Running %s election, next node is %s:%s, previous node is %s:%s.\n",
+		algorithm, next().Host, next().Port, previous().Host, previous().Port)
+
+	if self.IsInitiator {
+		startRing()
+	}
+}
+
+// startRing makes the current node a participant of the election. It must be
+// called on the event loop.
+func startRing() {
+	if ringParticipant {
+		return
+	}
+	ringParticipant = true
+	core.WaveStarted()
+	core.LogLocal(core.EVENT_STATE_CHANGE, "candidate "+strconv.Itoa(self.NodeId))
+
+	if algorithm == "chang-roberts" {
+		log.Printf("Sending candidate %d clockwise.\n", self.NodeId)
+		sendMessage(next(), message{
+			NodeId:  self.NodeId,
+			Host:    self.Host,
+			Port:    self.Port,
+			Message: ELECTION,
+			Leader:  self.NodeId,
+		})
+		return
+	}
+
+	startPhase(0)
+}
+
+// startPhase sends probes of phase to both neighbours, which travel 2^phase
+// hops unless a higher node swallows them. It must be called on the event
+// loop.
+func startPhase(phase int) {
+	ringPhase = phase
+	ringReplies = 0
+	log.Printf("Starting phase %d.\n", phase)
+
+	for _, n := range []node{next(), previous()} {
+		sendMessage(n, message{
+			NodeId:  self.NodeId,
+			Host:    self.Host,
+			Port:    self.Port,
+			Message: PROBE,
+			Leader:  self.NodeId,
+			Phase:   phase,
+			Hop:     1,
+		})
+	}
+}
+
+// handleRingMessage handles a message of the ring elections on the event loop.
+func handleRingMessage(msg message) {
+	switch msg.Message {
+	case ELECTION:
+		receiveCandidate(msg)
+	case PROBE:
+		receiveProbe(msg)
+	case REPLY:
+		receiveReply(msg)
+	case ELECTED:
+		receiveElectedRing(msg)
+	case TERMINATE:
+		receiveTerminateRing(msg)
+	}
+}
+
+// receiveCandidate handles a candidate of Chang-Roberts. Higher candidates are
+// forwarded, lower ones are swallowed and make a node that does not take part
+// yet send its own ID instead. A node that receives its own ID is elected.
+func receiveCandidate(msg message) {
+	switch {
+	case msg.Leader > self.NodeId:
+		ringParticipant = true
+		forward := msg
+		forward.NodeId, forward.Host, forward.Port = self.NodeId, self.Host, self.Port
+		sendMessage(next(), forward)
+	case msg.Leader < self.NodeId:
+		log.Printf("Swallowing candidate %d.\n", msg.Leader)
+		startRing()
+	default:
+		announceRingLeader()
+	}
+}
+
+// receiveProbe handles a probe of Hirschberg-Sinclair. Lower probes are
+// swallowed, higher ones are forwarded until they travelled 2^phase hops and
+// are then sent back as replies. A node that receives its own probe is
+// elected, since it went around the whole ring.
+func receiveProbe(msg message) {
+	if msg.Leader == self.NodeId {
+		// The probe coming round the other way is ignored.
+		if !ringElected {
+			announceRingLeader()
+		}
+		return
+	}
+
+	if msg.Leader < self.NodeId {
+		log.Printf("Swallowing probe of %d.\n", msg.Leader)
+		startRing()
+		return
+	}
+
+	ringParticipant = true
+	reply := msg
+	reply.NodeId, reply.Host, reply.Port = self.NodeId, self.Host, self.Port
+
+	if msg.Hop < 1<<msg.Phase {
+		reply.Hop++
+		sendMessage(other(msg), reply)
+		return
+	}
+
+	reply.Message = REPLY
+	sendMessage(node{Host: msg.Host, Port: msg.Port}, reply)
+}
+
+// receiveReply handles a reply of Hirschberg-Sinclair. Replies to other nodes
+// are sent on towards them, and a node that got the replies from both sides
+// starts its next phase.
+func receiveReply(msg message) {
+	if msg.Leader != self.NodeId {
+		forward := msg
+		forward.NodeId, forward.Host, forward.Port = self.NodeId, self.Host, self.Port
+		sendMessage(other(msg), forward)
+		return
+	}
+
+	if msg.Phase != ringPhase || ringElected {
+		return
+	}
+
+	ringReplies++
+	if ringReplies == 2 {
+		startPhase(ringPhase + 1)
+	}
+}
+
+// announceRingLeader sends the current node clockwise around the ring as the
+// elected leader. It must be called on the event loop.
+func announceRingLeader() {
+	if algorithm == "chang-roberts" {
+		log.Println("Elected.")
+	} else {
+		log.Printf("Elected in phase %d.\n", ringPhase)
+	}
+	ringElected = true
+	self.Leader = self.NodeId
+	leaderGauge(self.Leader)
+
+	sendMessage(next(), message{
+		NodeId:  self.NodeId,
+		Host:    self.Host,
+		Port:    self.Port,
+		Message: ELECTED,
+		Leader:  self.NodeId,
+	})
+}
+
+// receiveElectedRing records the elected leader and sends it on clockwise,
+// until it is back at the leader. The leader then starts detecting the
+// termination of the election.
+func receiveElectedRing(msg message) {
+	self.Leader = msg.Leader
+	leaderGauge(self.Leader)
+	core.WaveCompleted()
+	core.LogLocal(core.EVENT_DECIDE, "leader "+strconv.Itoa(self.Leader))
+
+	if msg.Leader != self.NodeId {
+		forward := msg
+		forward.NodeId, forward.Host, forward.Port = self.NodeId, self.Host, self.Port
+		sendMessage(next(), forward)
+		return
+	}
+
+	core.StartSafra()
+}
+
+// terminateRing is called by the leader once termination has been detected.
+// It sends the message to terminate clockwise around the ring.
+func terminateRing() {
+	sendMessage(next(), message{
+		NodeId:  self.NodeId,
+		Host:    self.Host,
+		Port:    self.Port,
+		Message: TERMINATE,
+		Leader:  self.Leader,
+	})
+}
+
+// receiveTerminateRing sends the message to terminate on clockwise, until it
+// is back at the leader, and stops the node as decided.
+func receiveTerminateRing(msg message) {
+	if !ringElected {
+		forward := msg
+		forward.NodeId, forward.Host, forward.Port = self.NodeId, self.Host, self.Port
+		sendMessage(next(), forward)
+	}
+
+	log.Println("Leader is:", self.Leader)
+	log.Println(core.Report())
+	core.Stop(core.EXIT_DECIDED)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"time"
+
+	"distributed-systems/core"
+)
+
+var persistent bool                    // Keep the leader running after the election.
+var following bool                     // The node follows a confirmed leader.
+var leaderId int                       // Leader confirmed in leaderTerm.
+var leaderTerm int                     // Term the current leader was confirmed in.
+var leaderBeat int                     // Highest heartbeat number of the leader seen.
+var leaderHeard time.Time              // Last time the leader was heard of or an election progressed.
+var leaderSince time.Time              // When the current node started to lead.
+var leaderMembers []member             // Membership confirmed for the current leader.
+var beatAcks = make(map[int]int)       // Highest heartbeat number seen by each node.
+var beatSent = make(map[int]time.Time) // When the current node sent its heartbeats as leader.
+
+// setupService prepares the persistent leader service if it was requested.
+// Every neighbour is reachable until it has been silent for longer than the
+// suspect timeout.
+func setupService() {
+	if !persistent {
+		return
+	}
+
+	log.Println("Running persistent leader service.")
+
+	leaderHeard = time.Now()
+	for _, n := range neighbours {
+		lastHeard[n.Port] = time.Now()
+		reachable[n.Port] = true
+	}
+}
+
+// runService runs the persistent leader service. Every node sends a heartbeat
+// to its neighbours every heartbeat interval, carrying the leader it follows,
+// the term the leader was confirmed in, the highest heartbeat number of the
+// leader it has seen and the highest heartbeat numbers seen by the other nodes.
+// The leader increases its heartbeat number with every heartbeat, so the
+// heartbeat numbers spread through the network like gossip and their
+// acknowledgements spread back to the leader. A neighbour that stays silent
+// for longer than the suspect timeout is left out of elections, and when the
+// heartbeat number of the leader stops increasing for as long, the node starts
+// the election of the next term.
+func runService() {
+	leaderHeard = time.Now() // Neighbours may have taken long to come up.
+
+	core.Every(heartbeatInterval, sendHeartbeats)
+}
+
+// sendHeartbeats sends a heartbeat to every neighbour, records which
+// neighbours are reachable and starts the election of the next term if the
+// lease lapsed or the leader failed.
+func sendHeartbeats() {
+	leading := following && leaderId == self.NodeId
+	if leading {
+		leaderBeat++
+		leaderHeard = time.Now()
+		beatSent[leaderBeat] = leaderHeard
+		beatAcks[self.NodeId] = leaderBeat
+	}
+
+	for _, n := range neighbours {
+		up := time.Since(lastHeard[n.Port]) < suspectTimeout
+		if up != reachable[n.Port] {
+			if up {
+				log.Printf("Neighbour %s:%s is reachable.\n", n.Host, n.Port)
+			} else {
+				log.Printf("Neighbour %s:%s is unreachable.\n", n.Host, n.Port)
+			}
+			reachable[n.Port] = up
+		}
+
+		// The acknowledgements are copied, since the message may be
+		// delivered after the event loop moved on.
+		acks := make(map[int]int, len(beatAcks))
+		for id, beat := range beatAcks {
+			acks[id] = beat
+		}
+
+		msg := message{
+			NodeId:  self.NodeId,
+			Host:    self.Host,
+			Port:    self.Port,
+			Message: HEARTBEAT,
+			Leader:  leaderId,
+			Term:    leaderTerm,
+			Beat:    leaderBeat,
+			Members: leaderMembers,
+			Acks:    acks,
+		}
+		sendMessage(n, msg)
+	}
+
+	if leading && leaseLapsed() {
+		// A member stopped acknowledging the heartbeats, so the lease can
+		// only be renewed with the membership of a new election.
+		log.Printf("Lease lapsed, initiating wave of node %d in term %d.\n", self.NodeId, term+1)
+		joinWave(term+1, self.NodeId, message{})
+	}
+
+	if !leading && time.Since(leaderHeard) > suspectTimeout {
+		if following {
+			log.Printf("Leader %d of term %d failed.\n", leaderId, leaderTerm)
+		} else {
+			log.Printf("Election of term %d did not complete.\n", term)
+		}
+
+		log.Printf("Initiating wave of node %d in term %d.\n", self.NodeId, term+1)
+		joinWave(term+1, self.NodeId, message{})
+	}
+
+	publishLease()
+}
+
+// handleHeartbeat handles a heartbeat of a neighbour. A leader confirmed in a
+// later term than the one the current node follows is adopted once the current
+// node no longer follows a live leader, and a leader steps down right away. A
+// higher heartbeat number of the current leader shows that it is still alive.
+func handleHeartbeat(msg message) {
+	lastHeard[msg.Port] = time.Now()
+
+	if msg.Term > leaderTerm && (leaderId == self.NodeId || !leaderAlive()) {
+		// The election of the term completed without the current node.
+		waveDone = true
+		followLeader(msg.Leader, msg.Term)
+	}
+
+	if !following || msg.Term != leaderTerm || msg.Leader != leaderId {
+		return
+	}
+
+	if msg.Beat > leaderBeat {
+		leaderBeat = msg.Beat
+		leaderHeard = time.Now()
+		beatAcks[self.NodeId] = leaderBeat
+	}
+
+	for id, beat := range msg.Acks {
+		if beat > beatAcks[id] {
+			beatAcks[id] = beat
+		}
+	}
+
+	if len(leaderMembers) == 0 {
+		leaderMembers = msg.Members
+	}
+}
+
+// followLeader makes the current node follow leader, confirmed in term t. It
+// must be called on the event loop.
+func followLeader(leader int, t int) {
+	if following && leaderId == self.NodeId && leader != self.NodeId {
+		log.Printf("Stepping down, node %d is leader in term %d.\n", leader, t)
+	}
+
+	if t > term {
+		term = t
+		termGauge(term)
+	}
+
+	following = true
+	leaderId = leader
+	leaderTerm = t
+	leaderBeat = 0
+	leaderHeard = time.Now()
+	leaderSince = leaderHeard
+	leaderMembers = nil
+	beatAcks = map[int]int{self.NodeId: 0}
+	beatSent = make(map[int]time.Time)
+
+	self.Leader = leader
+	leaderGauge(self.Leader)
+
+	if leader == self.NodeId {
+		log.Printf("Leading in term %d.\n", t)
+	} else {
+		log.Printf("Following leader %d in term %d.\n", leader, t)
+	}
+	core.LogLocal(core.EVENT_DECIDE, "leader "+strconv.Itoa(leader)+" term "+strconv.Itoa(t))
+	publishLease()
+}
+
+// leaderAlive reports whether the current node follows a leader it heard of
+// within the suspect timeout. Such a node has promised the leader not to take
+// part in any other election. It must be called on the event loop.
+func leaderAlive() bool {
+	return following && time.Since(leaderHeard) < suspectTimeout
+}
+
+// isUp reports whether neighbour n takes part in elections. Outside of the
+// persistent leader service every neighbour does.
+func isUp(n node) bool {
+	return !persistent || reachable[n.Port]
+}
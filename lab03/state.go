@@ -0,0 +1,18 @@
+package main
+
+// localState is the state of the current node recorded in a snapshot and
+// logged when it stops.
+type localState struct {
+	Self       node
+	Neighbours []node
+	Leader     int
+}
+
+// currentState returns the local state of the current node.
+func currentState() localState {
+	return localState{
+		Self:       self,
+		Neighbours: append([]node(nil), neighbours...),
+		Leader:     self.Leader,
+	}
+}
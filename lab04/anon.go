@@ -2,64 +2,88 @@ package main
 
 import (
 	"bufio"
-	"encoding/gob"
+	crand "crypto/rand"
+	"encoding/binary"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"math/rand"
-	"net"
-	"os"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
+
+	"distributed-systems/anon"
+	"distributed-systems/core"
 )
 
 // TERMINATE is a special message that is sent to terminate a child node.
+// DONE acknowledges the leader announcement once a node and its subtree know
+// the leader and have delivered all their messages.
 const (
-	TERMINATE = "#TERMINATE#"
+	TERMINATE = anon.TERMINATE
+	DONE      = anon.DONE
 )
 
 // message is used to send payloads from one node to another.
 // messages carry ID of the sender node, Host (IP) of the sender, Port of the
-// sender and a string Message.
+// sender and a string Message, along with the Leader, Round and Size of the
+// wave, the Lamport Clock of the sender when the message was sent, the ID of
+// the Snapshot a marker belongs to, the place of the message on its Channel,
+// the Nonce of a partition aware election wave, the Hop count and Bit of a
+// token of the ring election, the Mins of the exponential samples used to
+// estimate the size of the network and the Safra token of the termination
+// detection.
 type message struct {
-	Host    string
-	Port    string
-	Message string
-	Leader  int
-	Round   int
-	Size    int
+	Host     string
+	Port     string
+	Message  string
+	Leader   int
+	Round    int
+	Size     int
+	Clock    int
+	Snapshot string
+	Channel  *core.ChannelSeq
+	Nonce    int
+	Hop      int
+	Bit      bool
+	Mins     []float64
+	Safra    *core.SafraToken
 }
 
 // node represents details pertaining to different nodes in the network graph.
-// NodeId is the ID of a node, Host is the IP address, Port is the port used,
-// IsInitiator indicates if a node is an initiator, HaveSent and HasReplied are
-// used to track whether nodes have sent and replied to messages, ParentMessage
-// is used to keep track of the parent of a node.
+// Host is the IP address, Port is the port used, Socket is the path of its
+// Unix socket, IsInitiator indicates if a node is an initiator and
+// ParentMessage is the message of the parent of a node in the current wave. The
+// rest of the state of a wave is kept in currentWave.
 type node struct {
-	Size          int
 	Host          string
 	Port          string
+	Socket        string
 	IsInitiator   bool
-	HaveSent      bool
-	HasReplied    bool
 	ParentMessage message
 }
 
-var neighbours []node    // Neighbours of the current node.
-var self node            // Current node (self)
-var selfMutex sync.Mutex // Mutex to manage access to member of self.
-var hasInitiated bool    // Track if initiation message has been sent.
-var roundNumber int      // Track round numbers.
-var leader int           // Leader.
-var randomId int         // Random ID.
-var status bool          // Current status of node.
-var numNodes int         // Size of the network.
+var neighbours []node // Neighbours of the current node.
+var self node         // Current node (self)
+var roundNumber int   // Track round numbers.
+var leader int        // Leader.
+var randomId int      // Random ID.
+var status bool       // The current node initiated the current wave.
+var numNodes int      // Size of the network.
+var idRand *rand.Rand // Source of the random IDs of the current node.
 
 func main() {
 	// Setup and parse CLI flags.
 	configFile := flag.String("config", "this is not a path", "Path to config file.")
+	seed := flag.Int64("seed", 0, "Seed for the random IDs of the node, 0 to seed from the system.")
+	core.RegisterFlags()
+	flag.BoolVar(&partitionAware, "partition-aware", false, "Keep running and elect a leader per connected component.")
+	flag.BoolVar(&ringElection, "ring", false, "Run the Itai-Rodeh election on a unidirectional ring.")
+	flag.DurationVar(&heartbeatInterval, "heartbeat", 500*time.Millisecond, "Interval between heartbeats of the partition aware election.")
+	flag.StringVar(&sizeMode, "size", "config", "How to learn the network size: config, count or exponential.")
+	flag.IntVar(&sizeSamples, "size-samples", 64, "Number of exponential samples per node with -size exponential.")
+	flag.DurationVar(&suspectTimeout, "suspect-timeout", 2*time.Second, "Silence after which a neighbour is considered unreachable.")
 	flag.Parse()
 
 	// Check if a config file has been passed as a flag.
@@ -71,290 +95,273 @@ func main() {
 
 	addresses := parseConfig(*configFile)
 
-	self = addresses[0]        // Populate current node.
-	neighbours = addresses[1:] // Populate neighbours.
-	hasInitiated := false
-
-	go listener() // Run goroutine to listen for messages.
-
-	// Main event loop.
-	if allNeighboursUp() {
-		// If all neighbours are up then proceed with main event loop.
-		shouldExit := false
-
-		for {
-			// Initiate communication from initiator node.
-			if self.IsInitiator && !hasInitiated {
-				// Send ping message to neighbours.
-				roundNumber = 0
-
-				msg := message{
-					Host:    self.Host,
-					Port:    self.Port,
-					Message: "ping",
-					Leader:  leader,
-					Round:   roundNumber,
-					Size:    0,
-				}
-
-				sendMessageToAllNeighbours(msg)
-				hasInitiated = true
-			} else {
-				time.Sleep(3 * time.Second)
-
-				size := computeSize()
-
-				if status {
-					if size == numNodes {
-						// Done!
-						log.Println("Done.")
-
-						shouldExit = true
-					} else {
-						if allNeighboursReplied() {
-							roundNumber = roundNumber + 1
-							randomId = getRandomId()
-							leader = randomId
-
-							log.Println("New ID is: ", leader)
-
-							msg := message{
-								Host:    self.Host,
-								Port:    self.Port,
-								Message: "ping",
-								Leader:  leader,
-								Round:   roundNumber,
-								Size:    0,
-							}
-
-							resetActivities()
-							sendMessageToAllNeighbours(msg)
-						}
-					}
-				} else {
-					if allNeighboursReplied() {
-						msg := message{
-							Host:    self.Host,
-							Port:    self.Port,
-							Message: "pong",
-							Leader:  leader,
-							Round:   roundNumber,
-							Size:    size,
-						}
-
-						parent := node{
-							Host: self.ParentMessage.Host,
-							Port: self.ParentMessage.Port,
-						}
-
-						log.Printf("Network size: %d, Detected size: %d.\n", numNodes, size)
-						sendMessage(parent, msg)
-						resetActivities()
-					}
-				}
-			}
+	self = addresses[0]             // Populate current node.
+	neighbours = addresses[1:]      // Populate neighbours.
+	peers := peersOf(addresses[1:]) // Dialled while the event loop owns neighbours.
 
-			if shouldExit {
-				log.Println("I was elected leader.")
-				log.Printf("Detected network size is: %d, should be: %d.\n", computeSize(), numNodes)
+	setupRandom(*seed)
+	setupSize()
+	ports := make([]string, 0)
+	for _, n := range neighbours {
+		ports = append(ports, n.Port)
+	}
+	electionNode = anon.NewNode(self.Port, ports, network{})
+	electionNode.Log = log.Default()
+	if numNodes > 0 {
+		randomId = getRandomId()
+		leader = randomId
+		log.Println("Random ID is: ", randomId)
+		setLeaderMetrics(leader, roundNumber)
+	}
 
-				terminateNeighbours()
-			}
-		}
+	core.Setup(election(), self.peer(), peers) // Run the election over the network.
+	defer core.WaitForShutdown()               // Let shutdown exit once the node stopped.
+	core.LogLocal(core.EVENT_STATE_CHANGE, fmt.Sprintf("round %d leader %d", roundNumber, leader))
+
+	setupTermination() // Detect the end of the election.
+	core.Start()       // Listen for messages and handle them on the event loop.
+
+	if partitionAware {
+		core.Run(runPartitionAware)
+		return
 	}
-}
 
-func resetActivities() {
-	for nid := 0; nid < len(neighbours); nid++ {
-		neighbours[nid].HaveSent = false
-		neighbours[nid].HasReplied = false
-		neighbours[nid].Size = 0
+	// Once all neighbours are up and the size of the network is known the
+	// initiators start the first round. The rest of the election is driven by
+	// the messages handled on the event loop, which terminates the node once
+	// all nodes know the leader.
+	if !core.WaitForPeers(peers) || !core.Run(learnSize) || !waitForSize() {
+		return
 	}
 
-	hasInitiated = false
-}
+	if ringElection {
+		core.Run(runRing)
+		return
+	}
 
-func getRandomId() int {
-	rand.Seed(time.Now().UnixNano())
-	return rand.Intn(numNodes) + 1
+	core.Run(func() {
+		if self.IsInitiator {
+			electionNode.Initiate()
+		}
+	})
 }
 
-func computeSize() int {
-	size := 0
-
-	for _, node := range neighbours {
-		if self.ParentMessage.Port != node.Port {
-			size += node.Size
+// setupRandom seeds the random source the IDs of the current node are drawn
+// from. Every node gets its own stream, so nodes started at the same time do
+// not draw the same IDs. A seed of 0 seeds the stream from the system's
+// random source, any other seed is combined with the port of the node so that
+// runs can be repeated.
+func setupRandom(seed int64) {
+	if seed == 0 {
+		var b [8]byte
+		if _, err := crand.Read(b[:]); err != nil {
+			panic("Error seeding random IDs: " + err.Error())
 		}
+		seed = int64(binary.LittleEndian.Uint64(b[:]))
+	} else {
+		port, _ := strconv.Atoi(self.Port)
+		seed += int64(port)
 	}
 
-	return size + 1
+	idRand = rand.New(rand.NewSource(seed))
 }
 
-// listener listens for incoming connections.
-func listener() {
-	l, _ := net.Listen("tcp", self.Host+":"+self.Port)
-	defer l.Close()
+// getRandomId draws a random ID between 1 and the size of the network. It must
+// be called on the event loop.
+func getRandomId() int {
+	return idRand.Intn(numNodes) + 1
+}
 
-	log.Printf("Listening on %s:%s\n", self.Host, self.Port)
+// electionNode is the current node in the anonymous election, whose handlers
+// are shared with the simulator of anonsim.
+var electionNode *anon.Node
 
-	for {
-		conn, _ := l.Accept()
+// network runs the anonymous election of the current node over the core and
+// keeps the state, metrics and events of lab04 up to date with it.
+type network struct{}
 
-		decoder := gob.NewDecoder(conn)
-		var payloadData message
-		err := decoder.Decode(&payloadData)
-		if err != nil {
-			// If there is an error, skip the message.
-			continue
+// neighbour returns the neighbour with port.
+func neighbour(port string) node {
+	for _, n := range neighbours {
+		if n.Port == port {
+			return n
 		}
+	}
 
-		log.Printf("Received message from %s:%s.\n", payloadData.Host, payloadData.Port)
-		log.Printf("Round is %d, payload round is %d.", roundNumber, payloadData.Round)
-		log.Printf("Leader is %d, payload leader is %d.", leader, payloadData.Leader)
+	panic("Unknown neighbour " + port + ".")
+}
 
-		// Message to terminate received from parent.
-		if payloadData.Message == TERMINATE {
-			terminateNeighbours()
-		}
+// Send sends msg to the neighbour with port to.
+func (network) Send(to string, msg anon.Message) {
+	sendMessage(neighbour(to), message{
+		Host:    self.Host,
+		Port:    self.Port,
+		Message: msg.Kind,
+		Leader:  msg.Leader,
+		Round:   msg.Round,
+		Size:    msg.Size,
+	})
+}
 
-		// Invalid message.
-		if payloadData.Host == "" || payloadData.Port == "" || payloadData.Leader == 0 {
-			log.Printf("Message from %s:%s was INVALID.\n", payloadData.Host, payloadData.Port)
-			continue
-		}
+// RandomId draws the random ID of a new round.
+func (network) RandomId() int {
+	randomId = getRandomId()
+	return randomId
+}
 
-		var id int
-		for nid, n := range neighbours {
-			if n.Port == payloadData.Port {
-				id = nid
-				break
-			}
-		}
+// ReachedAll reports whether a wave that reached size nodes reached the whole
+// network.
+func (network) ReachedAll(size int) bool {
+	return reachedAll(size)
+}
 
-		if payloadData.Message == "pong" && neighbours[id].HaveSent {
-			log.Printf("Received reply from %s:%s.\n", payloadData.Host, payloadData.Port)
-			neighbours[id].HasReplied = true
-			neighbours[id].Size = payloadData.Size
-		} else {
-			if payloadData.Round > roundNumber || (payloadData.Round == roundNumber && payloadData.Leader > leader) {
-				log.Printf("Selecting %d as leader.", payloadData.Leader)
-				status = false
-				resetActivities()
-
-				neighbours[id].HasReplied = true
-				leader = payloadData.Leader
-				roundNumber = payloadData.Round
-
-				self.ParentMessage = payloadData
-
-				msg := message{
-					Host:    self.Host,
-					Port:    self.Port,
-					Message: "ping",
-					Leader:  leader,
-					Round:   roundNumber,
-					Size:    0,
-				}
-
-				sendMessageToAllNeighbours(msg)
-			}
+// Joined records the wave the current node started or joined.
+func (network) Joined(w anon.Wave) {
+	leader = w.Id
+	roundNumber = w.Round
+	status = w.Parent == ""
+	setLeaderMetrics(leader, roundNumber)
+	core.WaveStarted()
+
+	if status {
+		self.ParentMessage = message{}
+		core.LogLocal(core.EVENT_STATE_CHANGE, fmt.Sprintf("round %d leader %d", roundNumber, leader))
+		return
+	}
 
-			if payloadData.Round < roundNumber || (payloadData.Round == roundNumber && payloadData.Leader < leader) {
-				log.Printf("Ignoring message from %s:%s. Current leader is: %d.\n", payloadData.Host, payloadData.Port, leader)
-			}
+	parent := neighbour(w.Parent)
+	self.ParentMessage = message{Host: parent.Host, Port: parent.Port, Message: anon.PING, Leader: w.Id, Round: w.Round}
+	core.LogLocal(core.EVENT_STATE_CHANGE, fmt.Sprintf("round %d leader %d parent %s:%s", roundNumber, leader, parent.Host, parent.Port))
+}
 
-			if payloadData.Round == roundNumber && payloadData.Leader == leader {
-				log.Printf("Leader %d remains unchanged.\n", leader)
-				neighbours[id].HasReplied = true
-				neighbours[id].Size = payloadData.Size
-			}
-		}
+// Completed records that all neighbours replied to the wave w.
+func (network) Completed(w anon.Wave) {
+	core.WaveCompleted()
+
+	if w.Parent != "" {
+		log.Printf("Network size: %d, Detected size: %d.\n", numNodes, w.Size)
 	}
 }
 
-// terminateNeighbours send messages to non parent neighbours of node to
-// terminate.
-func terminateNeighbours() {
-	for _, n := range neighbours {
-		msg := message{
-			Host:    self.Host,
-			Port:    self.Port,
-			Message: TERMINATE,
-			Leader:  leader,
+// Decided records the leader announced by msg.
+func (network) Decided(msg anon.Message) {
+	leader = msg.Leader
+	roundNumber = msg.Round
+	status = msg.From == self.Port
+	setLeaderMetrics(leader, roundNumber)
+
+	if status {
+		if sizeMode != "exponential" && msg.Size > numNodes {
+			log.Printf("Wave of ID %d reached %d nodes, more than the network size %d.\n", msg.Leader, msg.Size, numNodes)
 		}
-		sendMessage(n, msg)
+
+		log.Println("I was elected leader.")
+		log.Printf("Detected network size is: %d, should be: %d.\n", msg.Size, numNodes)
 	}
 
-	log.Printf("I am : %d, leader is %d.\n", randomId, leader)
-	log.Println("Sleeping for 3 seconds before terminating.")
-	time.Sleep(3 * time.Second)
+	log.Printf("Leader is %d (round %d, size %d).\n", msg.Leader, msg.Round, msg.Size)
+	core.LogLocal(core.EVENT_DECIDE, fmt.Sprintf("round %d leader %d", roundNumber, leader))
+}
 
-	os.Exit(0)
+// Announced starts detecting the termination of the election along the tree of
+// the announcement once all nodes know the leader.
+func (network) Announced(size int) {
+	core.StartSafra()
 }
 
-// allNeighboursUp checks if all neighbours can be reached if not, it will
-// block till all neighbours are up.
-func allNeighboursUp() bool {
-	for _, addr := range neighbours {
-		for {
-			log.Printf("Trying to dial %s:%s\n", addr.Host, addr.Port)
-			conn, err := net.Dial("tcp", addr.Host+":"+addr.Port)
-
-			if err == nil {
-				conn.Close()
-				log.Printf("Successfully dialled %s:%s\n", addr.Host, addr.Port)
-				break
-			}
+// Terminated stops the node as decided.
+func (network) Terminated() {
+	log.Printf("I am : %d, leader is %d.\n", randomId, leader)
+	core.Stop(core.EXIT_DECIDED)
+}
 
-			time.Sleep(1 * time.Second)
-		}
+// handleElectionMessage handles a message of the anonymous election on the
+// event loop.
+func handleElectionMessage(msg message) {
+	electionNode.Handle(anon.Message{
+		From:   msg.Port,
+		Kind:   msg.Message,
+		Leader: msg.Leader,
+		Round:  msg.Round,
+		Size:   msg.Size,
+	})
+}
+
+// setupTermination detects the end of the election with Safra's algorithm,
+// whose token walks the tree of the announcement or goes around the ring. The
+// partition aware election keeps running instead.
+func setupTermination() {
+	switch {
+	case partitionAware:
+		return
+	case ringElection:
+		core.SetupSafra(core.RingRoute(func() core.Peer { return neighbours[0].peer() }), terminateRing)
+		return
 	}
 
-	return true
+	core.SetupSafra(core.TreeRoute(announceParent, announceTree), electionNode.Terminate)
 }
 
-// allNeighboursReplied checks if all neighbours have replied to a node.
-func allNeighboursReplied() bool {
-	allReplied := true
-	for _, addr := range neighbours {
-		selfMutex.Lock()
-		if self.ParentMessage.Port != addr.Port && !addr.HasReplied {
-			allReplied = false
-		}
-		selfMutex.Unlock()
+// announceParent returns the parent of the current node in the tree of the
+// announcement, the zero peer on the leader.
+func announceParent() core.Peer {
+	if electionNode.AnnounceParent == "" {
+		return core.Peer{}
 	}
 
-	return allReplied
+	return neighbour(electionNode.AnnounceParent).peer()
 }
 
-func sendMessageToAllNeighbours(msg message) {
-	for idx, recvAddr := range neighbours {
-		sendMessage(recvAddr, msg)
-		neighbours[idx].HaveSent = true
+// announceTree returns the children of the current node in the tree of the
+// announcement, in the order of the config file.
+func announceTree() []core.Peer {
+	children := make([]core.Peer, 0)
+	for _, port := range electionNode.Children() {
+		children = append(children, neighbour(port).peer())
 	}
+
+	return children
 }
 
-// sendMessage sends msg of type message to node recvAddr. Retries sending
-// indefinitely.
-func sendMessage(recvAddr node, msg message) {
-	log.Printf("Sending %s to %s:%s.\n", msg.Message, recvAddr.Host, recvAddr.Port)
-	for {
-		conn, err := net.Dial("tcp", recvAddr.Host+":"+recvAddr.Port)
-
-		if err == nil {
-			encoder := gob.NewEncoder(conn)
-			if err := encoder.Encode(msg); err != nil {
-				log.Fatal(err)
-			}
+// handleMessage handles a message of the election on the event loop. Snapshot
+// markers and the signals and tokens of the termination detection never get
+// here, the core handles them.
+func handleMessage(msg message) {
+	if msg.Message != HEARTBEAT {
+		log.Printf("Received message from %s:%s.\n", msg.Host, msg.Port)
+		log.Printf("Round is %d, payload round is %d.", roundNumber, msg.Round)
+		log.Printf("Leader is %d, payload leader is %d.", leader, msg.Leader)
+	}
 
-			conn.Close()
-			break
-		}
+	if partitionAware {
+		handlePartitionMessage(msg)
+		return
+	}
+
+	switch msg.Message {
+	case COUNT, COUNTED, SIZE, MINS:
+		handleSizeMessage(msg)
+		return
+	}
 
-		time.Sleep(1 * time.Second)
+	if ringElection {
+		handleRingMessage(msg)
+		return
+	}
+
+	// Hold back the election until the size of the network is known.
+	select {
+	case <-sizeLearned:
+		handleElectionMessage(msg)
+	default:
+		heldBack = append(heldBack, msg)
 	}
-	log.Printf("Sent %s to %s:%s.\n", msg.Message, recvAddr.Host, recvAddr.Port)
+}
+
+// sendMessage sends msg of type message to node recvAddr, subject to the
+// injected faults. Retries sending until it is delivered.
+func sendMessage(recvAddr node, msg message) {
+	core.Send(recvAddr.peer(), msg)
 }
 
 // parseConfig parses config file.
@@ -372,7 +379,12 @@ func parseConfig(configFile string) []node {
 	addresses := make([]node, 0)
 
 	for scanner.Scan() {
-		line := strings.Split(scanner.Text(), ":")
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		line := strings.Split(fields[0], ":")
 		host := line[0]
 		port := line[1]
 
@@ -381,6 +393,11 @@ func parseConfig(configFile string) []node {
 			Port: port,
 		}
 
+		// The path of the Unix socket of the node may follow its address.
+		if len(fields) > 1 {
+			addr.Socket = fields[1]
+		}
+
 		if len(line) == 4 || len(line) == 3 {
 			numNodes, _ = strconv.Atoi(line[2])
 
@@ -388,13 +405,11 @@ func parseConfig(configFile string) []node {
 				// Node is an initiator.
 				log.Printf("Initiator node (%s:%s)\n", addr.Host, addr.Port)
 				addr.IsInitiator = true
-				status = true
 				addresses = append(addresses, addr)
 			} else {
 				// Node is not an initiator.
 				log.Printf("Non-initiator node (%s:%s)\n", addr.Host, addr.Port)
 				addresses = append(addresses, addr)
-				status = false
 			}
 
 		} else if len(line) == 2 {
@@ -402,9 +417,5 @@ func parseConfig(configFile string) []node {
 		}
 	}
 
-	randomId = getRandomId()
-	leader = randomId
-	log.Println("Random ID is: ", randomId)
-
 	return addresses
 }
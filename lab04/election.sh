@@ -0,0 +1,50 @@
+#! /bin/bash
+
+# Usage: ./election.sh [runs] [flags...]
+#
+# Runs the anonymous election on the 5 nodes of the config directory the given
+# number of times (10 by default), passing any further flags such as fault
+# injection flags to every node, and checks that in every run all nodes decide
+# on the same leader, that its wave reached all nodes and that every node exits
+# cleanly. The number of rounds and ties of every run is printed.
+
+set -u
+
+RUNS=${1:-10}
+shift
+DIR=$(mktemp -d)
+
+cleanup() {
+    kill $(jobs -p) 2>/dev/null
+    wait 2>/dev/null
+}
+trap cleanup EXIT
+
+go build -o $DIR/anon *.go || exit 1
+echo "Logs are in $DIR."
+
+for run in $(seq $RUNS); do
+    for n in 1 2 3 4 5; do
+        (timeout 120 $DIR/anon -config config/configFile_600$n.txt "$@" > $DIR/run_${run}_600$n.log 2>&1
+         echo "exit $?" >> $DIR/run_${run}_600$n.log) &
+    done
+    wait
+
+    decided=$(grep -h "Leader is [0-9]* (" $DIR/run_${run}_600*.log | sed "s/.*Leader is //; s/\.$//" | sort -u)
+    if [ $(echo "$decided" | wc -l) -ne 1 ] || [ $(grep -h "Leader is [0-9]* (" $DIR/run_${run}_600*.log | wc -l) -ne 5 ] \
+        || ! echo "$decided" | grep -q "size 5)"; then
+        echo "FAIL: run $run, nodes should agree on a leader of 5 nodes, got:"
+        grep -H "Leader is [0-9]* (" $DIR/run_${run}_600*.log
+        exit 1
+    fi
+
+    if [ "$(grep -h '^exit' $DIR/run_${run}_600*.log | sort -u)" != "exit 0" ]; then
+        echo "FAIL: run $run, not all nodes terminated cleanly."
+        exit 1
+    fi
+
+    ties=$(grep -h "Tie in round" $DIR/run_${run}_600*.log | wc -l)
+    echo "OK: run $run, leader $decided after $ties ties."
+done
+
+echo "PASS"
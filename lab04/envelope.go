@@ -0,0 +1,113 @@
+package main
+
+import "distributed-systems/core"
+
+// PROTOCOL_VERSION is the version of the messages exchanged by the nodes. It
+// has to be raised whenever the fields of a message or their meaning change,
+// so that nodes of different versions reject each other's messages.
+const PROTOCOL_VERSION = 4
+
+// Kinds of the messages of the election.
+const (
+	TYPE_PING core.MessageType = core.TYPE_PROTOCOL + iota
+	TYPE_PONG
+	TYPE_ELECTED
+	TYPE_DONE
+	TYPE_TERMINATE
+	TYPE_HEARTBEAT
+	TYPE_WAVE
+	TYPE_ECHO
+	TYPE_TOKEN
+	TYPE_COUNT
+	TYPE_COUNTED
+	TYPE_SIZE
+	TYPE_MINS
+)
+
+// messageTypes maps the Message of a message to its kind.
+var messageTypes = map[string]core.MessageType{
+	"ping":    TYPE_PING,
+	"pong":    TYPE_PONG,
+	ELECTED:   TYPE_ELECTED,
+	DONE:      TYPE_DONE,
+	TERMINATE: TYPE_TERMINATE,
+	HEARTBEAT: TYPE_HEARTBEAT,
+	WAVE:      TYPE_WAVE,
+	ECHO:      TYPE_ECHO,
+	TOKEN:     TYPE_TOKEN,
+	COUNT:     TYPE_COUNT,
+	COUNTED:   TYPE_COUNTED,
+	SIZE:      TYPE_SIZE,
+	MINS:      TYPE_MINS,
+}
+
+// protocolName returns the name of the election the current node runs. Nodes
+// only accept messages of the same election, so that for example a node with
+// an estimated network size does not take part in the waves of nodes that
+// read it from their config file.
+func protocolName() string {
+	switch {
+	case partitionAware:
+		return "anonymous/partition-aware"
+	case ringElection:
+		return "anonymous/ring"
+	case sizeMode != "config":
+		return "anonymous/size-" + sizeMode
+	}
+
+	return "anonymous"
+}
+
+// election describes the election to the core. TERMINATE and the heartbeats
+// are not part of the election whose termination is detected.
+func election() core.Protocol[message] {
+	return core.Protocol[message]{
+		Name:    protocolName(),
+		Version: PROTOCOL_VERSION,
+		Types:   messageTypes,
+		Control: []string{TERMINATE, HEARTBEAT},
+		Quiet:   []string{HEARTBEAT},
+		Handle:  handleMessage,
+		State:   func() any { return currentState() },
+	}
+}
+
+// Header returns the fields of msg that every protocol shares.
+func (msg message) Header() core.Header {
+	return core.Header{
+		Host:     msg.Host,
+		Port:     msg.Port,
+		Kind:     msg.Message,
+		Clock:    msg.Clock,
+		Snapshot: msg.Snapshot,
+		Channel:  msg.Channel,
+		Safra:    msg.Safra,
+	}
+}
+
+// WithHeader returns a copy of msg with the shared fields of h.
+func (msg message) WithHeader(h core.Header) core.Message {
+	msg.Host = h.Host
+	msg.Port = h.Port
+	msg.Message = h.Kind
+	msg.Clock = h.Clock
+	msg.Snapshot = h.Snapshot
+	msg.Channel = h.Channel
+	msg.Safra = h.Safra
+	return msg
+}
+
+// peer returns node n as a peer of the core.
+func (n node) peer() core.Peer {
+	return core.Peer{Host: n.Host, Port: n.Port, Socket: n.Socket}
+}
+
+// peersOf returns nodes as peers of the core.
+func peersOf(nodes []node) []core.Peer {
+	out := make([]core.Peer, 0, len(nodes))
+	for _, n := range nodes {
+		out = append(out, n.peer())
+	}
+
+	return out
+}
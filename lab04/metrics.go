@@ -0,0 +1,13 @@
+package main
+
+import "distributed-systems/core"
+
+// Gauges of the election, exposed with the metrics of the node.
+var leaderGauge = core.Gauge("node_leader", "Leader currently known to the node.")
+var roundGauge = core.Gauge("node_round", "Election round currently known to the node.")
+
+// setLeaderMetrics records the leader and round currently known to the node.
+func setLeaderMetrics(leader int, round int) {
+	leaderGauge(leader)
+	roundGauge(round)
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+
+	"distributed-systems/core"
+)
+
+// Messages used by the partition aware election.
+const (
+	HEARTBEAT = "#HEARTBEAT#"
+	WAVE      = "wave"
+	ECHO      = "echo"
+	ELECTED   = "elected"
+)
+
+// wave is the state of the current node in the election wave it takes part
+// in. A wave is tagged with the Round it was started in, the random Id drawn by
+// its initiator and a random Nonce that breaks ties between initiators that
+// drew the same ID. Parent is the port of the neighbour the wave arrived from
+// (empty for the initiator), Pending holds the ports of the neighbours whose
+// echo is still awaited and Size is the number of nodes in the subtree of the
+// current node. The count of the network size leaves Nonce at 0.
+type wave struct {
+	Round   int
+	Id      int
+	Nonce   int
+	Parent  string
+	Pending map[string]bool
+	Size    int
+}
+
+var partitionAware bool                    // Run the partition aware election.
+var heartbeatInterval time.Duration        // Interval between heartbeats.
+var suspectTimeout time.Duration           // Silence after which a neighbour is unreachable.
+var currentWave wave                       // Wave the current node takes part in.
+var maxRound int                           // Highest round seen so far.
+var leaderSize int                         // Size of the component of the current leader.
+var reachable = make(map[string]bool)      // Reachability of neighbours by port.
+var lastHeard = make(map[string]time.Time) // Last message from neighbours by port.
+var topologyChanged bool                   // Reachability changed since the last wave.
+
+// runPartitionAware runs the partition aware election. Neighbours are watched
+// with heartbeats and every time a neighbour becomes unreachable or reachable
+// again a new election wave is started in a new round with a fresh random ID.
+// Only the wave with the highest (round, ID, nonce) tag completes, so every
+// connected component elects exactly one leader and learns its size without
+// knowing the size of the network. When two components merge the new wave
+// covers both of them and exactly one leader survives.
+func runPartitionAware() {
+	log.Println("Running partition aware election.")
+
+	core.Every(heartbeatInterval, watchNeighbours)
+}
+
+// watchNeighbours sends a heartbeat to every neighbour and starts a new wave
+// if the reachability of a neighbour changed.
+func watchNeighbours() {
+	for _, n := range neighbours {
+		sendMessageOnce(n, message{
+			Host:    self.Host,
+			Port:    self.Port,
+			Message: HEARTBEAT,
+			Leader:  leader,
+			Round:   roundNumber,
+		})
+
+		up := time.Since(lastHeard[n.Port]) < suspectTimeout
+		if up != reachable[n.Port] {
+			if up {
+				log.Printf("Neighbour %s:%s is reachable.\n", n.Host, n.Port)
+			} else {
+				log.Printf("Neighbour %s:%s is unreachable.\n", n.Host, n.Port)
+			}
+			reachable[n.Port] = up
+			topologyChanged = true
+		}
+	}
+
+	if topologyChanged {
+		topologyChanged = false
+		startWave()
+	}
+}
+
+// handlePartitionMessage handles a message of the partition aware election
+// on the event loop.
+func handlePartitionMessage(msg message) {
+	lastHeard[msg.Port] = time.Now()
+	if msg.Round > maxRound {
+		maxRound = msg.Round
+	}
+
+	switch msg.Message {
+	case WAVE:
+		receiveWave(msg)
+	case ECHO:
+		receiveEcho(msg)
+	case ELECTED:
+		receiveElected(msg)
+	}
+}
+
+// startWave starts a new wave in a new round with a fresh random ID and the
+// current node as initiator. It must be called on the event loop.
+func startWave() {
+	maxRound++
+	randomId = getRandomId()
+	currentWave = wave{
+		Round:   maxRound,
+		Id:      randomId,
+		Nonce:   rand.Int(),
+		Pending: make(map[string]bool),
+		Size:    1,
+	}
+	log.Printf("Starting wave in round %d with ID %d.\n", currentWave.Round, currentWave.Id)
+	core.WaveStarted()
+
+	forwardWave()
+}
+
+// compareWave compares the tag of msg with the tag of the current wave and
+// returns -1, 0 or 1 if it is lower, equal or higher.
+func compareWave(msg message) int {
+	tag := []int{msg.Round, msg.Leader, msg.Nonce}
+	current := []int{currentWave.Round, currentWave.Id, currentWave.Nonce}
+
+	for idx := range tag {
+		if tag[idx] < current[idx] {
+			return -1
+		}
+		if tag[idx] > current[idx] {
+			return 1
+		}
+	}
+
+	return 0
+}
+
+// receiveWave handles a wave message. Waves with a lower tag than the current
+// one are extinguished, a wave with a higher tag is joined and the wave
+// message of the current wave from another neighbour counts as its echo.
+func receiveWave(msg message) {
+	switch compareWave(msg) {
+	case 0:
+		delete(currentWave.Pending, msg.Port)
+		checkWave()
+		return
+	case -1:
+		log.Printf("Extinguishing wave of ID %d in round %d.\n", msg.Leader, msg.Round)
+		return
+	}
+
+	log.Printf("Joining wave of ID %d in round %d, parent is %s:%s.\n", msg.Leader, msg.Round, msg.Host, msg.Port)
+	currentWave = wave{
+		Round:   msg.Round,
+		Id:      msg.Leader,
+		Nonce:   msg.Nonce,
+		Parent:  msg.Port,
+		Pending: make(map[string]bool),
+		Size:    1,
+	}
+	core.WaveStarted()
+
+	forwardWave()
+}
+
+// forwardWave sends the current wave to all reachable neighbours except the
+// parent. It must be called on the event loop.
+func forwardWave() {
+	for _, n := range neighbours {
+		if n.Port == currentWave.Parent || !reachable[n.Port] {
+			continue
+		}
+
+		currentWave.Pending[n.Port] = true
+		sendMessageOnce(n, message{
+			Host:    self.Host,
+			Port:    self.Port,
+			Message: WAVE,
+			Leader:  currentWave.Id,
+			Round:   currentWave.Round,
+			Nonce:   currentWave.Nonce,
+		})
+	}
+
+	checkWave()
+}
+
+// receiveEcho handles the echo of a neighbour in the current wave.
+func receiveEcho(msg message) {
+	if compareWave(msg) != 0 || currentWave.Pending == nil {
+		return
+	}
+
+	currentWave.Size += msg.Size
+	delete(currentWave.Pending, msg.Port)
+
+	checkWave()
+}
+
+// checkWave completes the current wave once all echoes arrived. The initiator
+// is elected, every other node echoes the size of its subtree to its parent.
+// It must be called on the event loop.
+func checkWave() {
+	if currentWave.Pending == nil || len(currentWave.Pending) > 0 {
+		return
+	}
+	currentWave.Pending = nil
+	core.WaveCompleted()
+
+	if currentWave.Parent == "" {
+		log.Printf("Wave of round %d completed.\n", currentWave.Round)
+		receiveElected(message{
+			Host:    self.Host,
+			Port:    self.Port,
+			Message: ELECTED,
+			Leader:  currentWave.Id,
+			Round:   currentWave.Round,
+			Size:    currentWave.Size,
+		})
+		return
+	}
+
+	for _, n := range neighbours {
+		if n.Port == currentWave.Parent {
+			sendMessageOnce(n, message{
+				Host:    self.Host,
+				Port:    self.Port,
+				Message: ECHO,
+				Leader:  currentWave.Id,
+				Round:   currentWave.Round,
+				Size:    currentWave.Size,
+				Nonce:   currentWave.Nonce,
+			})
+		}
+	}
+}
+
+// receiveElected adopts the leader elected in the round of msg, unless a
+// leader of a later round is already known, and floods it to all reachable
+// neighbours.
+func receiveElected(msg message) {
+	if msg.Round <= roundNumber {
+		return
+	}
+
+	log.Printf("Leader of component is: %d (round %d, size %d).\n", msg.Leader, msg.Round, msg.Size)
+	core.LogLocal(core.EVENT_DECIDE, fmt.Sprintf("round %d leader %d size %d", msg.Round, msg.Leader, msg.Size))
+
+	leader = msg.Leader
+	roundNumber = msg.Round
+	leaderSize = msg.Size
+	status = msg.Port == self.Port
+	setLeaderMetrics(leader, roundNumber)
+
+	for _, n := range neighbours {
+		if n.Port == msg.Port || !reachable[n.Port] {
+			continue
+		}
+
+		sendMessageOnce(n, message{
+			Host:    self.Host,
+			Port:    self.Port,
+			Message: ELECTED,
+			Leader:  msg.Leader,
+			Round:   msg.Round,
+			Size:    msg.Size,
+		})
+	}
+}
+
+// sendMessageOnce sends msg of type message to node recvAddr, subject to the
+// injected faults. Unlike sendMessage it gives up if the node cannot be
+// dialled, since the partition aware election must not block on unreachable
+// neighbours.
+func sendMessageOnce(recvAddr node, msg message) {
+	core.SendOnce(recvAddr.peer(), msg, suspectTimeout)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"distributed-systems/clustertest"
+)
+
+var componentPattern = regexp.MustCompile(`Leader of component is: \d+ \(round \d+, size \d+\)`) // Leader a node follows.
+
+// TestPartitionAwareElection partitions a ring of clustertest.NODES nodes
+// running the partition aware election into nodes 1 to 3 and nodes 4 to 8,
+// checks that each component elects a single leader and learns its size, heals
+// the partition and checks that exactly one leader survives.
+func TestPartitionAwareElection(t *testing.T) {
+	c := clustertest.New(t, "anon")
+
+	ring := c.Network(t, "ring", func(n int) []string {
+		next := n%clustertest.NODES + 1
+		prev := (n+clustertest.NODES-2)%clustertest.NODES + 1
+		return []string{c.Address(n, fmt.Sprintf(":%d:*", clustertest.NODES)), c.Address(next, ""), c.Address(prev, "")}
+	})
+
+	// size accepts the decision of a group that learned its own size.
+	size := func(group []int, decided string) bool {
+		return strings.HasSuffix(decided, fmt.Sprintf(", size %d)", len(group)))
+	}
+	all := []int{1, 2, 3, 4, 5, 6, 7, 8}
+	steps := []clustertest.Partition{
+		{Name: "before the partition", Groups: [][]int{all}, Expect: size},
+		{Name: "during the partition", Faults: "partition=10001,10002,10003/10004,10005,10006,10007,10008",
+			Groups: [][]int{{1, 2, 3}, {4, 5, 6, 7, 8}}, Expect: size},
+		{Name: "after healing", Faults: "partition=", Groups: [][]int{all}, Expect: size},
+	}
+
+	c.RunPartitions(t, ring, componentPattern, 20*time.Second, steps, "-partition-aware")
+}
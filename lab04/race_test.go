@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"testing"
+
+	"distributed-systems/clustertest"
+	"distributed-systems/core"
+)
+
+var leaderPattern = regexp.MustCompile(`Leader is \d+ \(round \d+`) // Leader a node terminates with.
+
+// TestElectionIsRaceFree runs the anonymous election on rings of
+// clustertest.NODES nodes built with the race detector, while their metrics
+// are scraped: on a bidirectional ring with every way to learn the network size, partition aware
+// until the timeout, and as Itai-Rodeh election on a unidirectional ring.
+func TestElectionIsRaceFree(t *testing.T) {
+	c := clustertest.New(t, "anon")
+
+	// Every node lists its clockwise neighbour first and, unless the ring is
+	// unidirectional, its anticlockwise one second.
+	network := func(name string, bidirectional bool) string {
+		return c.Network(t, name, func(n int) []string {
+			next := n%clustertest.NODES + 1
+			prev := (n+clustertest.NODES-2)%clustertest.NODES + 1
+			lines := []string{c.Address(n, fmt.Sprintf(":%d:*", clustertest.NODES)), c.Address(next, "")}
+			if bidirectional {
+				lines = append(lines, c.Address(prev, ""))
+			}
+			return lines
+		})
+	}
+	ring := network("ring", true)
+	unidirectional := network("unidirectional", false)
+
+	metrics := clustertest.FreeAddrs(t, clustertest.NODES)
+	requests := clustertest.MetricsRequests(metrics)
+	nodeArgs := func(n int) []string {
+		return []string{"-metrics", metrics[n-1]}
+	}
+
+	for _, size := range []string{"config", "count", "exponential"} {
+		t.Run(size, func(t *testing.T) {
+			outputs := c.Run(t, ring, core.EXIT_DECIDED, nodeArgs, requests, "-size", size)
+			clustertest.ExpectAgreement(t, outputs, leaderPattern)
+		})
+	}
+
+	t.Run("partition-aware", func(t *testing.T) {
+		c.Run(t, ring, core.EXIT_TIMED_OUT, nodeArgs, requests, "-partition-aware", "-timeout", "10s")
+	})
+
+	t.Run("itai-rodeh", func(t *testing.T) {
+		outputs := c.Run(t, unidirectional, core.EXIT_DECIDED, nodeArgs, requests, "-ring")
+		clustertest.ExpectAgreement(t, outputs, leaderPattern)
+	})
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+
+	"distributed-systems/core"
+)
+
+// TOKEN carries the random ID of an active node around the ring.
+const (
+	TOKEN = "token"
+)
+
+var ringElection bool // Run the Itai-Rodeh election on a unidirectional ring.
+var ringPassive bool  // The current node no longer takes part in the election.
+
+// runRing runs the Itai-Rodeh election on a unidirectional ring of known size.
+// The first neighbour in the config file is the next node on the ring, which
+// is the only node messages are sent to. Every initiator draws a random ID
+// with getRandomId and sends a token around the ring carrying its round, its
+// ID, a hop count and a bit that is cleared by any other active node with the
+// same round and ID. A token that comes back after travelling the whole ring
+// with the bit still set elects its node, with the bit cleared the node starts
+// the next round with a new ID.
+func runRing() {
+	if len(neighbours) != 1 {
+		panic("Ring election needs exactly one neighbour, the next node on the ring.")
+	}
+
+	log.Printf("Running Itai-Rodeh election on a ring of %d nodes, next node is %s:%s.\n",
+		numNodes, neighbours[0].Host, neighbours[0].Port)
+
+	if self.IsInitiator && !ringPassive {
+		startRingRound(1)
+	}
+}
+
+// startRingRound makes the current node draw a new random ID for round and
+// sends its token to the next node. It must be called on the event loop.
+func startRingRound(round int) {
+	randomId = getRandomId()
+	leader = randomId
+	roundNumber = round
+	status = true
+
+	log.Printf("Starting round %d with ID %d.\n", round, randomId)
+	core.LogLocal(core.EVENT_STATE_CHANGE, fmt.Sprintf("round %d leader %d", roundNumber, leader))
+	setLeaderMetrics(leader, roundNumber)
+	core.WaveStarted()
+
+	sendMessage(neighbours[0], message{
+		Host:    self.Host,
+		Port:    self.Port,
+		Message: TOKEN,
+		Leader:  randomId,
+		Round:   round,
+		Hop:     1,
+		Bit:     true,
+	})
+}
+
+// handleRingMessage handles a message of the ring election on the event loop.
+func handleRingMessage(msg message) {
+	switch msg.Message {
+	case TOKEN:
+		receiveToken(msg)
+	case ELECTED:
+		receiveRingLeader(msg)
+	case TERMINATE:
+		receiveTerminateRing(msg)
+	}
+}
+
+// passOn passes msg on to the next node on the ring, one hop further.
+func passOn(msg message) {
+	msg.Host, msg.Port = self.Host, self.Port
+	msg.Hop++
+	sendMessage(neighbours[0], msg)
+}
+
+// receiveToken handles the token of an active node. Passive nodes pass every
+// token on and never start a round of their own. An active node makes way for
+// a token of a higher round or ID and purges a token of a lower one. A token
+// of the same round and ID either is its own token back after numNodes hops or
+// belongs to another node that drew the same ID, whose token is passed on with
+// its bit cleared. It must be called on the event loop.
+func receiveToken(msg message) {
+	if msg.Hop == numNodes {
+		if !status || msg.Round != roundNumber || msg.Leader != randomId {
+			log.Printf("Purging token of ID %d in round %d, it went around the ring.\n", msg.Leader, msg.Round)
+			return
+		}
+
+		if msg.Bit {
+			electRing()
+			return
+		}
+
+		log.Printf("Tie in round %d, another node drew ID %d too.\n", roundNumber, randomId)
+		core.WaveCompleted()
+		startRingRound(roundNumber + 1)
+		return
+	}
+
+	if !status {
+		// A node that passes a token on before it started a round of its own
+		// stays passive, the token went past it without seeing its ID.
+		ringPassive = true
+		passOn(msg)
+		return
+	}
+
+	switch {
+	case msg.Round > roundNumber || msg.Round == roundNumber && msg.Leader > randomId:
+		log.Printf("Becoming passive, token of ID %d in round %d is higher.\n", msg.Leader, msg.Round)
+		status = false
+		ringPassive = true
+		leader = msg.Leader
+		roundNumber = msg.Round
+		setLeaderMetrics(leader, roundNumber)
+		core.WaveCompleted()
+		core.LogLocal(core.EVENT_STATE_CHANGE, fmt.Sprintf("round %d leader %d passive", roundNumber, leader))
+		passOn(msg)
+		return
+	case msg.Round < roundNumber || msg.Leader < randomId:
+		log.Printf("Purging token of ID %d in round %d.\n", msg.Leader, msg.Round)
+		return
+	}
+
+	log.Printf("Another node drew ID %d in round %d.\n", msg.Leader, msg.Round)
+	msg.Bit = false
+	passOn(msg)
+}
+
+// electRing makes the current node the leader and sends the leader around the
+// ring. It must be called on the event loop.
+func electRing() {
+	log.Printf("I was elected leader in round %d, %.2f rounds are expected when all %d nodes initiate.\n",
+		roundNumber, expectedRounds(numNodes, numNodes), numNodes)
+	core.WaveCompleted()
+
+	sendMessage(neighbours[0], message{
+		Host:    self.Host,
+		Port:    self.Port,
+		Message: ELECTED,
+		Leader:  randomId,
+		Round:   roundNumber,
+		Hop:     1,
+	})
+}
+
+// receiveRingLeader records the leader and passes it on, until it is back at
+// the leader, which then starts detecting termination. It must be called on
+// the event loop.
+func receiveRingLeader(msg message) {
+	leader = msg.Leader
+	roundNumber = msg.Round
+	setLeaderMetrics(leader, roundNumber)
+	log.Printf("Leader is %d (round %d).\n", leader, roundNumber)
+	core.LogLocal(core.EVENT_DECIDE, fmt.Sprintf("round %d leader %d", roundNumber, leader))
+
+	if msg.Hop == numNodes {
+		core.StartSafra()
+		return
+	}
+
+	passOn(msg)
+}
+
+// terminateRing is called by the leader once termination has been detected.
+// It sends the message to terminate around the ring.
+func terminateRing() {
+	sendMessage(neighbours[0], message{
+		Host:    self.Host,
+		Port:    self.Port,
+		Message: TERMINATE,
+		Leader:  leader,
+		Round:   roundNumber,
+		Hop:     1,
+	})
+}
+
+// receiveTerminateRing passes the message to terminate on, until it is back
+// at the leader, and stops the current node as decided. It must be called on
+// the event loop.
+func receiveTerminateRing(msg message) {
+	if msg.Hop != numNodes {
+		passOn(msg)
+	}
+
+	log.Printf("I am : %d, leader is %d.\n", randomId, leader)
+	core.Stop(core.EXIT_DECIDED)
+}
+
+// expectedRounds returns the expected number of rounds of the Itai-Rodeh
+// election when k nodes draw their IDs from 1 to n. A round with k active
+// nodes ends with the m of them that drew the highest ID, which is m with
+// probability C(k, m) (1/n)^m ((v-1)/n)^(k-m) summed over the highest ID v,
+// and the election ends once m is 1.
+func expectedRounds(k int, n int) float64 {
+	rounds := make([]float64, k+1)
+	for active := 1; active <= k; active++ {
+		if active == 1 {
+			rounds[active] = 1
+			continue
+		}
+
+		// Probability that exactly m of the active nodes drew the highest ID.
+		ties := make([]float64, active+1)
+		for m := 1; m <= active; m++ {
+			for v := 1; v <= n; v++ {
+				ties[m] += binomial(active, m) * math.Pow(1/float64(n), float64(m)) *
+					math.Pow(float64(v-1)/float64(n), float64(active-m))
+			}
+		}
+
+		expected := 1.0
+		for m := 2; m < active; m++ {
+			expected += ties[m] * rounds[m]
+		}
+		rounds[active] = expected / (1 - ties[active])
+	}
+
+	return rounds[k]
+}
+
+// binomial returns the binomial coefficient n choose k.
+func binomial(n int, k int) float64 {
+	result := 1.0
+	for idx := 1; idx <= k; idx++ {
+		result = result * float64(n-k+idx) / float64(idx)
+	}
+
+	return result
+}
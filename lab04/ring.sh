@@ -0,0 +1,52 @@
+#! /bin/bash
+
+# Usage: ./ring.sh [runs] [flags...]
+#
+# Runs the Itai-Rodeh election on the ring of 5 nodes of the config/ring
+# directory the given number of times (20 by default), passing any further
+# flags to every node, checks that in every run all nodes agree on the leader
+# and terminate cleanly, and compares the average number of rounds with the
+# expected number of rounds.
+
+set -u
+
+RUNS=${1:-20}
+shift
+DIR=$(mktemp -d)
+
+cleanup() {
+    kill $(jobs -p) 2>/dev/null
+    wait 2>/dev/null
+}
+trap cleanup EXIT
+
+go build -o $DIR/anon *.go || exit 1
+echo "Logs are in $DIR."
+
+for run in $(seq $RUNS); do
+    for n in 1 2 3 4 5; do
+        (timeout 120 $DIR/anon -ring -config config/ring/configFile_600$n.txt "$@" > $DIR/run_${run}_600$n.log 2>&1
+         echo "exit $?" >> $DIR/run_${run}_600$n.log) &
+    done
+    wait
+
+    decided=$(grep -h "Leader is [0-9]* (" $DIR/run_${run}_600*.log | sed "s/.*Leader is //; s/\.$//" | sort -u)
+    if [ $(echo "$decided" | wc -l) -ne 1 ] || [ $(grep -h "Leader is [0-9]* (" $DIR/run_${run}_600*.log | wc -l) -ne 5 ]; then
+        echo "FAIL: run $run, nodes should agree on the leader, got:"
+        grep -H "Leader is [0-9]* (" $DIR/run_${run}_600*.log
+        exit 1
+    fi
+
+    if [ "$(grep -h '^exit' $DIR/run_${run}_600*.log | sort -u)" != "exit 0" ]; then
+        echo "FAIL: run $run, not all nodes terminated cleanly."
+        exit 1
+    fi
+
+    echo "OK: run $run, leader $decided."
+done
+
+grep -h "I was elected leader" $DIR/run_*_600*.log | sed 's/.*in round \([0-9]*\), \([0-9.]*\) rounds.*/\1 \2/' |
+    awk '{ rounds += $1; expected = $2; runs++ }
+        END { printf "Rounds: %.2f on average over %d runs, %.2f expected.\n", rounds / runs, runs, expected }'
+
+echo "PASS"
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"log"
+	"math"
+	"strconv"
+	"time"
+
+	"distributed-systems/core"
+)
+
+// Messages used to learn the size of the network.
+const (
+	COUNT   = "count"
+	COUNTED = "counted"
+	SIZE    = "size"
+	MINS    = "mins"
+)
+
+var sizeMode string                    // How the size of the network is learned: config, count or exponential.
+var sizeSamples int                    // Number of exponential samples drawn by every node.
+var sizeUpper float64                  // Upper bound of the size of the network.
+var sizeLearned = make(chan bool)      // Closed once the size of the network is known.
+var heldBack []message                 // Election messages held back until the size is known.
+var countWave wave                     // Counting wave the current node takes part in.
+var sizeMins []float64                 // Minimum of every exponential sample seen.
+var sizeChanged time.Time              // Last time sizeMins changed.
+var sizeConfidence = 1.959963984540054 // Quantile of the standard normal distribution for 95% confidence.
+
+// setupSize checks the size mode and draws the exponential samples of the
+// current node if the size is to be estimated.
+func setupSize() {
+	switch sizeMode {
+	case "config":
+		if numNodes <= 0 {
+			panic("Invalid network size, please give it in the config file or pass -size count or -size exponential.")
+		}
+		sizeUpper = float64(numNodes)
+		close(sizeLearned)
+	case "count", "exponential":
+		if partitionAware || ringElection {
+			panic("The partition aware and ring elections need the network size from the config file.")
+		}
+		numNodes = 0 // Ignore the size in the config file.
+	default:
+		panic("Invalid size mode, please pass config, count or exponential.")
+	}
+
+	if sizeMode != "exponential" {
+		return
+	}
+
+	if sizeSamples < 3 {
+		panic("Invalid number of samples, please pass at least 3.")
+	}
+
+	sizeMins = make([]float64, sizeSamples)
+	for idx := range sizeMins {
+		sizeMins[idx] = idRand.ExpFloat64()
+	}
+	sizeChanged = time.Now()
+}
+
+// learnSize learns the size of the network, unless it was given in the config
+// file. With -size count the nodes count themselves exactly with an echo wave
+// that uses their ports as IDs, so that only the wave of the highest port
+// completes. With -size exponential every node draws exponentially distributed
+// samples and the nodes flood the minimum of each sample through the network,
+// which is exponentially distributed with the size of the network as its rate.
+// The estimate is taken once the minimums did not change for the suspect
+// timeout.
+func learnSize() {
+	switch sizeMode {
+	case "count":
+		startCount()
+	case "exponential":
+		sendMins("")
+		core.After(heartbeatInterval, checkMins)
+	}
+}
+
+// checkMins estimates the size of the network once the minimums did not
+// change for the suspect timeout, otherwise it checks again after the
+// heartbeat interval.
+func checkMins() {
+	if time.Since(sizeChanged) > suspectTimeout {
+		estimateSize()
+		return
+	}
+
+	core.After(heartbeatInterval, checkMins)
+}
+
+// waitForSize blocks until the size of the network is known. It reports false
+// if the node stopped before.
+func waitForSize() bool {
+	select {
+	case <-sizeLearned:
+		return true
+	case <-core.Done():
+		return false
+	}
+}
+
+// sizeKnown tells the waiting main goroutine that the size of the network is
+// known and handles the election messages that were held back until now.
+func sizeKnown() {
+	close(sizeLearned)
+
+	for _, msg := range heldBack {
+		handleElectionMessage(msg)
+	}
+	heldBack = nil
+}
+
+// reachedAll reports whether a wave that reached size nodes reached the whole
+// network. With an estimated size the number of nodes is only known to be at
+// most sizeUpper, so a wave has to reach more than half of that. No other wave
+// can then have reached as many nodes, as long as the network is no larger
+// than the bound. The bound only holds with 95% confidence, so in about 2.5%
+// of the runs two leaders may be elected.
+func reachedAll(size int) bool {
+	if sizeMode == "exponential" {
+		return float64(size) > sizeUpper/2
+	}
+
+	return size >= numNodes
+}
+
+// handleSizeMessage handles a message used to learn the size of the network
+// on the event loop.
+func handleSizeMessage(msg message) {
+	switch msg.Message {
+	case COUNT:
+		receiveCount(msg)
+	case COUNTED:
+		if msg.Leader == countWave.Id && countWave.Pending[msg.Port] {
+			countWave.Size += msg.Size
+			delete(countWave.Pending, msg.Port)
+			checkCount()
+		}
+	case SIZE:
+		receiveSize(msg)
+	case MINS:
+		receiveMins(msg)
+	}
+}
+
+// startCount starts a counting wave tagged with the port of the current node,
+// unless the node already takes part in the wave of a higher port. It must be
+// called on the event loop.
+func startCount() {
+	port, _ := strconv.Atoi(self.Port)
+	if countWave.Id > port {
+		return
+	}
+
+	log.Println("Counting the nodes of the network.")
+	countWave = wave{Id: port, Pending: make(map[string]bool), Size: 1}
+	forwardCount()
+}
+
+// receiveCount handles the counting wave of a neighbour. Waves of lower ports
+// are extinguished, the wave of a higher port is joined and a wave message of
+// the current wave counts as an echo of an empty subtree.
+func receiveCount(msg message) {
+	switch {
+	case msg.Leader < countWave.Id:
+		return
+	case msg.Leader == countWave.Id:
+		delete(countWave.Pending, msg.Port)
+		checkCount()
+		return
+	}
+
+	countWave = wave{Id: msg.Leader, Parent: msg.Port, Pending: make(map[string]bool), Size: 1}
+	forwardCount()
+}
+
+// forwardCount sends the counting wave to all neighbours except the parent. It
+// must be called on the event loop.
+func forwardCount() {
+	for _, n := range neighbours {
+		if n.Port == countWave.Parent {
+			continue
+		}
+
+		countWave.Pending[n.Port] = true
+		sendMessage(n, message{
+			Host:    self.Host,
+			Port:    self.Port,
+			Message: COUNT,
+			Leader:  countWave.Id,
+		})
+	}
+
+	checkCount()
+}
+
+// checkCount echoes the number of nodes in the subtree of the current node to
+// its parent once all neighbours replied. The initiator then knows the size of
+// the network and floods it. It must be called on the event loop.
+func checkCount() {
+	if countWave.Pending == nil || len(countWave.Pending) > 0 {
+		return
+	}
+	countWave.Pending = nil
+
+	if countWave.Parent == "" {
+		receiveSize(message{Host: self.Host, Port: self.Port, Message: SIZE, Size: countWave.Size})
+		return
+	}
+
+	for _, n := range neighbours {
+		if n.Port == countWave.Parent {
+			sendMessage(n, message{
+				Host:    self.Host,
+				Port:    self.Port,
+				Message: COUNTED,
+				Leader:  countWave.Id,
+				Size:    countWave.Size,
+			})
+		}
+	}
+}
+
+// receiveSize learns the size of the network counted by the wave of the
+// highest port and floods it to all other neighbours. It must be called on
+// the event loop.
+func receiveSize(msg message) {
+	if numNodes > 0 {
+		return
+	}
+
+	numNodes = msg.Size
+	sizeUpper = float64(numNodes)
+	log.Printf("Counted %d nodes.\n", numNodes)
+
+	for _, n := range neighbours {
+		if n.Port == msg.Port {
+			continue
+		}
+
+		sendMessage(n, message{
+			Host:    self.Host,
+			Port:    self.Port,
+			Message: SIZE,
+			Leader:  countWave.Id,
+			Size:    numNodes,
+		})
+	}
+
+	sizeKnown()
+}
+
+// receiveMins merges the minimums of a neighbour into the minimums of the
+// current node and passes them on if any of them decreased. It must be called
+// on the event loop.
+func receiveMins(msg message) {
+	if len(msg.Mins) != len(sizeMins) {
+		log.Printf("Ignoring %d samples from %s:%s, expected %d.\n", len(msg.Mins), msg.Host, msg.Port, len(sizeMins))
+		return
+	}
+
+	changed := false
+	for idx, min := range msg.Mins {
+		if min < sizeMins[idx] {
+			sizeMins[idx] = min
+			changed = true
+		}
+	}
+
+	if !changed {
+		return
+	}
+	sizeChanged = time.Now()
+
+	sendMins(msg.Port)
+}
+
+// sendMins sends the minimums of the current node to all neighbours except the
+// one with port skip. It must be called on the event loop.
+func sendMins(skip string) {
+	for _, n := range neighbours {
+		if n.Port == skip {
+			continue
+		}
+
+		sendMessage(n, message{
+			Host:    self.Host,
+			Port:    self.Port,
+			Message: MINS,
+			Mins:    append([]float64(nil), sizeMins...),
+		})
+	}
+}
+
+// estimateSize estimates the size of the network from the minimums. The sum S
+// of k minimums of exponential samples with rate 1 from n nodes is Gamma
+// distributed with shape k and rate n, so (k-1)/S estimates n without bias and
+// the quantiles of the Gamma distribution, approximated as by Wilson and
+// Hilferty, bound it with 95% confidence. The IDs are then drawn up to the
+// upper bound. It must be called on the event loop.
+func estimateSize() {
+	sum := 0.0
+	for _, min := range sizeMins {
+		sum += min
+	}
+
+	k := float64(len(sizeMins))
+	quantile := func(z float64) float64 {
+		return k * math.Pow(1-1/(9*k)+z/(3*math.Sqrt(k)), 3)
+	}
+
+	estimate := (k - 1) / sum
+	lower := quantile(-sizeConfidence) / sum
+	sizeUpper = quantile(sizeConfidence) / sum
+	numNodes = int(math.Ceil(sizeUpper))
+
+	log.Printf("Estimated %.1f nodes, between %.1f and %.1f with 95%% confidence.\n", estimate, lower, sizeUpper)
+	sizeKnown()
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// decision is a Value chosen for a Slot of the replicated log, and whether it
+// is the value Proposed.
+type decision struct {
+	Slot     int
+	Value    string
+	Proposed bool
+}
+
+func main() {
+	// Setup and parse CLI flags.
+	addr := flag.String("node", "127.0.0.1:9401", "Address the Paxos node serves proposals on.")
+	value := flag.String("value", "", "Value to propose, the values chosen so far are listed if empty.")
+	flag.Parse()
+
+	if *value == "" {
+		listChosen(*addr)
+		return
+	}
+
+	resp, err := http.Post("http://"+*addr+"/propose", "text/plain", strings.NewReader(*value))
+	if err != nil {
+		panic("Error sending proposal: " + err.Error())
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		panic("Error reading decision: " + err.Error())
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		fmt.Printf("Proposal of %q failed: %s\n", *value, strings.TrimSpace(string(body)))
+		os.Exit(1)
+	}
+
+	var decisions []decision
+	if err := json.Unmarshal(body, &decisions); err != nil {
+		panic("Error reading decision: " + err.Error())
+	}
+
+	for _, d := range decisions {
+		if d.Proposed {
+			fmt.Printf("Slot %d chose %q, the proposed value.\n", d.Slot, d.Value)
+		} else {
+			fmt.Printf("Slot %d chose %q instead of %q.\n", d.Slot, d.Value, *value)
+		}
+	}
+}
+
+// listChosen prints the values the node at addr learned by slot.
+func listChosen(addr string) {
+	resp, err := http.Get("http://" + addr + "/chosen")
+	if err != nil {
+		panic("Error requesting chosen values: " + err.Error())
+	}
+	defer resp.Body.Close()
+
+	var chosen map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&chosen); err != nil {
+		panic("Error reading chosen values: " + err.Error())
+	}
+
+	slots := make([]int, 0, len(chosen))
+	for slot := range chosen {
+		s, _ := strconv.Atoi(slot)
+		slots = append(slots, s)
+	}
+	sort.Ints(slots)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SLOT\tVALUE")
+	for _, s := range slots {
+		fmt.Fprintf(w, "%d\t%s\n", s, chosen[strconv.Itoa(s)])
+	}
+	w.Flush()
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// snapshot is the part of a global snapshot recorded by a single node. State
+// and the in-flight messages in Channels are kept generic since every lab
+// records a different local state and message layout.
+type snapshot struct {
+	Id       string
+	Node     string
+	State    map[string]interface{}
+	Channels map[string][]map[string]interface{}
+}
+
+// globalSnapshot is a global snapshot put together from the snapshots of all
+// nodes that took part in it.
+type globalSnapshot struct {
+	Id    string
+	Nodes []snapshot
+}
+
+func main() {
+	// Setup and parse CLI flags.
+	dir := flag.String("dir", ".", "Directory holding the snapshot files of every node.")
+	id := flag.String("id", "", "ID of the snapshot to put together, the latest if empty.")
+	outFile := flag.String("out", "", "Path to write the global snapshot to as JSON.")
+	flag.Parse()
+
+	paths, err := filepath.Glob(filepath.Join(*dir, "snapshot_*.json"))
+	if err != nil || len(paths) == 0 {
+		panic("No snapshot files found in " + *dir + ".")
+	}
+
+	snapshots := make(map[string][]snapshot)
+	written := make(map[string]time.Time) // Time the last file of every snapshot was written.
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			panic("Error reading snapshot file " + path + ".")
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			panic("Error reading snapshot file " + path + ".")
+		}
+
+		var s snapshot
+		if err := json.Unmarshal(data, &s); err != nil {
+			log.Printf("Skipping malformed snapshot %s: %v\n", path, err)
+			continue
+		}
+		snapshots[s.Id] = append(snapshots[s.Id], s)
+		if info.ModTime().After(written[s.Id]) {
+			written[s.Id] = info.ModTime()
+		}
+	}
+
+	if *id == "" {
+		for sid := range snapshots {
+			if *id == "" || written[sid].After(written[*id]) {
+				*id = sid
+			}
+		}
+	}
+
+	nodes, ok := snapshots[*id]
+	if !ok {
+		panic(fmt.Sprintf("No snapshot with ID %s found.", *id))
+	}
+
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Node < nodes[j].Node })
+	global := globalSnapshot{Id: *id, Nodes: nodes}
+
+	printSnapshot(global)
+
+	if *outFile != "" {
+		data, err := json.MarshalIndent(global, "", "  ")
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := ioutil.WriteFile(*outFile, data, 0644); err != nil {
+			panic("Error writing global snapshot.")
+		}
+		log.Println("Wrote global snapshot to: " + *outFile)
+	}
+}
+
+// printSnapshot prints the local state of every node in global along with the
+// messages that were in flight towards it.
+func printSnapshot(global globalSnapshot) {
+	fmt.Printf("Snapshot %s recorded by %d nodes.\n\n", global.Id, len(global.Nodes))
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NODE\tLEADER\tROUND\tPARENT\tREPLIED\tIN FLIGHT")
+
+	leaders := make(map[string]int)
+	for _, s := range global.Nodes {
+		self, _ := s.State["Self"].(map[string]interface{})
+		parent, _ := self["ParentMessage"].(map[string]interface{})
+
+		parentAddr := "-"
+		if host, _ := parent["Host"].(string); host != "" {
+			parentAddr = fmt.Sprintf("%s:%v", host, parent["Port"])
+		}
+
+		replied := make([]string, 0)
+		neighbours, _ := s.State["Neighbours"].([]interface{})
+		for _, n := range neighbours {
+			if nb, ok := n.(map[string]interface{}); ok && nb["HasReplied"] == true {
+				replied = append(replied, fmt.Sprintf("%v", nb["Port"]))
+			}
+		}
+
+		inFlight := 0
+		for _, msgs := range s.Channels {
+			inFlight += len(msgs)
+		}
+
+		leader := field(s.State["Leader"], self["Leader"])
+		leaders[leader]++
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\n", s.Node, leader, field(s.State["RoundNumber"]),
+			parentAddr, strings.Join(replied, ","), inFlight)
+	}
+	w.Flush()
+	fmt.Println()
+
+	for _, s := range global.Nodes {
+		for channel, msgs := range s.Channels {
+			for _, msg := range msgs {
+				fmt.Printf("In flight %s -> %s: %v (leader %s, round %s)\n", channel, s.Node,
+					msg["Message"], field(msg["Leader"]), field(msg["Round"]))
+			}
+		}
+	}
+
+	if len(leaders) > 1 {
+		fmt.Printf("Nodes disagree on the leader: %v\n", leaders)
+	} else {
+		for leader := range leaders {
+			fmt.Printf("All nodes agree on leader %s.\n", leader)
+		}
+	}
+}
+
+// field formats the first of values that is set, or "-" if none are.
+func field(values ...interface{}) string {
+	for _, v := range values {
+		if v != nil {
+			return fmt.Sprintf("%v", v)
+		}
+	}
+
+	return "-"
+}
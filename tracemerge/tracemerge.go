@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Layout of the space-time diagram, in pixels.
+const (
+	MARGIN_LEFT  = 160
+	MARGIN_TOP   = 40
+	ROW_HEIGHT   = 60
+	COLUMN_WIDTH = 40
+)
+
+// event is a single entry of the structured event log written by a node with
+// the `-events` flag. Message is kept as a generic map since every lab sends a
+// different message layout.
+type event struct {
+	Time    time.Time              `json:"time"`
+	Node    string                 `json:"node"`
+	NodeId  int                    `json:"nodeId,omitempty"`
+	Clock   int                    `json:"clock"`
+	Type    string                 `json:"type"`
+	Peer    string                 `json:"peer,omitempty"`
+	Message map[string]interface{} `json:"message,omitempty"`
+	Detail  string                 `json:"detail,omitempty"`
+}
+
+// arrow connects the send event of a message to its receive event. From and
+// To are indices into the merged timeline.
+type arrow struct {
+	From int
+	To   int
+}
+
+func main() {
+	// Setup and parse CLI flags.
+	outFile := flag.String("out", "", "Path to write the merged timeline to, stdout if empty.")
+	diagramFile := flag.String("diagram", "", "Path to write a space-time diagram to (.svg or .html).")
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		panic("No event logs given, pass the event log of every node as arguments.")
+	}
+
+	events := make([]event, 0)
+	for _, path := range flag.Args() {
+		events = append(events, readEvents(path)...)
+	}
+
+	timeline := mergeEvents(events)
+	arrows := matchMessages(timeline)
+
+	out := os.Stdout
+	if *outFile != "" {
+		f, err := os.Create(*outFile)
+		if err != nil {
+			panic("Error creating output file.")
+		}
+		defer f.Close()
+		out = f
+	}
+
+	encoder := json.NewEncoder(out)
+	for _, e := range timeline {
+		if err := encoder.Encode(e); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *diagramFile != "" {
+		writeDiagram(*diagramFile, timeline, arrows)
+	}
+}
+
+// readEvents reads all events from the event log at path.
+func readEvents(path string) []event {
+	f, err := os.Open(path)
+	if err != nil {
+		panic("Error reading event log " + path + ".")
+	}
+	defer f.Close()
+
+	events := make([]event, 0)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+
+		var e event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			log.Printf("Skipping malformed event in %s: %v\n", path, err)
+			continue
+		}
+		events = append(events, e)
+	}
+
+	log.Printf("Read %d events from %s.\n", len(events), path)
+
+	return events
+}
+
+// mergeEvents orders events by Lamport clock, breaking ties by node. Since
+// the clock of a receive is always greater than that of the matching send and
+// the clock of a node only grows, the result is a causally consistent
+// timeline.
+func mergeEvents(events []event) []event {
+	sort.SliceStable(events, func(i, j int) bool {
+		if events[i].Clock != events[j].Clock {
+			return events[i].Clock < events[j].Clock
+		}
+		return events[i].Node < events[j].Node
+	})
+
+	return events
+}
+
+// matchMessages pairs every receive in timeline with the send of the same
+// message. A message is identified by its sender, its receiver and the clock
+// it was stamped with.
+func matchMessages(timeline []event) []arrow {
+	sends := make(map[string]int)
+	for idx, e := range timeline {
+		if e.Type == "send" {
+			sends[fmt.Sprintf("%s>%s@%d", e.Node, e.Peer, e.Clock)] = idx
+		}
+	}
+
+	arrows := make([]arrow, 0)
+	for idx, e := range timeline {
+		if e.Type != "receive" {
+			continue
+		}
+
+		clock, _ := e.Message["Clock"].(float64)
+		key := fmt.Sprintf("%s>%s@%d", e.Peer, e.Node, int(clock))
+
+		if from, ok := sends[key]; ok {
+			arrows = append(arrows, arrow{From: from, To: idx})
+		} else {
+			log.Printf("No send found for receive at %s with clock %d.\n", e.Node, e.Clock)
+		}
+	}
+
+	return arrows
+}
+
+// writeDiagram writes a space-time diagram of timeline to path. The format is
+// chosen from the extension of path, .html wraps the SVG diagram in a page
+// that also lists every event.
+func writeDiagram(path string, timeline []event, arrows []arrow) {
+	f, err := os.Create(path)
+	if err != nil {
+		panic("Error creating diagram file.")
+	}
+	defer f.Close()
+
+	if strings.ToLower(filepath.Ext(path)) == ".html" {
+		fmt.Fprintln(f, "<!DOCTYPE html>")
+		fmt.Fprintln(f, "<html><head><meta charset=\"utf-8\"><title>Space-time diagram</title>")
+		fmt.Fprintln(f, "<style>body{font-family:sans-serif}td,th{padding:2px 8px;text-align:left}</style>")
+		fmt.Fprintln(f, "</head><body>")
+		writeSVG(f, timeline, arrows)
+		fmt.Fprintln(f, "<table><tr><th>Clock</th><th>Node</th><th>Type</th><th>Peer</th><th>Message</th><th>Detail</th></tr>")
+		for _, e := range timeline {
+			fmt.Fprintf(f, "<tr><td>%d</td><td>%s</td><td>%s</td><td>%s</td><td>%s</td><td>%s</td></tr>\n",
+				e.Clock, html.EscapeString(e.Node), html.EscapeString(e.Type), html.EscapeString(e.Peer),
+				html.EscapeString(messageKind(e)), html.EscapeString(e.Detail))
+		}
+		fmt.Fprintln(f, "</table></body></html>")
+	} else {
+		writeSVG(f, timeline, arrows)
+	}
+
+	log.Println("Wrote space-time diagram to: " + path)
+}
+
+// writeSVG writes timeline as an SVG space-time diagram with one horizontal
+// line per node, one column per Lamport clock value and an arrow for every
+// message.
+func writeSVG(w io.Writer, timeline []event, arrows []arrow) {
+	rows := make(map[string]int)
+	nodes := make([]string, 0)
+	columns := make(map[int]int)
+	clocks := make([]int, 0)
+
+	for _, e := range timeline {
+		if _, ok := rows[e.Node]; !ok {
+			rows[e.Node] = 0
+			nodes = append(nodes, e.Node)
+		}
+		if _, ok := columns[e.Clock]; !ok {
+			columns[e.Clock] = 0
+			clocks = append(clocks, e.Clock)
+		}
+	}
+
+	sort.Strings(nodes)
+	for idx, n := range nodes {
+		rows[n] = idx
+	}
+	sort.Ints(clocks)
+	for idx, c := range clocks {
+		columns[c] = idx
+	}
+
+	x := func(e event) int { return MARGIN_LEFT + columns[e.Clock]*COLUMN_WIDTH }
+	y := func(e event) int { return MARGIN_TOP + rows[e.Node]*ROW_HEIGHT }
+
+	width := MARGIN_LEFT + (len(clocks)+1)*COLUMN_WIDTH
+	height := MARGIN_TOP + len(nodes)*ROW_HEIGHT
+
+	fmt.Fprintf(w, "<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%d\" height=\"%d\" font-family=\"sans-serif\" font-size=\"12\">\n", width, height)
+	fmt.Fprintln(w, "<defs><marker id=\"head\" markerWidth=\"8\" markerHeight=\"8\" refX=\"8\" refY=\"4\" orient=\"auto\"><path d=\"M0,0 L8,4 L0,8 z\" fill=\"#555\"/></marker></defs>")
+
+	for idx, n := range nodes {
+		rowY := MARGIN_TOP + idx*ROW_HEIGHT
+		fmt.Fprintf(w, "<text x=\"10\" y=\"%d\">%s</text>\n", rowY+4, html.EscapeString(n))
+		fmt.Fprintf(w, "<line x1=\"%d\" y1=\"%d\" x2=\"%d\" y2=\"%d\" stroke=\"#000\"/>\n", MARGIN_LEFT-10, rowY, width-10, rowY)
+	}
+
+	for _, a := range arrows {
+		from, to := timeline[a.From], timeline[a.To]
+		fmt.Fprintf(w, "<line x1=\"%d\" y1=\"%d\" x2=\"%d\" y2=\"%d\" stroke=\"#555\" marker-end=\"url(#head)\"><title>%s</title></line>\n",
+			x(from), y(from), x(to), y(to), html.EscapeString(messageKind(from)))
+	}
+
+	colours := map[string]string{
+		"send":         "#1f77b4",
+		"receive":      "#2ca02c",
+		"state-change": "#ff7f0e",
+		"decide":       "#d62728",
+	}
+
+	for _, e := range timeline {
+		colour, ok := colours[e.Type]
+		if !ok {
+			colour = "#7f7f7f"
+		}
+
+		title := fmt.Sprintf("%s clock=%d %s %s %s", e.Node, e.Clock, e.Type, messageKind(e), e.Detail)
+		fmt.Fprintf(w, "<circle cx=\"%d\" cy=\"%d\" r=\"5\" fill=\"%s\"><title>%s</title></circle>\n",
+			x(e), y(e), colour, html.EscapeString(strings.TrimSpace(title)))
+
+		if e.Type == "decide" {
+			fmt.Fprintf(w, "<text x=\"%d\" y=\"%d\" fill=\"%s\">%s</text>\n", x(e)+6, y(e)-8, colour, html.EscapeString(e.Detail))
+		}
+	}
+
+	fmt.Fprintln(w, "</svg>")
+}
+
+// messageKind returns the kind of the message carried by e, if any.
+func messageKind(e event) string {
+	if kind, ok := e.Message["Message"].(string); ok {
+		return kind
+	}
+
+	return ""
+}